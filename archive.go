@@ -0,0 +1,129 @@
+package flea
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"math"
+	"os"
+)
+
+// The archive is the third residency tier, for records cold enough that
+// default queries skip them, see Options.ArchiveFunc. archive.ndjson.gz is
+// a gzip file of NDJSON lines, written as one gzip member per offloaded
+// batch so that it can grow without rewriting what is already there. An
+// archived record is located by the file offset of its member, and by the
+// offset and size of its line once the member is decompressed.
+//
+// Like data.ndjson, the archive is only a spill area: archived records are
+// written to every snapshot, and the archive is rebuilt on Open.
+
+// archiveWindow holds the last decompressed member of the archive, so that
+// reading the records of a batch in order decompresses it once.
+type archiveWindow struct {
+	member int64
+	data   []byte
+}
+
+func (w *archiveWindow) read(file File, member, offset, size int64) ([]byte, error) {
+	if w.data == nil || w.member != member {
+		zr, err := gzip.NewReader(bufio.NewReader(io.NewSectionReader(file, member, math.MaxInt64-member)))
+		if err != nil {
+			return nil, err
+		}
+		// stop at the end of this member
+		zr.Multistream(false)
+		data, err := io.ReadAll(zr)
+		if err != nil {
+			return nil, err
+		}
+		w.member, w.data = member, data
+	}
+	if offset+size > int64(len(w.data)) {
+		return nil, fmt.Errorf("archived record at %d+%d is past the end of its member", member, offset)
+	}
+	return w.data[offset : offset+size], nil
+}
+
+func (s *Store[ID, T]) getArchivePath() string {
+	return s.getPath("archive.ndjson.gz")
+}
+
+// openArchive creates an empty archive, discarding the one of a previous
+// run: archived records are rebuilt from the snapshot and the WAL.
+func (s *Store[ID, T]) openArchive() error {
+	if s.archiveFn == nil {
+		return nil
+	}
+	f, err := s.fs.OpenFile(s.getArchivePath(), os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	s.archiveFile = f
+	s.archiveWindow = &archiveWindow{}
+	return nil
+}
+
+// appendToArchive offloads batch to the archive as a single gzip member.
+// Like the data file, the archive is never synced.
+func (s *Store[ID, T]) appendToArchive(batch []*record[T]) error {
+	member, err := s.archiveFile.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	offsets := make([]int64, len(batch))
+	sizes := make([]int64, len(batch))
+	var offset int64
+	for i, rec := range batch {
+		b, err := s.encode(*rec.value, rec.blob)
+		if err != nil {
+			return err
+		}
+		if s.verifyOffload {
+			s.checkOffloaded(*rec.value, b)
+		}
+		zw.Write(b)
+		zw.Write([]byte{'\n'})
+		offsets[i], sizes[i] = offset, int64(len(b))
+		offset += int64(len(b)) + 1
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+
+	if _, err := s.archiveFile.Write(buf.Bytes()); err != nil {
+		return err
+	}
+
+	s.onlineCount -= len(batch)
+	s.offlineCount += len(batch)
+	s.archivedCount += len(batch)
+
+	for i, rec := range batch {
+		rec.archived = true
+		rec.member = member
+		rec.offset = offsets[i]
+		rec.size = sizes[i]
+		rec.value = nil
+		rec.offloaded = true
+	}
+	return nil
+}
+
+// loadArchived reads the value of an archived record. A failed read is
+// counted in Stats.ReadErrors.
+func (s *Store[ID, T]) loadArchived(rec *record[T]) (v T, err error) {
+	defer s.countReadError(&err)
+
+	var zero T
+	data, err := s.archiveWindow.read(s.archiveFile, rec.member, rec.offset, rec.size)
+	if err != nil {
+		return zero, fmt.Errorf("%w: %w", ErrIO, err)
+	}
+	return s.decodeScratch(data)
+}
@@ -3,7 +3,11 @@ package flea
 import (
 	"fmt"
 	"math/rand"
+	"os"
+	"path/filepath"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 const USERS_AMOUNT = 300000
@@ -87,6 +91,33 @@ func BenchmarkGet_All_MixedMemoryDisk(b *testing.B) {
 	_ = result
 }
 
+func BenchmarkGet_AllOffline(b *testing.B) {
+	minusOne := -1
+
+	store, _ := Open[uint64, testUser](Options[uint64, testUser]{
+		Dir: b.TempDir(),
+		IDFunc: func(u testUser) (uint64, error) {
+			return u.Id, nil
+		},
+		MaxInMemoryRecords: &minusOne,
+		ResidencyFunc:      func(testUser) bool { return false },
+	})
+	defer store.Close()
+
+	values := make([]testUser, USERS_AMOUNT)
+	for i := range values {
+		values[i] = testUser{Id: uint64(i + 1), Val: i}
+	}
+	store.PutAll(values)
+
+	b.ReportAllocs()
+	for b.Loop() {
+		if got := store.Get(nil); len(got) != USERS_AMOUNT {
+			b.Fatalf("expected %d values, got %d", USERS_AMOUNT, len(got))
+		}
+	}
+}
+
 func BenchmarkPerf_1MUsers_90PercentInDisk_GetFromDisk(b *testing.B) {
 	const total = 1_000_000
 	maxOnline := 100_000 // 10% online
@@ -132,8 +163,8 @@ func BenchmarkPerf_1MUsers_90PercentInDisk_GetFromDisk(b *testing.B) {
 	// registro garantidamente offline
 	targetId := uint64(999_999)
 
-	rec, ok := store.index[targetId]
-	if !ok || rec.value != nil {
+	info, ok := store.Inspect(targetId)
+	if !ok || info.Online {
 		b.Fatal("target must be offline")
 	}
 
@@ -298,3 +329,207 @@ func BenchmarkGetByID_OnDisk(b *testing.B) {
 	}
 
 }
+
+func openGetAllBenchStore(b *testing.B) *Store[uint64, testUser] {
+	b.Helper()
+
+	store, err := Open[uint64, testUser](Options[uint64, testUser]{
+		Dir: b.TempDir(),
+		IDFunc: func(u testUser) (uint64, error) {
+			return u.Id, nil
+		},
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	values := make([]testUser, USERS_AMOUNT)
+	for i := 0; i < USERS_AMOUNT; i++ {
+		values[i] = testUser{Id: uint64(i + 1), Val: i}
+	}
+	store.PutAll(values)
+
+	// tombstones inflate len(records) over the live count
+	store.Delete(func(u testUser) bool { return u.Id%2 == 0 })
+
+	return store
+}
+
+func BenchmarkGet_AllPredicate(b *testing.B) {
+	store := openGetAllBenchStore(b)
+	defer store.Close()
+
+	b.ReportAllocs()
+	for b.Loop() {
+		_ = store.Get(all[testUser])
+	}
+}
+
+func BenchmarkGetAll(b *testing.B) {
+	store := openGetAllBenchStore(b)
+	defer store.Close()
+
+	b.ReportAllocs()
+	for b.Loop() {
+		_ = store.GetAll()
+	}
+}
+
+// countingFS counts the opens of, and the writes to, the offline data file.
+type countingFS struct {
+	OSFS
+	opens  atomic.Int64
+	writes atomic.Int64
+}
+
+type countingFile struct {
+	File
+	fs *countingFS
+}
+
+func (c *countingFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	f, err := c.OSFS.OpenFile(name, flag, perm)
+	if err != nil || filepath.Base(name) != "data.ndjson" {
+		return f, err
+	}
+	c.opens.Add(1)
+	return countingFile{File: f, fs: c}, nil
+}
+
+func (f countingFile) Write(p []byte) (int, error) {
+	f.fs.writes.Add(1)
+	return f.File.Write(p)
+}
+
+func BenchmarkPutAll_SustainedOffload(b *testing.B) {
+	fs := &countingFS{}
+	max := 1000
+	store, err := Open[uint64, testUser](Options[uint64, testUser]{
+		Dir:                b.TempDir(),
+		FS:                 fs,
+		IDFunc:             func(u testUser) (uint64, error) { return u.Id, nil },
+		MaxInMemoryRecords: &max,
+		ResidencyFunc:      func(testUser) bool { return false },
+		SnapshotInterval:   time.Hour,
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer store.Close()
+
+	const batch = 1000
+	values := make([]testUser, batch)
+	opens, writes := fs.opens.Load(), fs.writes.Load()
+
+	var id uint64
+	for b.Loop() {
+		for i := range values {
+			id++
+			values[i] = testUser{Id: id, Val: int(id)}
+		}
+		if _, err := store.PutAll(values); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.ReportMetric(float64(fs.opens.Load()-opens)/float64(b.N), "opens/op")
+	b.ReportMetric(float64(fs.writes.Load()-writes)/float64(b.N), "writes/op")
+}
+
+func BenchmarkPut_GroupCommit(b *testing.B) {
+	for _, window := range []time.Duration{0, 200 * time.Microsecond} {
+		b.Run(fmt.Sprintf("window=%v", window), func(b *testing.B) {
+			store, err := Open[uint64, testUser](Options[uint64, testUser]{
+				Dir:               b.TempDir(),
+				IDFunc:            func(u testUser) (uint64, error) { return u.Id, nil },
+				SnapshotInterval:  time.Hour,
+				GroupCommitWindow: window,
+			})
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer store.Close()
+
+			var id atomic.Uint64
+			b.SetParallelism(128)
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					n := id.Add(1)
+					if _, err := store.Put(testUser{Id: n, Val: int(n)}); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkDelete_Many(b *testing.B) {
+	store, err := Open[uint64, testUser](Options[uint64, testUser]{
+		Dir:              b.TempDir(),
+		IDFunc:           func(u testUser) (uint64, error) { return u.Id, nil },
+		SnapshotInterval: time.Hour,
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer store.Close()
+
+	const batch = 10000
+	values := make([]testUser, batch)
+	for i := range values {
+		values[i] = testUser{Id: uint64(i), Val: i}
+	}
+
+	for b.Loop() {
+		b.StopTimer()
+		if _, err := store.PutAll(values); err != nil {
+			b.Fatal(err)
+		}
+		b.StartTimer()
+
+		deleted, err := store.Delete(func(testUser) bool { return true })
+		if err != nil {
+			b.Fatal(err)
+		}
+		if len(deleted) != batch {
+			b.Fatalf("expected %d deletes, got %d", batch, len(deleted))
+		}
+	}
+}
+
+func BenchmarkGet_ExpensivePredicate(b *testing.B) {
+	// stands in for a CPU-heavy predicate, e.g. a regexp or a distance
+	expensive := func(u testUser) bool {
+		h := uint64(u.Val)
+		for range 2000 {
+			h = h*6364136223846793005 + 1442695040888963407
+		}
+		return h%2 == 0
+	}
+
+	for _, workers := range []int{0, 8} {
+		b.Run(fmt.Sprintf("parallelism=%d", workers), func(b *testing.B) {
+			store, err := Open[uint64, testUser](Options[uint64, testUser]{
+				Dir:            b.TempDir(),
+				IDFunc:         func(u testUser) (uint64, error) { return u.Id, nil },
+				GetParallelism: workers,
+			})
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer store.Close()
+
+			values := make([]testUser, 100000)
+			for i := range values {
+				values[i] = testUser{Id: uint64(i), Val: i}
+			}
+			store.PutAll(values)
+
+			for b.Loop() {
+				store.Get(expensive)
+			}
+		})
+	}
+}
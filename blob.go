@@ -0,0 +1,202 @@
+package flea
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+)
+
+// With Options.BlobField, the bytes of the blob field of every record are
+// written once to blobs.bin, and the field is replaced by a short reference
+// in the WAL, the snapshot and the data files: blobMarker followed by the
+// offset and the size of the blob in blobs.bin. Values are given their blob
+// back whenever they are decoded, so the field keeps its bytes in memory
+// and in every value handed to callers.
+//
+// Unlike data.ndjson, blobs.bin is not a spill area: the WAL and the
+// snapshot point into it, so it is never truncated. Blobs of overwritten
+// and deleted records are not reclaimed.
+
+// blobMarker starts the reference to a blob. It is not valid UTF-8, so
+// text stored in a blob field is never mistaken for it.
+const blobMarker = "\xfe\xffflea:blob:"
+
+// blobRef locates a blob in blobs.bin. The zero blobRef means the record
+// has no blob there.
+type blobRef struct {
+	offset int64
+	size   int64
+}
+
+func (r blobRef) valid() bool {
+	return r.size > 0
+}
+
+func (r blobRef) marker() []byte {
+	b := []byte(blobMarker)
+	b = strconv.AppendInt(b, r.offset, 10)
+	b = append(b, ':')
+	return strconv.AppendInt(b, r.size, 10)
+}
+
+// parseBlobMarker returns the reference held by a blob field, if it holds
+// one.
+func parseBlobMarker(field []byte) (blobRef, bool) {
+	rest, ok := bytes.CutPrefix(field, []byte(blobMarker))
+	if !ok {
+		return blobRef{}, false
+	}
+	off, size, ok := bytes.Cut(rest, []byte(":"))
+	if !ok {
+		return blobRef{}, false
+	}
+	o, err1 := strconv.ParseInt(string(off), 10, 64)
+	n, err2 := strconv.ParseInt(string(size), 10, 64)
+	if err1 != nil || err2 != nil || o < 0 || n <= 0 {
+		return blobRef{}, false
+	}
+	return blobRef{offset: o, size: n}, true
+}
+
+func (s *Store[ID, T]) getBlobPath() string {
+	return s.getPath("blobs.bin")
+}
+
+// openBlobs opens blobs.bin, read-only for a read-only store.
+func (s *Store[ID, T]) openBlobs() error {
+	if s.blobField == nil {
+		return nil
+	}
+	var f File
+	var err error
+	if s.readOnly {
+		f, err = s.fs.Open(s.getBlobPath())
+		if os.IsNotExist(err) {
+			return nil
+		}
+	} else {
+		f, err = s.fs.OpenFile(s.getBlobPath(), os.O_CREATE|os.O_RDWR, 0644)
+	}
+	if err != nil {
+		return err
+	}
+	s.blobFile = f
+	return nil
+}
+
+// storeBlob appends a blob to blobs.bin, without syncing it.
+func (s *Store[ID, T]) storeBlob(b []byte) (blobRef, error) {
+	offset, err := s.blobFile.Seek(0, io.SeekEnd)
+	if err != nil {
+		return blobRef{}, err
+	}
+	if _, err := s.blobFile.Write(b); err != nil {
+		return blobRef{}, err
+	}
+	return blobRef{offset: offset, size: int64(len(b))}, nil
+}
+
+// ensureBlob returns ref when it is valid, or stores the blob of v and
+// returns where it went. Values with an empty blob field, and stores
+// without blobs.bin, have no blob to store.
+func (s *Store[ID, T]) ensureBlob(v *T, ref blobRef) (blobRef, error) {
+	if ref.valid() || s.blobFile == nil {
+		return ref, nil
+	}
+	field := *s.blobField(v)
+	if len(field) == 0 {
+		return blobRef{}, nil
+	}
+	ref, err := s.storeBlob(field)
+	if err != nil {
+		return blobRef{}, fmt.Errorf("%w: %w", ErrIO, err)
+	}
+	return ref, nil
+}
+
+// syncBlobs syncs blobs.bin, so that the references about to be written
+// don't outlive the blobs they point to.
+func (s *Store[ID, T]) syncBlobs() error {
+	if s.blobFile == nil {
+		return nil
+	}
+	if err := s.blobFile.Sync(); err != nil {
+		return fmt.Errorf("%w: %w", ErrIO, err)
+	}
+	return nil
+}
+
+// attachBlob replaces the reference held by the blob field of v with the
+// blob it points to, and returns the reference.
+func (s *Store[ID, T]) attachBlob(v *T) (blobRef, error) {
+	if s.blobField == nil {
+		return blobRef{}, nil
+	}
+	field := s.blobField(v)
+	ref, ok := parseBlobMarker(*field)
+	if !ok {
+		return blobRef{}, nil
+	}
+	if s.blobFile == nil {
+		return blobRef{}, fmt.Errorf("%w: blob at %d+%d, but there is no %s", ErrIO, ref.offset, ref.size, s.getBlobPath())
+	}
+	b := make([]byte, ref.size)
+	if _, err := s.blobFile.ReadAt(b, ref.offset); err != nil {
+		return blobRef{}, fmt.Errorf("%w: blob at %d+%d: %w", ErrIO, ref.offset, ref.size, err)
+	}
+	*field = b
+	return ref, nil
+}
+
+// encode marshals a value to be written to the WAL, the snapshot or the
+// data files, with its blob replaced by ref when it has one.
+func (s *Store[ID, T]) encode(v T, ref blobRef) ([]byte, error) {
+	if ref.valid() {
+		// v is a copy: only its slice header is replaced
+		*s.blobField(&v) = ref.marker()
+	}
+	return json.Marshal(v)
+}
+
+// inlineBlob returns the encoded value data with its blob in place of the
+// reference to it.
+func (s *Store[ID, T]) inlineBlob(data []byte) ([]byte, error) {
+	var v T
+	if err := json.Unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+	if _, err := s.attachBlob(&v); err != nil {
+		return nil, err
+	}
+	return json.Marshal(v)
+}
+
+// walOps stores the blobs of the put ops, recording where each went in the
+// op, and returns the ops as they are written to the WAL.
+func (s *Store[ID, T]) walOps(ops []walOp[ID, T]) ([]walOp[ID, T], error) {
+	if s.blobFile == nil {
+		return ops, nil
+	}
+	out := make([]walOp[ID, T], len(ops))
+	for i := range ops {
+		out[i] = ops[i]
+		if ops[i].Op != opPut {
+			continue
+		}
+		ref, err := s.ensureBlob(&ops[i].Value, ops[i].blob)
+		if err != nil {
+			return nil, err
+		}
+		ops[i].blob = ref
+		if ref.valid() {
+			*s.blobField(&out[i].Value) = ref.marker()
+		}
+	}
+	if err := s.syncBlobs(); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
@@ -0,0 +1,130 @@
+package flea
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// ErrNotRegistered is returned by Get when no store was registered for a type.
+var ErrNotRegistered = errors.New("flea: type not registered in catalog")
+
+// Catalog groups the stores of several types under one directory.
+//
+// Types are registered with Register and their stores are opened lazily by
+// the first Get. All stores of a catalog share a single Scheduler, and each
+// one still locks its own model directory.
+type Catalog struct {
+	mu        sync.Mutex
+	dir       string
+	entries   map[reflect.Type]*catalogEntry
+	scheduler *Scheduler
+}
+
+type catalogEntry struct {
+	open  func() (any, error)
+	store any
+	close func() error
+}
+
+// OpenCatalog creates a catalog rooted at dir. Every interval, all the
+// stores opened so far are snapshotted. It defaults to 30s.
+func OpenCatalog(dir string, interval time.Duration) *Catalog {
+	if dir == "" {
+		dir = "."
+	}
+	if interval == 0 {
+		interval = 30 * time.Second
+	}
+
+	return &Catalog{
+		dir:       dir,
+		entries:   make(map[reflect.Type]*catalogEntry),
+		scheduler: NewScheduler(interval),
+	}
+}
+
+// Register records the options used to open the store of T. The store is
+// not opened until the first Get. opts.Dir and opts.Scheduler are owned by
+// the catalog and ignored, and so is opts.SnapshotInterval.
+func Register[ID comparable, T any](c *Catalog, opts Options[ID, T]) error {
+	opts.Dir = c.dir
+	opts.Scheduler = c.scheduler
+
+	if err := opts.Validate(); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := reflect.TypeFor[T]()
+	if _, ok := c.entries[key]; ok {
+		return fmt.Errorf("flea: type %s already registered", key)
+	}
+
+	entry := &catalogEntry{}
+	entry.open = func() (any, error) {
+		s, err := newStore(opts)
+		if err != nil {
+			return nil, err
+		}
+		if err := s.openStorage(); err != nil {
+			return nil, err
+		}
+		if s.wal != nil {
+			s.startSnapshots()
+		}
+		entry.close = s.Close
+		return s, nil
+	}
+	c.entries[key] = entry
+
+	return nil
+}
+
+// Get returns the store registered for T, opening it on first use.
+func Get[ID comparable, T any](c *Catalog) (*Store[ID, T], error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := reflect.TypeFor[T]()
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrNotRegistered, key)
+	}
+
+	if entry.store == nil {
+		s, err := entry.open()
+		if err != nil {
+			return nil, err
+		}
+		entry.store = s
+	}
+
+	s, ok := entry.store.(*Store[ID, T])
+	if !ok {
+		return nil, fmt.Errorf("flea: type %s registered with a different id type", key)
+	}
+	return s, nil
+}
+
+// Close stops the scheduler and closes every opened store.
+func (c *Catalog) Close() error {
+	c.scheduler.Close()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var errs []error
+	for _, entry := range c.entries {
+		if entry.store == nil {
+			continue
+		}
+		errs = append(errs, entry.close())
+		entry.store = nil
+	}
+	return errors.Join(errs...)
+}
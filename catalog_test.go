@@ -0,0 +1,77 @@
+package flea
+
+import (
+	"errors"
+	"testing"
+)
+
+func registerUserAndOrder(t *testing.T, c *Catalog) {
+	t.Helper()
+
+	if err := Register(c, Options[uint64, User]{IDFunc: userID}); err != nil {
+		t.Fatalf("register users failed: %v", err)
+	}
+	if err := Register(c, Options[uint64, Order]{
+		IDFunc: func(o Order) (uint64, error) { return o.Id, nil },
+	}); err != nil {
+		t.Fatalf("register orders failed: %v", err)
+	}
+}
+
+func TestCatalog_RoundTripTwoTypes(t *testing.T) {
+	dir := t.TempDir()
+
+	c := OpenCatalog(dir, 0)
+	registerUserAndOrder(t, c)
+
+	userStore, err := Get[uint64, User](c)
+	if err != nil {
+		t.Fatalf("get users failed: %v", err)
+	}
+	orderStore, err := Get[uint64, Order](c)
+	if err != nil {
+		t.Fatalf("get orders failed: %v", err)
+	}
+
+	again, _ := Get[uint64, User](c)
+	if again != userStore {
+		t.Fatalf("expected the catalog to cache the user store")
+	}
+
+	userStore.Put(User{Id: 1, Name: "Alice"})
+	orderStore.PutAll([]Order{{Id: 100, Amount: 50}, {Id: 200, Amount: 75}})
+
+	if err := c.Close(); err != nil {
+		t.Fatalf("close failed: %v", err)
+	}
+
+	// ---- reopen ----
+	c = OpenCatalog(dir, 0)
+	defer c.Close()
+	registerUserAndOrder(t, c)
+
+	userStore, err = Get[uint64, User](c)
+	if err != nil {
+		t.Fatalf("get users failed: %v", err)
+	}
+	if users := userStore.Get(all[User]); len(users) != 1 || users[0].Name != "Alice" {
+		t.Fatalf("unexpected users after reopen: %+v", users)
+	}
+
+	orderStore, err = Get[uint64, Order](c)
+	if err != nil {
+		t.Fatalf("get orders failed: %v", err)
+	}
+	if orders := orderStore.Get(all[Order]); len(orders) != 2 {
+		t.Fatalf("expected 2 orders after reopen, got %d", len(orders))
+	}
+}
+
+func TestCatalog_GetUnregisteredType(t *testing.T) {
+	c := OpenCatalog(t.TempDir(), 0)
+	defer c.Close()
+
+	if _, err := Get[uint64, User](c); !errors.Is(err, ErrNotRegistered) {
+		t.Fatalf("expected ErrNotRegistered, got %v", err)
+	}
+}
@@ -0,0 +1,290 @@
+package flea
+
+import (
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"time"
+)
+
+var (
+	jsonMarshalerType = reflect.TypeFor[json.Marshaler]()
+	textMarshalerType = reflect.TypeFor[encoding.TextMarshaler]()
+)
+
+// checkRoundTrip reports the first field of t that encoding/json would drop
+// or fail to encode: unexported fields, fields tagged `json:"-"`, and
+// channel, func or complex values. Types with their own JSON or text
+// marshaler are trusted as is.
+func checkRoundTrip(t reflect.Type) error {
+	return checkType(t, t.String(), map[reflect.Type]bool{})
+}
+
+// hasMarshaler reports whether t encodes itself through a JSON or text
+// marshaler.
+func hasMarshaler(t reflect.Type) bool {
+	pt := reflect.PointerTo(t)
+	return t.Implements(jsonMarshalerType) || t.Implements(textMarshalerType) ||
+		pt.Implements(jsonMarshalerType) || pt.Implements(textMarshalerType)
+}
+
+func checkType(t reflect.Type, path string, seen map[reflect.Type]bool) error {
+	if hasMarshaler(t) {
+		return nil
+	}
+
+	switch t.Kind() {
+	case reflect.Chan, reflect.Func, reflect.UnsafePointer, reflect.Complex64, reflect.Complex128:
+		return fmt.Errorf("%w: %s has unsupported type %s", ErrLossyType, path, t)
+	case reflect.Pointer, reflect.Slice, reflect.Array:
+		return checkType(t.Elem(), path, seen)
+	case reflect.Map:
+		return checkType(t.Elem(), path, seen)
+	case reflect.Struct:
+		if seen[t] {
+			return nil
+		}
+		seen[t] = true
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			name := path + "." + f.Name
+			if !f.IsExported() && !isEmbeddedStruct(f) {
+				return fmt.Errorf("%w: %s is unexported", ErrLossyType, name)
+			}
+			if f.Tag.Get("json") == "-" {
+				return fmt.Errorf("%w: %s is tagged json:\"-\"", ErrLossyType, name)
+			}
+			if err := checkType(f.Type, name, seen); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// isEmbeddedStruct reports whether f is an embedded struct, whose exported
+// fields encoding/json promotes even when the struct type is unexported.
+func isEmbeddedStruct(f reflect.StructField) bool {
+	t := f.Type
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	return f.Anonymous && t.Kind() == reflect.Struct
+}
+
+// typeSig fingerprints the types a store was written with, so that Open
+// can tell when its files hold records of another type. Fields maps the
+// JSON name of every top-level field of T to the JSON kind of its values.
+type typeSig struct {
+	ID     string            `json:"id"`
+	Name   string            `json:"name"`
+	Fields map[string]string `json:"fields,omitempty"`
+}
+
+func typeSigOf[ID comparable, T any]() *typeSig {
+	t := reflect.TypeFor[T]()
+	sig := &typeSig{ID: reflect.TypeFor[ID]().String(), Name: t.String()}
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct || hasMarshaler(t) {
+		return sig
+	}
+	sig.Fields = make(map[string]string)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		// the fields of embedded structs are promoted, and left out
+		if name == "-" || !f.IsExported() || f.Anonymous && name == "" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		sig.Fields[name] = jsonKind(f.Type)
+	}
+	return sig
+}
+
+// jsonKind returns how encoding/json encodes values of t, coarsely enough
+// that changing an int to an int64 keeps the same kind.
+func jsonKind(t reflect.Type) string {
+	if hasMarshaler(t) {
+		return "any"
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		return jsonKind(t.Elem())
+	case reflect.Bool:
+		return "bool"
+	case reflect.String:
+		return "string"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			// base64
+			return "string"
+		}
+		return "array"
+	case reflect.Array:
+		return "array"
+	case reflect.Map, reflect.Struct:
+		return "object"
+	}
+	return "any"
+}
+
+// compatible returns ErrTypeMismatch unless records written with stored
+// decode into the types of sig. Fields added or removed since are fine, as
+// encoding/json skips them; a field that changed kind is not.
+func (sig *typeSig) compatible(stored *typeSig) error {
+	if stored == nil {
+		// written before types were recorded
+		return nil
+	}
+	if stored.ID != sig.ID {
+		return fmt.Errorf("%w: ids are %s, not %s", ErrTypeMismatch, stored.ID, sig.ID)
+	}
+	if stored.Name != sig.Name {
+		return fmt.Errorf("%w: records are %s, not %s", ErrTypeMismatch, stored.Name, sig.Name)
+	}
+	for name, kind := range stored.Fields {
+		k, ok := sig.Fields[name]
+		if ok && k != kind && k != "any" && kind != "any" {
+			return fmt.Errorf("%w: field %s of %s holds a %s, not a %s", ErrTypeMismatch, name, sig.Name, kind, k)
+		}
+	}
+	return nil
+}
+
+// hasFloats reports whether values of t can hold a float, so checkFinite can
+// be skipped for types that can't.
+func hasFloats(t reflect.Type) bool {
+	return typeHasFloats(t, map[reflect.Type]bool{})
+}
+
+func typeHasFloats(t reflect.Type, seen map[reflect.Type]bool) bool {
+	if hasMarshaler(t) {
+		return false
+	}
+
+	switch t.Kind() {
+	case reflect.Float32, reflect.Float64, reflect.Interface:
+		return true
+	case reflect.Pointer, reflect.Slice, reflect.Array, reflect.Map:
+		return typeHasFloats(t.Elem(), seen)
+	case reflect.Struct:
+		if seen[t] {
+			return false
+		}
+		seen[t] = true
+		for i := 0; i < t.NumField(); i++ {
+			if typeHasFloats(t.Field(i).Type, seen) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// maxCheckDepth bounds checkFinite on cyclic values, which encoding/json
+// rejects on its own.
+const maxCheckDepth = 1000
+
+// checkFinite returns ErrInvalidValue when v holds a NaN or infinite float
+// that encoding/json would refuse to encode.
+func checkFinite(v reflect.Value, path string, depth int) error {
+	if depth > maxCheckDepth || !v.IsValid() || hasMarshaler(v.Type()) {
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Float32, reflect.Float64:
+		if f := v.Float(); math.IsNaN(f) || math.IsInf(f, 0) {
+			return fmt.Errorf("%w: %s is %v", ErrInvalidValue, path, f)
+		}
+	case reflect.Pointer, reflect.Interface:
+		if !v.IsNil() {
+			return checkFinite(v.Elem(), path, depth+1)
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			if err := checkFinite(v.Index(i), fmt.Sprintf("%s[%d]", path, i), depth+1); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		it := v.MapRange()
+		for it.Next() {
+			if err := checkFinite(it.Value(), fmt.Sprintf("%s[%v]", path, it.Key()), depth+1); err != nil {
+				return err
+			}
+		}
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if (!f.IsExported() && !isEmbeddedStruct(f)) || f.Tag.Get("json") == "-" {
+				continue
+			}
+			if err := checkFinite(v.Field(i), path+"."+f.Name, depth+1); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+var timeType = reflect.TypeFor[time.Time]()
+
+// hasInlineTimes reports whether t holds a time.Time that normalizeTimes can
+// reach: t itself, or a field or array element of it, without going through
+// a pointer, slice or map shared with the caller.
+func hasInlineTimes(t reflect.Type) bool {
+	if t == timeType {
+		return true
+	}
+	switch t.Kind() {
+	case reflect.Array:
+		return hasInlineTimes(t.Elem())
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			if hasInlineTimes(t.Field(i).Type) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// normalizeTimes converts the times found by hasInlineTimes in the
+// addressable v to UTC and drops their monotonic clock reading. encoding/json
+// persists neither the clock reading nor the location, only the offset, so
+// without this a value read back from disk would not be == to the value
+// that was written.
+func normalizeTimes(v reflect.Value) {
+	if v.Type() == timeType {
+		if v.CanSet() {
+			v.Set(reflect.ValueOf(v.Interface().(time.Time).Round(0).UTC()))
+		}
+		return
+	}
+	switch v.Kind() {
+	case reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			normalizeTimes(v.Index(i))
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if f := v.Field(i); f.CanSet() {
+				normalizeTimes(f)
+			}
+		}
+	}
+}
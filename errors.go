@@ -0,0 +1,88 @@
+package flea
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrLocked is returned by Open when another process holds the store lock.
+	ErrLocked = errors.New("flea: store is locked by another process")
+	// ErrReadOnly is returned by write operations on a store opened with ReadOnly.
+	ErrReadOnly = errors.New("flea: store is read-only")
+	// ErrIDCollision is returned by writes rejected by the CollisionReject policy.
+	ErrIDCollision = errors.New("flea: id collision with a different stored value")
+	// ErrIDFunc wraps errors returned by the configured IDFunc.
+	ErrIDFunc = errors.New("flea: IDFunc failed")
+	// ErrInvalidSnapshot is returned when a freshly written snapshot fails
+	// verification. The previous snapshot and the WAL are kept.
+	ErrInvalidSnapshot = errors.New("flea: invalid snapshot")
+	// ErrLossyType is returned by Open with StrictEncoding when T has fields
+	// that would not survive a JSON round-trip.
+	ErrLossyType = errors.New("flea: type does not round-trip through JSON")
+	// ErrInvalidValue is returned by writes of values that can't be persisted,
+	// such as values holding a NaN or infinite float.
+	ErrInvalidValue = errors.New("flea: invalid value")
+	// ErrRecordTooLarge is returned when a record exceeds MaxRecordBytes,
+	// either on write or when it is read back from disk.
+	ErrRecordTooLarge = errors.New("flea: record too large")
+	// ErrCheckerRejected wraps the error of a Checker or DeleteChecker that
+	// rejected a write. Retrying the same write won't help.
+	ErrCheckerRejected = errors.New("flea: rejected by checker")
+	// ErrIO wraps failures writing the WAL or reading offline records. The
+	// operation had no effect and may succeed if retried.
+	ErrIO = errors.New("flea: I/O error")
+	// ErrNoIndex is returned by RangeByIndex and GetByField for an index
+	// that was never added.
+	ErrNoIndex = errors.New("flea: no such index")
+	// ErrNoField is returned by AddFieldIndex for a name missing from
+	// Options.ComputedFields.
+	ErrNoField = errors.New("flea: no such computed field")
+	// ErrAppendOnly is returned by deletes on a store opened with AppendOnly.
+	ErrAppendOnly = errors.New("flea: store is append-only")
+	// ErrNotFound is returned by GetOneByID when no live record has the id.
+	ErrNotFound = errors.New("flea: not found")
+	// ErrConflict is returned by PutIfVersion when the record is not at the
+	// expected version.
+	ErrConflict = errors.New("flea: version conflict")
+	// ErrTypeMismatch is returned by Open when the files of the store were
+	// written with another ID or T than the store is opened with.
+	ErrTypeMismatch = errors.New("flea: stored records have another type")
+	// ErrPredicatePanic is returned by queries and deletes whose predicate
+	// panicked. The panic value is part of the message.
+	ErrPredicatePanic = errors.New("flea: predicate panicked")
+)
+
+// BatchError reports which value of a batch write made it fail.
+// No value of the batch is written when a BatchError is returned.
+type BatchError struct {
+	Index int
+	Err   error
+}
+
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("flea: value %d: %v", e.Index, e.Err)
+}
+
+func (e *BatchError) Unwrap() error {
+	return e.Err
+}
+
+// SkippedRecordsError is returned when a snapshot could not read some
+// offline records. The store then keeps its current snapshot and its WAL,
+// which hold the skipped records, and later snapshots try them again. A
+// file written by SnapshotTo holds every other record.
+type SkippedRecordsError[ID comparable] struct {
+	// IDs of the skipped records that are still live
+	IDs []ID
+	// Err wraps the first read error in ErrIO.
+	Err error
+}
+
+func (e *SkippedRecordsError[ID]) Error() string {
+	return fmt.Sprintf("flea: snapshot skipped %d unreadable records: %v", len(e.IDs), e.Err)
+}
+
+func (e *SkippedRecordsError[ID]) Unwrap() error {
+	return e.Err
+}
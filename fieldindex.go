@@ -0,0 +1,130 @@
+package flea
+
+import (
+	"fmt"
+	"reflect"
+	"slices"
+)
+
+// fieldIndex maps the values of a computed field to the ids of the live
+// records holding them. Ids sharing a value are kept in the order they were
+// indexed.
+type fieldIndex[ID comparable, T any] struct {
+	field func(T) any
+	ids   map[any][]ID
+	keys  map[ID]any
+}
+
+func (x *fieldIndex[ID, T]) put(id ID, v T) {
+	k := x.field(v)
+	// a value that can't be a map key is left out of the index
+	if k != nil && !reflect.TypeOf(k).Comparable() {
+		x.drop(id)
+		return
+	}
+	if old, ok := x.keys[id]; ok {
+		if old == k {
+			return
+		}
+		x.remove(id, old)
+	}
+	x.ids[k] = append(x.ids[k], id)
+	x.keys[id] = k
+}
+
+func (x *fieldIndex[ID, T]) drop(id ID) {
+	if k, ok := x.keys[id]; ok {
+		x.remove(id, k)
+		delete(x.keys, id)
+	}
+}
+
+func (x *fieldIndex[ID, T]) remove(id ID, k any) {
+	ids := x.ids[k]
+	if i := slices.Index(ids, id); i >= 0 {
+		ids = slices.Delete(ids, i, i+1)
+	}
+	if len(ids) == 0 {
+		delete(x.ids, k)
+	} else {
+		x.ids[k] = ids
+	}
+}
+
+func (x *fieldIndex[ID, T]) reset() {
+	x.ids = make(map[any][]ID)
+	x.keys = make(map[ID]any)
+}
+
+// AddFieldIndex maintains an in-memory index of the live records by the
+// value of the named computed field, see Options.ComputedFields, for
+// GetByField. Offline records are read once to build it. Like a sorted
+// index, it is not persisted and must be added again after Open.
+//
+// Field values are compared with ==, so the field must return comparable
+// values; records with any other value are left out of the index.
+func (s *Store[ID, T]) AddFieldIndex(field string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fn, ok := s.computedFields[field]
+	if !ok {
+		return fmt.Errorf("%w: %q", ErrNoField, field)
+	}
+	if _, ok := s.fieldIndexes[field]; ok {
+		return fmt.Errorf("flea: index on field %q already exists", field)
+	}
+
+	x := &fieldIndex[ID, T]{field: fn}
+	x.reset()
+	for _, rec := range s.records {
+		if rec.deleted {
+			continue
+		}
+		v, err := s.valueOf(rec)
+		if err != nil {
+			return err
+		}
+		id, err := s.idFunc(v)
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrIDFunc, err)
+		}
+		x.put(id, v)
+	}
+
+	if s.fieldIndexes == nil {
+		s.fieldIndexes = make(map[string]*fieldIndex[ID, T])
+	}
+	s.fieldIndexes[field] = x
+	return nil
+}
+
+// GetByField returns the values whose computed field equals value, in the
+// order they were indexed. Offline values are loaded from disk.
+func (s *Store[ID, T]) GetByField(field string, value any) ([]T, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	x, ok := s.fieldIndexes[field]
+	if !ok {
+		return nil, fmt.Errorf("%w: field %q", ErrNoIndex, field)
+	}
+
+	if value != nil && !reflect.TypeOf(value).Comparable() {
+		return nil, fmt.Errorf("flea: field value of type %T can't be compared", value)
+	}
+	ids := x.ids[value]
+	results := make([]T, 0, len(ids))
+	for _, id := range ids {
+		rec := s.index[id]
+		v, err := s.valueOf(rec)
+		if err != nil {
+			return nil, err
+		}
+		if !rec.offloaded {
+			v = s.clone(v)
+		}
+		results = append(results, v)
+	}
+	return results, nil
+}
@@ -0,0 +1,71 @@
+package flea
+
+import (
+	"io"
+	"os"
+)
+
+// FS is the file system a store persists to. Every file of a store is
+// reached through it, so a store can target something else than the local
+// disk, or a fake in tests.
+type FS interface {
+	Open(name string) (File, error)
+	Create(name string) (File, error)
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+	Rename(oldpath, newpath string) error
+	Stat(name string) (os.FileInfo, error)
+	Remove(name string) error
+	MkdirAll(path string, perm os.FileMode) error
+}
+
+// File is a file opened through an FS. *os.File implements it.
+type File interface {
+	io.Reader
+	io.Writer
+	io.ReaderAt
+	io.Seeker
+	io.Closer
+	Stat() (os.FileInfo, error)
+	Sync() error
+	Truncate(size int64) error
+}
+
+// OSFS is the FS backed by the os package. It is the default.
+type OSFS struct{}
+
+func (OSFS) Open(name string) (File, error) {
+	return openOS(os.Open(name))
+}
+
+func (OSFS) Create(name string) (File, error) {
+	return openOS(os.Create(name))
+}
+
+func (OSFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	return openOS(os.OpenFile(name, flag, perm))
+}
+
+func (OSFS) Rename(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+func (OSFS) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (OSFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (OSFS) MkdirAll(path string, perm os.FileMode) error {
+	return os.MkdirAll(path, perm)
+}
+
+// openOS keeps a failed open from returning a non-nil File holding a nil
+// *os.File.
+func openOS(f *os.File, err error) (File, error) {
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
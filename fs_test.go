@@ -0,0 +1,624 @@
+package flea
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// memFS is an in-memory FS for tests.
+type memFS struct {
+	mu    sync.Mutex
+	files map[string]*memData
+	// fail makes the operations on names containing it fail
+	fail string
+}
+
+type memData struct {
+	mu  sync.Mutex
+	buf []byte
+}
+
+var errMemFS = errors.New("memfs: injected failure")
+
+func newMemFS() *memFS {
+	return &memFS{files: make(map[string]*memData)}
+}
+
+func (m *memFS) Open(name string) (File, error) {
+	return m.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (m *memFS) Create(name string) (File, error) {
+	return m.OpenFile(name, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644)
+}
+
+func (m *memFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.fail != "" && strings.Contains(name, m.fail) {
+		return nil, &os.PathError{Op: "open", Path: name, Err: errMemFS}
+	}
+
+	d, ok := m.files[name]
+	if !ok {
+		if flag&os.O_CREATE == 0 {
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+		}
+		d = &memData{}
+		m.files[name] = d
+	}
+	if flag&os.O_TRUNC != 0 {
+		d.mu.Lock()
+		d.buf = nil
+		d.mu.Unlock()
+	}
+	return &memFile{name: name, data: d, append: flag&os.O_APPEND != 0}, nil
+}
+
+func (m *memFS) Rename(oldpath, newpath string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	d, ok := m.files[oldpath]
+	if !ok {
+		return &os.PathError{Op: "rename", Path: oldpath, Err: os.ErrNotExist}
+	}
+	delete(m.files, oldpath)
+	m.files[newpath] = d
+	return nil
+}
+
+func (m *memFS) Stat(name string) (os.FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	d, ok := m.files[name]
+	if !ok {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+	}
+	return d.info(name), nil
+}
+
+func (m *memFS) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.files, name)
+	return nil
+}
+
+func (m *memFS) MkdirAll(path string, perm os.FileMode) error {
+	return nil
+}
+
+func (d *memData) info(name string) os.FileInfo {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return memInfo{name: filepath.Base(name), size: int64(len(d.buf))}
+}
+
+type memFile struct {
+	name   string
+	data   *memData
+	pos    int64
+	append bool
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.pos)
+	f.pos += int64(n)
+	return n, err
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	f.data.mu.Lock()
+	defer f.data.mu.Unlock()
+
+	if off >= int64(len(f.data.buf)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.data.buf[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	f.data.mu.Lock()
+	defer f.data.mu.Unlock()
+
+	if f.append {
+		f.pos = int64(len(f.data.buf))
+	}
+	if end := f.pos + int64(len(p)); end > int64(len(f.data.buf)) {
+		f.data.buf = append(f.data.buf, make([]byte, end-int64(len(f.data.buf)))...)
+	}
+	copy(f.data.buf[f.pos:], p)
+	f.pos += int64(len(p))
+	return len(p), nil
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	f.data.mu.Lock()
+	defer f.data.mu.Unlock()
+
+	switch whence {
+	case io.SeekStart:
+		f.pos = offset
+	case io.SeekCurrent:
+		f.pos += offset
+	case io.SeekEnd:
+		f.pos = int64(len(f.data.buf)) + offset
+	}
+	return f.pos, nil
+}
+
+func (f *memFile) Truncate(size int64) error {
+	f.data.mu.Lock()
+	defer f.data.mu.Unlock()
+
+	if size < int64(len(f.data.buf)) {
+		f.data.buf = f.data.buf[:size]
+	}
+	return nil
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) { return f.data.info(f.name), nil }
+func (f *memFile) Sync() error                { return nil }
+func (f *memFile) Close() error               { return nil }
+
+type memInfo struct {
+	name string
+	size int64
+}
+
+func (i memInfo) Name() string       { return i.name }
+func (i memInfo) Size() int64        { return i.size }
+func (i memInfo) Mode() os.FileMode  { return 0644 }
+func (i memInfo) ModTime() time.Time { return time.Time{} }
+func (i memInfo) IsDir() bool        { return false }
+func (i memInfo) Sys() any           { return nil }
+
+func TestFS_StorePersistsThroughFake(t *testing.T) {
+	dir := t.TempDir()
+	fs := newMemFS()
+	max := 2
+	opts := Options[uint64, User]{
+		Dir:                dir,
+		FS:                 fs,
+		IDFunc:             userID,
+		MaxInMemoryRecords: &max,
+		ResidencyFunc:      func(User) bool { return false },
+	}
+
+	s, err := Open[uint64, User](opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 5; i++ {
+		if _, err := s.Put(User{Id: uint64(i), Name: "u"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if info, _ := s.Inspect(1); info.Online {
+		t.Fatalf("expected record 1 to be offline")
+	}
+	if err := s.snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	s.Put(User{Id: 6, Name: "after snapshot"})
+	s.Close()
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("expected nothing on the local disk, found %d entries", len(entries))
+	}
+
+	s, err = Open[uint64, User](opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	users := s.GetAll()
+	if len(users) != 6 {
+		t.Fatalf("expected 6 users, got %d", len(users))
+	}
+	for i, u := range users {
+		if u.Id != uint64(i+1) {
+			t.Fatalf("expected id %d at %d, got %d", i+1, i, u.Id)
+		}
+	}
+}
+
+func TestFS_DataFileFailureFailsOpen(t *testing.T) {
+	fs := newMemFS()
+	fs.fail = "data.ndjson"
+	_, err := Open[uint64, User](Options[uint64, User]{
+		Dir:           t.TempDir(),
+		FS:            fs,
+		IDFunc:        userID,
+		ResidencyFunc: func(User) bool { return false },
+	})
+	if !errors.Is(err, errMemFS) {
+		t.Fatalf("expected the injected failure, got %v", err)
+	}
+}
+
+func TestFS_SnapshotFailureKeepsWAL(t *testing.T) {
+	fs := newMemFS()
+	opts := Options[uint64, User]{
+		Dir:    t.TempDir(),
+		FS:     fs,
+		IDFunc: userID,
+	}
+
+	s, err := Open[uint64, User](opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Put(User{Id: 1})
+
+	fs.fail = "snapshot.tmp"
+	if err := s.snapshot(); !errors.Is(err, errMemFS) {
+		t.Fatalf("expected the injected failure, got %v", err)
+	}
+	fs.fail = ""
+	s.Close()
+
+	s, err = Open[uint64, User](opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if s.Len() != 1 {
+		t.Fatalf("expected the WAL to keep the record, got %d", s.Len())
+	}
+}
+
+func TestFS_WALTrimIsAtomic(t *testing.T) {
+	fs := newMemFS()
+	opts := Options[uint64, User]{
+		Dir:    t.TempDir(),
+		FS:     fs,
+		IDFunc: userID,
+	}
+
+	s, err := Open[uint64, User](opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Put(User{Id: 1})
+	walSize := func() int64 {
+		info, err := fs.Stat(s.getWalPath())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info.Size()
+	}
+	before := walSize()
+
+	// the trimmed WAL can't be written: the old one must stay as it was
+	fs.fail = "wal.log.tmp"
+	if err := s.snapshot(); !errors.Is(err, errMemFS) {
+		t.Fatalf("expected the injected failure, got %v", err)
+	}
+	fs.fail = ""
+	if after := walSize(); after != before {
+		t.Fatalf("expected the WAL untouched, got %d bytes from %d", after, before)
+	}
+
+	if err := s.snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	if n := walSize(); n != 0 {
+		t.Fatalf("expected an empty WAL after the snapshot, got %d bytes", n)
+	}
+	// writes go on to the new WAL
+	s.Put(User{Id: 2})
+	s.Close()
+
+	s, err = Open[uint64, User](opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if s.Len() != 2 {
+		t.Fatalf("expected 2 records, got %d", s.Len())
+	}
+}
+
+// crossDeviceFS is the local disk, where renames out of tempDir fail like
+// they do across file systems.
+type crossDeviceFS struct {
+	OSFS
+	tempDir string
+	crossed int
+}
+
+func (c *crossDeviceFS) Rename(oldpath, newpath string) error {
+	if strings.HasPrefix(oldpath, c.tempDir) != strings.HasPrefix(newpath, c.tempDir) {
+		c.crossed++
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.EXDEV}
+	}
+	return c.OSFS.Rename(oldpath, newpath)
+}
+
+func TestFS_SnapshotTempDirOnAnotherFileSystem(t *testing.T) {
+	dir, tempDir := t.TempDir(), t.TempDir()
+	fs := &crossDeviceFS{tempDir: tempDir}
+	opts := Options[uint64, User]{
+		Dir:     dir,
+		TempDir: tempDir,
+		FS:      fs,
+		IDFunc:  userID,
+	}
+
+	s, err := Open[uint64, User](opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Put(User{Id: 1, Name: "alice"})
+	s.Put(User{Id: 2, Name: "bob"})
+	if err := s.snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	tmp := s.getSnapshotTmpPath()
+	s.Close()
+
+	if fs.crossed == 0 {
+		t.Fatal("expected the snapshot to be written to the temp directory")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "flea_user", "snapshot.ndjson")); err != nil {
+		t.Fatalf("expected the snapshot in the store directory: %v", err)
+	}
+	for _, d := range []string{filepath.Join(dir, "flea_user"), filepath.Dir(tmp)} {
+		if _, err := os.Stat(filepath.Join(d, "snapshot.tmp")); !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("expected no snapshot.tmp left in %s, got %v", d, err)
+		}
+	}
+
+	s, err = Open[uint64, User](Options[uint64, User]{Dir: dir, IDFunc: userID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if s.Len() != 2 {
+		t.Fatalf("expected 2 records from the snapshot, got %d", s.Len())
+	}
+}
+
+func TestFS_SnapshotTempDirSharedByStores(t *testing.T) {
+	tempDir := t.TempDir()
+	var tmps []string
+	for range 2 {
+		s, err := Open[uint64, User](Options[uint64, User]{
+			Dir:     t.TempDir(),
+			TempDir: tempDir,
+			IDFunc:  userID,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		s.Put(User{Id: 1, Name: "alice"})
+		if err := s.snapshot(); err != nil {
+			t.Fatal(err)
+		}
+		tmps = append(tmps, s.getSnapshotTmpPath())
+	}
+	if tmps[0] == tmps[1] {
+		t.Fatalf("expected stores in different directories to use different temp files, both use %s", tmps[0])
+	}
+}
+
+// flakySyncFS is a memFS whose WAL fails its next failures fsyncs, with
+// err or errMemFS.
+type flakySyncFS struct {
+	*memFS
+	failures int
+	syncs    int
+	err      error
+}
+
+func (f *flakySyncFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	file, err := f.memFS.OpenFile(name, flag, perm)
+	if err != nil || !strings.HasSuffix(name, "wal.log") {
+		return file, err
+	}
+	return &flakySyncFile{File: file, fs: f}, nil
+}
+
+type flakySyncFile struct {
+	File
+	fs *flakySyncFS
+}
+
+func (f *flakySyncFile) Sync() error {
+	f.fs.syncs++
+	if f.fs.failures > 0 {
+		f.fs.failures--
+		if f.fs.err != nil {
+			return f.fs.err
+		}
+		return errMemFS
+	}
+	return f.File.Sync()
+}
+
+// The retries only serve an FS whose Sync reports interrupted calls; the
+// memFS stands in for one, the OSFS never does.
+func TestFS_SyncRetriesInterruptedSyncOfCustomFS(t *testing.T) {
+	interrupted := &os.PathError{Op: "sync", Path: "wal.log", Err: syscall.EINTR}
+	fs := &flakySyncFS{memFS: newMemFS(), err: interrupted}
+	s, err := Open[uint64, User](Options[uint64, User]{
+		Dir:              t.TempDir(),
+		FS:               fs,
+		IDFunc:           userID,
+		SyncRetries:      3,
+		SyncRetryBackoff: time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	fs.failures, fs.syncs = 2, 0
+	if _, err := s.Put(User{Id: 1}); err != nil {
+		t.Fatalf("expected the put to survive 2 failed syncs, got %v", err)
+	}
+	if fs.syncs != 3 {
+		t.Fatalf("expected 3 syncs, got %d", fs.syncs)
+	}
+
+	fs.failures, fs.syncs = 10, 0
+	if _, err := s.Put(User{Id: 2}); !errors.Is(err, syscall.EINTR) {
+		t.Fatalf("expected the put to fail once retries are exhausted, got %v", err)
+	}
+	if fs.syncs != 4 {
+		t.Fatalf("expected 1 sync and 3 retries, got %d", fs.syncs)
+	}
+
+	// the data of a failed fsync may be gone, so it is never retried
+	fs.failures, fs.syncs, fs.err = 1, 0, errMemFS
+	if _, err := s.Put(User{Id: 3}); !errors.Is(err, errMemFS) {
+		t.Fatalf("expected the put to fail, got %v", err)
+	}
+	if fs.syncs != 1 {
+		t.Fatalf("expected no retry of a failed fsync, got %d syncs", fs.syncs)
+	}
+	if s.Len() != 1 {
+		t.Fatalf("expected only the first put to be stored, got %d records", s.Len())
+	}
+}
+
+func TestFS_GroupCommitWatchFromLeavesOutPendingPuts(t *testing.T) {
+	fs := &flakySyncFS{memFS: newMemFS()}
+	s, err := Open[uint64, User](Options[uint64, User]{
+		Dir:               t.TempDir(),
+		FS:                fs,
+		IDFunc:            userID,
+		GroupCommitWindow: 300 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if _, err := s.Put(User{Id: 1, Name: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// an insert and an update in flight while WatchFrom lists the store
+	done := make(chan error, 2)
+	go func() { _, err := s.Put(User{Id: 2, Name: "bob"}); done <- err }()
+	go func() { _, err := s.Put(User{Id: 1, Name: "alice v2"}); done <- err }()
+	time.Sleep(100 * time.Millisecond)
+
+	initial, events, cancel, err := s.WatchFrom()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cancel()
+	if len(initial) != 1 || initial[0].Name != "alice" {
+		t.Fatalf("expected only the durable alice in initial, got %+v", initial)
+	}
+	for range 2 {
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+	got := map[string]bool{}
+	for range 2 {
+		got[(<-events).Value.Name] = true
+	}
+	if !got["bob"] || !got["alice v2"] {
+		t.Fatalf("expected events for both pending puts, got %v", got)
+	}
+
+	// a put rolled back by its fsync is neither in initial nor an event
+	fs.failures = 1
+	go func() { _, err := s.Put(User{Id: 3, Name: "carol"}); done <- err }()
+	time.Sleep(100 * time.Millisecond)
+	initial, events, cancel, err = s.WatchFrom()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cancel()
+	if len(initial) != 2 {
+		t.Fatalf("expected the pending carol left out of initial, got %+v", initial)
+	}
+	if err := <-done; !errors.Is(err, ErrIO) {
+		t.Fatalf("expected ErrIO, got %v", err)
+	}
+	if _, err := s.Put(User{Id: 4, Name: "dave"}); err != nil {
+		t.Fatal(err)
+	}
+	if e := <-events; e.Value.Name != "dave" {
+		t.Fatalf("expected no event for the rolled back carol, got %+v", e)
+	}
+}
+
+func TestFS_GroupCommitSyncFailureRollsBack(t *testing.T) {
+	fs := &flakySyncFS{memFS: newMemFS()}
+	var hooks int
+	s, err := Open[uint64, User](Options[uint64, User]{
+		Dir:               t.TempDir(),
+		FS:                fs,
+		IDFunc:            userID,
+		GroupCommitWindow: time.Millisecond,
+		AfterWrite: []AfterWrite[User]{
+			func(old *User, new User) { hooks++ },
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	events, cancel := s.Watch()
+	defer cancel()
+
+	if _, err := s.Put(User{Id: 1, Name: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	<-events
+
+	fs.failures = 1
+	if _, err := s.Put(User{Id: 1, Name: "bob"}); !errors.Is(err, ErrIO) {
+		t.Fatalf("expected ErrIO, got %v", err)
+	}
+	fs.failures = 1
+	if _, err := s.Put(User{Id: 2, Name: "carol"}); !errors.Is(err, ErrIO) {
+		t.Fatalf("expected ErrIO, got %v", err)
+	}
+
+	if got, _, _ := s.GetByID(1); got.Name != "alice" {
+		t.Fatalf("expected the update to be rolled back, got %+v", got)
+	}
+	if v, _ := s.Version(1); v != 1 {
+		t.Fatalf("expected version 1 back, got %d", v)
+	}
+	if _, ok, _ := s.GetByID(2); ok || s.Len() != 1 {
+		t.Fatalf("expected the insert to be rolled back, got %d records", s.Len())
+	}
+	if hooks != 1 {
+		t.Fatalf("expected AfterWrite to run for the durable write only, ran %d times", hooks)
+	}
+	select {
+	case e := <-events:
+		t.Fatalf("expected no event for failed writes, got %+v", e)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
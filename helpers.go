@@ -1,6 +1,9 @@
 package flea
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
 	"os"
 	"path/filepath"
 	"reflect"
@@ -19,9 +22,35 @@ func (s *Store[ID, T]) getDataPath() string {
 	return s.getPath("data.ndjson")
 }
 
+// getSnapshotTmpPath returns where a snapshot is written before it
+// replaces the current one, see Options.TempDir. Stores of the same T in
+// other directories can share a TempDir, so its directory there is named
+// after a hash of the path of the store too.
+func (s *Store[ID, T]) getSnapshotTmpPath() string {
+	if s.tempDir == "" {
+		return s.getPath("snapshot.tmp")
+	}
+	path, err := filepath.Abs(s.Path())
+	if err != nil {
+		path = s.Path()
+	}
+	sum := sha256.Sum256([]byte(path))
+	dir := s.getModelName() + "-" + hex.EncodeToString(sum[:8])
+	return filepath.Join(s.tempDir, dir, "snapshot.tmp")
+}
+
+func (s *Store[ID, T]) getLockPath() string {
+	return s.getPath("LOCK")
+}
+
+// Path returns the model directory of the store, where its WAL, snapshot
+// and data files live: Dir joined with the sanitized name of T.
+func (s *Store[ID, T]) Path() string {
+	return filepath.Join(s.dir, s.getModelName())
+}
+
 func (s *Store[ID, T]) getPath(file string) string {
-	modelDir := filepath.Join(s.dir, s.getModelName())
-	return filepath.Join(modelDir, file)
+	return filepath.Join(s.Path(), file)
 }
 
 func (s *Store[ID, T]) getModelName() string {
@@ -30,9 +59,18 @@ func (s *Store[ID, T]) getModelName() string {
 	return cls
 }
 
-func (s *Store[ID, T]) makeDirs() {
-	path := s.getPath("")
-	os.MkdirAll(path, os.ModePerm)
+func (s *Store[ID, T]) makeDirs() error {
+	path := s.Path()
+	if err := s.fs.MkdirAll(path, os.ModePerm); err != nil {
+		return fmt.Errorf("flea: can't create store directory %s: %w", path, err)
+	}
+	if s.tempDir != "" {
+		tmp := filepath.Dir(s.getSnapshotTmpPath())
+		if err := s.fs.MkdirAll(tmp, os.ModePerm); err != nil {
+			return fmt.Errorf("flea: can't create temp directory %s: %w", tmp, err)
+		}
+	}
+	return nil
 }
 
 func sanitizeTypeName(name string) string {
@@ -46,14 +84,32 @@ func sanitizeTypeName(name string) string {
 	return strings.ToLower(replacer.Replace(name))
 }
 
+// emptyFile renames a new empty file over the one at path and returns it.
+// Handles open on the old file, such as those of an offlineReader or a
+// View, keep reading what it held.
+func (s *Store[ID, T]) emptyFile(path string) (File, error) {
+	tmp := path + ".tmp"
+	f, err := s.fs.OpenFile(tmp, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.fs.Rename(tmp, path); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
 func (s *Store[ID, T]) handleDataFile(f func(T) bool) error {
 
 	if f != nil {
 		dataPath := s.getDataPath()
 		var err error
-		s.dataFile, err = os.OpenFile(
+		// offline records are rebuilt from the snapshot and the WAL, so
+		// whatever was spilled by a previous run is discarded.
+		s.dataFile, err = s.fs.OpenFile(
 			dataPath,
-			os.O_CREATE|os.O_RDWR,
+			os.O_CREATE|os.O_RDWR|os.O_TRUNC,
 			0644,
 		)
 		if err != nil {
@@ -63,3 +119,35 @@ func (s *Store[ID, T]) handleDataFile(f func(T) bool) error {
 	}
 	return nil
 }
+
+// acquireLock takes an exclusive lock on the LOCK file of the model dir,
+// failing fast with ErrLocked when another process already owns it. As the
+// first file a store writes, LOCK also tells whether the directory is
+// writable.
+func (s *Store[ID, T]) acquireLock() error {
+	f, err := s.fs.OpenFile(s.getLockPath(), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return fmt.Errorf("flea: store directory %s is not writable: %w", s.Path(), err)
+	}
+	// only files of the local disk can be locked
+	if osf, ok := f.(*os.File); ok {
+		if err := lockFile(osf); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	s.lock = f
+	return nil
+}
+
+func (s *Store[ID, T]) releaseLock() error {
+	if s.lock == nil {
+		return nil
+	}
+	if osf, ok := s.lock.(*os.File); ok {
+		unlockFile(osf)
+	}
+	err := s.lock.Close()
+	s.lock = nil
+	return err
+}
@@ -0,0 +1,144 @@
+package flea
+
+import (
+	"bytes"
+	"cmp"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"reflect"
+)
+
+// HashIDFunc identifies a record by the SHA-256 digest of its JSON encoding,
+// truncated to 64 bits. It is meant for content-addressed stores, where two
+// distinct records must never share an id.
+//
+// encoding/json writes struct fields in declaration order and sorts map
+// keys, so equal values always produce the same id.
+func HashIDFunc[T any](v T) (uint64, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return 0, err
+	}
+	sum := sha256.Sum256(b)
+	return binary.BigEndian.Uint64(sum[:8]), nil
+}
+
+// SeededHashIDFunc is like HashIDFunc, but mixes seed into the digest, so
+// stores using different seeds give equal values different ids. Changing
+// the seed of an existing store changes every id: records written with the
+// old seed are no longer found by the new one.
+func SeededHashIDFunc[T any](seed uint64) IDFunc[uint64, T] {
+	return func(v T) (uint64, error) {
+		sum, err := seededDigest(seed, v)
+		if err != nil {
+			return 0, err
+		}
+		return binary.BigEndian.Uint64(sum[:8]), nil
+	}
+}
+
+// seededDigest returns the SHA-256 digest of seed followed by the JSON
+// encoding of v.
+func seededDigest[T any](seed uint64, v T) ([]byte, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var prefix [8]byte
+	binary.BigEndian.PutUint64(prefix[:], seed)
+	h := sha256.New()
+	h.Write(prefix[:])
+	h.Write(b)
+	return h.Sum(nil), nil
+}
+
+// HexHashIDFunc is like HashIDFunc for string-keyed stores: the id is the
+// full SHA-256 digest, hex encoded.
+func HexHashIDFunc[T any](v T) (string, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Hash32IDFunc is like HashIDFunc, truncated to 32 bits. Collisions become
+// likely past tens of thousands of distinct values, so it only suits small
+// stores.
+func Hash32IDFunc[T any](v T) (uint32, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return 0, err
+	}
+	sum := sha256.Sum256(b)
+	return binary.BigEndian.Uint32(sum[:4]), nil
+}
+
+// defaultIDFunc returns the hash IDFunc matching ID, mixing seed into the
+// digest unless it is 0, or nil when ID has none.
+func defaultIDFunc[ID comparable, T any](seed uint64) IDFunc[ID, T] {
+	var f any
+	switch any(*new(ID)).(type) {
+	case uint64:
+		f = IDFunc[uint64, T](HashIDFunc[T])
+		if seed != 0 {
+			f = SeededHashIDFunc[T](seed)
+		}
+	case uint32:
+		f = IDFunc[uint32, T](Hash32IDFunc[T])
+		if seed != 0 {
+			f = IDFunc[uint32, T](func(v T) (uint32, error) {
+				sum, err := seededDigest(seed, v)
+				if err != nil {
+					return 0, err
+				}
+				return binary.BigEndian.Uint32(sum[:4]), nil
+			})
+		}
+	case string:
+		f = IDFunc[string, T](HexHashIDFunc[T])
+		if seed != 0 {
+			f = IDFunc[string, T](func(v T) (string, error) {
+				sum, err := seededDigest(seed, v)
+				if err != nil {
+					return "", err
+				}
+				return hex.EncodeToString(sum), nil
+			})
+		}
+	default:
+		return nil
+	}
+	return f.(IDFunc[ID, T])
+}
+
+// idOrder returns a total order over ids: numeric and string ids compare by
+// value, any other id by its JSON encoding.
+func idOrder[ID comparable]() func(a, b ID) int {
+	switch reflect.TypeFor[ID]().Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return func(a, b ID) int {
+			return cmp.Compare(reflect.ValueOf(a).Int(), reflect.ValueOf(b).Int())
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return func(a, b ID) int {
+			return cmp.Compare(reflect.ValueOf(a).Uint(), reflect.ValueOf(b).Uint())
+		}
+	case reflect.Float32, reflect.Float64:
+		return func(a, b ID) int {
+			return cmp.Compare(reflect.ValueOf(a).Float(), reflect.ValueOf(b).Float())
+		}
+	case reflect.String:
+		return func(a, b ID) int {
+			return cmp.Compare(reflect.ValueOf(a).String(), reflect.ValueOf(b).String())
+		}
+	}
+	return func(a, b ID) int {
+		x, _ := json.Marshal(a)
+		y, _ := json.Marshal(b)
+		return bytes.Compare(x, y)
+	}
+}
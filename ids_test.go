@@ -0,0 +1,148 @@
+package flea
+
+import (
+	"testing"
+)
+
+func TestHashIDFunc_NearIdenticalRecords(t *testing.T) {
+	a := User{Id: 1, Name: "Alice", Score: 1.0}
+	b := User{Id: 1, Name: "Alice", Score: 1.1}
+
+	idA, err := HashIDFunc(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idB, err := HashIDFunc(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if idA == idB {
+		t.Fatalf("expected distinct ids for distinct records")
+	}
+
+	again, _ := HashIDFunc(a)
+	if again != idA {
+		t.Fatalf("expected the same id for the same record")
+	}
+
+	m1 := map[string]int{"a": 1, "b": 2, "c": 3}
+	m2 := map[string]int{"c": 3, "b": 2, "a": 1}
+	h1, _ := HashIDFunc(m1)
+	h2, _ := HashIDFunc(m2)
+	if h1 != h2 {
+		t.Fatalf("expected map ids to be independent of insertion order")
+	}
+}
+
+func TestHashIDFunc_AsStoreIDFunc(t *testing.T) {
+	dir := t.TempDir()
+
+	s, err := Open[uint64, User](Options[uint64, User]{
+		Dir:    dir,
+		IDFunc: HashIDFunc[User],
+	})
+	if err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	defer s.Close()
+
+	for i := 0; i < 1000; i++ {
+		if _, err := s.Put(User{Id: 1, Name: "Alice", Age: i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if s.Len() != 1000 {
+		t.Fatalf("expected 1000 distinct records, got %d", s.Len())
+	}
+}
+
+func TestSeededHashIDFunc(t *testing.T) {
+	u := User{Id: 1, Name: "Alice"}
+
+	a, err := SeededHashIDFunc[User](1)(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := SeededHashIDFunc[User](2)(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a == b {
+		t.Fatalf("expected different seeds to give different ids")
+	}
+
+	again, _ := SeededHashIDFunc[User](1)(u)
+	if again != a {
+		t.Fatalf("expected the same seed to give the same id")
+	}
+}
+
+func TestDefaultIDFunc_StringAndUint32Keys(t *testing.T) {
+	u := User{Id: 1, Name: "Alice"}
+
+	strs, err := Open[string, User](Options[string, User]{Dir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	defer strs.Close()
+
+	id, err := strs.Put(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, _ := HexHashIDFunc(u); id != want || len(id) != 64 {
+		t.Fatalf("expected id %q, got %q", want, id)
+	}
+
+	small, err := Open[uint32, User](Options[uint32, User]{Dir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	defer small.Close()
+
+	small.Put(u)
+	small.Put(u)
+	want, _ := Hash32IDFunc(u)
+	if v, ok, _ := small.GetByID(want); !ok || v != u {
+		t.Fatalf("expected %+v under id %d, got %+v", u, want, v)
+	}
+	if small.Len() != 1 {
+		t.Fatalf("expected equal values to share an id, got %d records", small.Len())
+	}
+
+	if _, err := Open[int, User](Options[int, User]{Dir: t.TempDir()}); err == nil {
+		t.Fatalf("expected an error for an id type without a default")
+	}
+}
+
+func TestHashSeed(t *testing.T) {
+	u := User{Id: 1, Name: "Alice"}
+	idIn := func(seed uint64) uint64 {
+		s, err := Open[uint64, User](Options[uint64, User]{Dir: t.TempDir(), HashSeed: seed})
+		if err != nil {
+			t.Fatalf("open failed: %v", err)
+		}
+		defer s.Close()
+		id, err := s.Put(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+
+	if want, _ := HashIDFunc(u); idIn(0) != want {
+		t.Fatalf("expected no seed to keep the HashIDFunc id")
+	}
+	if want, _ := SeededHashIDFunc[User](7)(u); idIn(7) != want {
+		t.Fatalf("expected a seed to give the SeededHashIDFunc id")
+	}
+	if idIn(1) == idIn(2) {
+		t.Fatalf("expected different seeds to give different ids")
+	}
+
+	_, err := Open[uint64, User](Options[uint64, User]{Dir: t.TempDir(), IDFunc: userID, HashSeed: 1})
+	if err == nil {
+		t.Fatalf("expected HashSeed to be rejected with an IDFunc of its own")
+	}
+}
@@ -1,28 +1,49 @@
 package flea
 
 import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"encoding/binary"
 	"encoding/json"
+	"fmt"
 	"io"
-	"os"
+	"reflect"
+	"slices"
+	"time"
 )
 
+// frameHeader is the size of the length prefix of a record in a framed data
+// file.
+const frameHeader = 4
+
 type dataWindow struct {
 	buf        []byte
 	baseOffset int64
 }
 
-func (w *dataWindow) read(file *os.File, offset, size int64) ([]byte, error) {
+func (w *dataWindow) read(file File, offset, size int64) ([]byte, error) {
 
 	if offset >= w.baseOffset && offset+size <= w.baseOffset+int64(len(w.buf)) {
 		start := offset - w.baseOffset
 		return w.buf[start : start+size], nil
 	}
 
-	if len(w.buf) == 0 {
+	if cap(w.buf) < int(size) {
 		w.buf = make([]byte, max(4096, int(size)*10))
 	}
+	w.buf = w.buf[:cap(w.buf)]
 	n, err := file.ReadAt(w.buf, offset)
-	if err != nil && err != io.EOF {
+	if err == nil || err == io.EOF {
+		if int64(n) < size {
+			err = fmt.Errorf("record at %d+%d is past the end of the data file", offset, size)
+		} else {
+			err = nil
+		}
+	}
+	if err != nil {
+		// the buffer no longer holds the previous window
+		w.buf = w.buf[:0]
 		return nil, err
 	}
 	w.baseOffset = offset
@@ -32,77 +53,270 @@ func (w *dataWindow) read(file *os.File, offset, size int64) ([]byte, error) {
 	return w.buf[start : start+size], nil
 }
 
-func (s *Store[ID, T]) loadFromDisk(offset, size int64) (T, error) {
+// loadFromDisk reads the value of an offline record from the data file. A
+// failed read is counted in Stats.ReadErrors.
+func (s *Store[ID, T]) loadFromDisk(offset, size int64) (v T, err error) {
+	defer s.countReadError(&err)
+
 	var zero T
 
-	var v T
+	if s.maxRecordBytes > 0 && size > int64(s.maxRecordBytes) {
+		return zero, fmt.Errorf("%w: %d bytes at offset %d, limit is %d", ErrRecordTooLarge, size, offset, s.maxRecordBytes)
+	}
 
-	data, err := s.dataWindow.read(s.dataFile, offset, size)
+	var data []byte
+	if s.framed {
+		data, err = s.readFrame(offset, size)
+	} else {
+		data, err = s.dataWindow.read(s.dataFile, offset, size)
+	}
 	if err != nil {
-		return zero, err
+		return zero, fmt.Errorf("%w: %w", ErrIO, err)
+	}
+	return s.decodeScratch(data)
+}
+
+// countReadError counts *err in Stats.ReadErrors when it is set. It runs
+// under s.mu.
+func (s *Store[ID, T]) countReadError(err *error) {
+	if *err != nil {
+		s.readErrors++
+	}
+}
+
+// decodeScratch is decode through s.scratch, so that decoding doesn't
+// allocate a T for every offline value read. It runs under s.mu.
+func (s *Store[ID, T]) decodeScratch(data []byte) (T, error) {
+	var zero T
+	if s.scratch == nil {
+		s.scratch = new(T)
 	}
-	if err := json.Unmarshal(data, &v); err != nil {
+	// decode into a zero value, or slices and maps of the previous value
+	// would be reused and shared with it
+	*s.scratch = zero
+	if err := s.decode(data, s.scratch); err != nil {
 		return zero, err
 	}
-	return v, nil
+	return *s.scratch, nil
 }
 
-func (s *Store[ID, T]) appendToDisk(batch []*record[T]) error {
+// readFrame reads the payload at offset in a framed data file, after
+// checking that its length prefix agrees with size.
+func (s *Store[ID, T]) readFrame(offset, size int64) ([]byte, error) {
+	data, err := s.dataWindow.read(s.dataFile, offset-frameHeader, size+frameHeader)
+	if err != nil {
+		return nil, err
+	}
+	if n := binary.BigEndian.Uint32(data); int64(n) != size {
+		return nil, fmt.Errorf("corrupt frame at offset %d: length %d, expected %d", offset, n, size)
+	}
+	return data[frameHeader:], nil
+}
 
-	offset, err := s.dataFile.Seek(0, io.SeekEnd)
+// framePrefix returns how many bytes of a record in the data file come
+// before its payload.
+func (s *Store[ID, T]) framePrefix() int64 {
+	if s.framed {
+		return frameHeader
+	}
+	return 0
+}
+
+// frameLen returns how many bytes a record with a payload of size bytes
+// takes in the data file.
+func (s *Store[ID, T]) frameLen(size int64) int64 {
+	if s.framed {
+		return frameHeader + size
+	}
+	return size + 1
+}
+
+// writeFrame writes payload to w as one record of the data file: a line of
+// NDJSON, or a big-endian uint32 length followed by the payload when the
+// data file is framed.
+func (s *Store[ID, T]) writeFrame(w io.Writer, payload []byte) error {
+	var err error
+	if s.framed {
+		var h [frameHeader]byte
+		binary.BigEndian.PutUint32(h[:], uint32(len(payload)))
+		_, err = w.Write(h[:])
+		if err == nil {
+			_, err = w.Write(payload)
+		}
+	} else {
+		_, err = w.Write(payload)
+		if err == nil {
+			_, err = w.Write([]byte{'\n'})
+		}
+	}
+	return err
+}
+
+// decode unmarshals a value read back from disk, gives it back its blob
+// and runs OnLoad on it.
+func (s *Store[ID, T]) decode(data []byte, v *T) error {
+	_, err := s.decodeRef(data, v)
+	return err
+}
+
+// decodeRef is decode, also returning where the blob of v is stored.
+func (s *Store[ID, T]) decodeRef(data []byte, v *T) (blobRef, error) {
+	if err := json.Unmarshal(data, v); err != nil {
+		return blobRef{}, err
+	}
+	ref, err := s.attachBlob(v)
+	if err != nil {
+		return blobRef{}, err
+	}
+	if s.onLoad != nil {
+		return ref, s.onLoad(v)
+	}
+	return ref, nil
+}
+
+// valueOf returns the value of rec, reading it from disk when it is offline,
+// archived records included.
+func (s *Store[ID, T]) valueOf(rec *record[T]) (T, error) {
+	if !rec.offloaded {
+		return *rec.value, nil
+	}
+	if rec.archived {
+		return s.loadArchived(rec)
+	}
+	return s.loadFromDisk(rec.offset, rec.size)
+}
+
+// appendToDisk offloads batch to the data file, which stays open for the
+// life of the store. The whole batch goes out in a single write, and the
+// file is never synced: it is rebuilt from the snapshot and the WAL on Open.
+func (s *Store[ID, T]) appendToDisk(batch []*record[T]) error {
+	var buf bytes.Buffer
+	offset, err := s.dataFileEnd(&buf)
 	if err != nil {
 		return err
 	}
 
-	for _, rec := range batch {
+	sizes := make([]int64, len(batch))
+	for i, rec := range batch {
+		b, err := s.encode(*rec.value, rec.blob)
 		if err != nil {
 			return err
 		}
 
-		b, err := json.Marshal(*rec.value)
-		if err != nil {
-			return err
+		if s.verifyOffload {
+			s.checkOffloaded(*rec.value, b)
 		}
 
-		if _, err := s.dataFile.Write(b); err != nil {
-			return err
-		}
+		// rec.size counts the payload only, not its framing
+		s.writeFrame(&buf, b)
+		sizes[i] = int64(len(b))
+	}
+
+	if _, err := s.dataFile.Write(buf.Bytes()); err != nil {
+		return err
+	}
+
+	s.onlineCount -= len(batch)
+	s.offlineCount += len(batch)
 
-		rec.offset = offset
-		rec.size = int64(len(b))
-		offset += rec.size
+	for i, rec := range batch {
+		rec.offloads++
+		if rec.offloads == s.thrashThreshold {
+			s.warnThrash(*rec.value, rec.offloads)
+		}
+		rec.offset = offset + s.framePrefix()
+		rec.size = sizes[i]
+		offset += s.frameLen(rec.size)
 		rec.value = nil
+		rec.offloaded = true
 	}
 
 	return nil
 }
 
+// dataFileEnd returns the offset at which frames appended to the data file
+// start, writing to w what must precede them.
+//
+// A write cut short leaves a partial last line. It is terminated so that
+// the appended frames start on a line of their own; readers never look at
+// that line since no record points to it. A partial frame needs no care:
+// framed files are only ever read at the offsets of records.
+func (s *Store[ID, T]) dataFileEnd(w io.ByteWriter) (int64, error) {
+	offset, err := s.dataFile.Seek(0, io.SeekEnd)
+	if err != nil || offset == 0 || s.framed {
+		return offset, err
+	}
+	last := make([]byte, 1)
+	if _, err := s.dataFile.ReadAt(last, offset-1); err != nil {
+		return 0, err
+	}
+	if last[0] == '\n' {
+		return offset, nil
+	}
+	if err := w.WriteByte('\n'); err != nil {
+		return 0, err
+	}
+	return offset + 1, nil
+}
+
+// warnThrash logs that the record holding v went offline n times since the
+// last snapshot.
+func (s *Store[ID, T]) warnThrash(v T, n int32) {
+	if s.logger == nil {
+		return
+	}
+	id, err := s.idFunc(v)
+	if err != nil {
+		return
+	}
+	s.logger.Warn("flea: record keeps moving between memory and disk",
+		"id", id, "offloads", n, "path", s.Path())
+}
+
+// checkOffloaded logs a warning when payload, the offline copy of v, does
+// not read back as v; see Options.VerifyOffload.
+func (s *Store[ID, T]) checkOffloaded(v T, payload []byte) {
+	var back T
+	err := s.decode(payload, &back)
+	if err == nil {
+		if s.equal != nil && s.equal(v, back) {
+			return
+		}
+		if s.equal == nil && reflect.DeepEqual(v, back) {
+			return
+		}
+	}
+	id, _ := s.idFunc(v)
+	s.logger.Warn("flea: offline copy of a record differs from its in-memory value",
+		"id", id, "err", err, "path", s.Path())
+}
+
 func (s *Store[ID, T]) handleResidency() error {
 	if s.residencyFn == nil {
 		return nil
 	}
 
-	if s.maxInMemory >= 0 && len(s.index) <= s.maxInMemory {
+	if s.maxInMemory >= 0 && s.onlineCount <= s.maxInMemory {
 		return nil
 	}
 
 	offline := make([]*record[T], 0, 1024)
+	var archive []*record[T]
+	online := s.onlineCount
 
-	ids := make([]ID, 0, len(s.index))
-	for id := range s.index {
-		ids = append(ids, id)
-	}
-
-	for _, id := range ids {
+	// Walk records in insertion order so the oldest ones are offloaded first.
+	for _, rec := range s.records {
 
-		rec, ok := s.index[id]
-		if !ok {
+		if rec.deleted {
 			continue
 		}
 
+		if rec.offloaded {
+			continue
+		}
 		obj := rec.value
 
-		if obj == nil {
+		if rec.recent {
 			continue
 		}
 
@@ -110,18 +324,327 @@ func (s *Store[ID, T]) handleResidency() error {
 			continue
 		}
 
-		offline = append(offline, rec)
-		//rec.value = nil
-		s.onlineCount--
+		if s.archiveFn != nil && s.archiveFn(*obj) {
+			archive = append(archive, rec)
+		} else {
+			offline = append(offline, rec)
+		}
+		online--
 
-		if s.maxInMemory >= 0 && s.onlineCount <= s.maxInMemory {
+		if s.maxInMemory >= 0 && online <= s.maxInMemory {
 			break
 		}
+	}
+
+	if len(archive) > 0 {
+		if err := s.appendToArchive(archive); err != nil {
+			return err
+		}
+	}
+	if len(offline) == 0 {
+		return nil
+	}
+	return s.appendToDisk(offline)
+}
+
+// WarmAll loads offline records back into memory, oldest first, until the
+// store holds MaxInMemoryRecords online records; without a cap, every
+// offline record is loaded. Archived records stay in the archive. It is
+// meant for a controlled warm-up before a burst of queries, or for a store
+// that shrank below its cap.
+//
+// Residency still applies to later writes: without a cap, the next write
+// offloads again the records ResidencyFunc rejects. The space the loaded
+// records held in the data file is reclaimed by the next compaction.
+func (s *Store[ID, T]) WarmAll() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, rec := range s.records {
+		if s.maxInMemory >= 0 && s.onlineCount >= s.maxInMemory {
+			break
+		}
+		if rec.deleted || !rec.offloaded || rec.archived {
+			continue
+		}
+		v, err := s.loadFromDisk(rec.offset, rec.size)
+		if err != nil {
+			return err
+		}
+		rec.value = &v
+		rec.offloaded = false
+		s.offlineCount--
+		s.onlineCount++
+		s.superseded++
+	}
+	s.checkCompaction()
+	return nil
+}
+
+// rewriteDataFile copies the offline payload of the live records in s.records
+// into a fresh data file, dropping the space held by deleted or superseded
+// entries, and updates every offline record with its new offset.
+func (s *Store[ID, T]) rewriteDataFile() error {
+	if s.dataFile == nil {
+		return nil
+	}
+
+	tmp := s.getPath("data.tmp")
+	f, err := s.fs.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	offsets := make(map[*record[T]]int64)
+	var offset int64
+	for _, rec := range s.records {
+		if !rec.offloaded || rec.archived {
+			continue
+		}
+		b, err := s.dataWindow.read(s.dataFile, rec.offset, rec.size)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		var buf bytes.Buffer
+		s.writeFrame(&buf, b)
+		if _, err := f.Write(buf.Bytes()); err != nil {
+			f.Close()
+			return err
+		}
+		offsets[rec] = offset + s.framePrefix()
+		offset += s.frameLen(rec.size)
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := s.fs.Rename(tmp, s.getDataPath()); err != nil {
+		f.Close()
+		return err
+	}
+
+	s.dataFile.Close()
+	s.dataFile = f
+	s.dataWindow = &dataWindow{}
+
+	for rec, off := range offsets {
+		rec.offset = off
+	}
+	s.superseded = 0
+	return nil
+}
+
+// ScanFrom streams the offline data file starting at the given byte offset,
+// calling fn for every live offline record matching p together with the
+// offset of the next record. Passing that offset back to ScanFrom resumes
+// the scan right after the record, so long jobs can checkpoint their progress.
+//
+// Only offline records are visited; online records are never read. An error
+// returned by fn stops the scan and is returned as is. fn runs while the
+// store is locked and must not call back into it.
+func (s *Store[ID, T]) ScanFrom(offset int64, p Predicate[T], fn func(T, int64) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.dataFile == nil {
+		return nil
+	}
+	if s.framed {
+		return s.scanFrames(offset, p, fn)
+	}
+
+	live := make(map[int64]bool, s.offlineCount)
+	for _, rec := range s.records {
+		if rec.offloaded && !rec.deleted && !rec.archived {
+			live[rec.offset] = true
+		}
+	}
+
+	end, err := s.dataFile.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if offset >= end {
+		return nil
+	}
 
-		if len(offline) == 0 {
+	r := bufio.NewReader(io.NewSectionReader(s.dataFile, offset, end-offset))
+	for {
+		line, err := r.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if len(line) == 0 {
+			return nil
+		}
+
+		at := offset
+		offset += int64(len(line))
+
+		if live[at] {
+			v, err := s.decodeScratch(line)
+			if err != nil {
+				return err
+			}
+			ok, err := callPredicate(p, v)
+			if err != nil {
+				return err
+			}
+			if ok {
+				if err := fn(v, offset); err != nil {
+					return err
+				}
+			}
+		}
+
+		if err == io.EOF {
 			return nil
 		}
+	}
+}
 
+// scanFrames is ScanFrom for a framed data file. The live offline records
+// are visited by ascending offset, straight from their frames, so the bytes
+// between them are never parsed.
+func (s *Store[ID, T]) scanFrames(offset int64, p Predicate[T], fn func(T, int64) error) error {
+	recs := make([]*record[T], 0, s.offlineCount)
+	for _, rec := range s.records {
+		if rec.offloaded && !rec.deleted && !rec.archived && rec.offset-frameHeader >= offset {
+			recs = append(recs, rec)
+		}
 	}
-	return s.appendToDisk(offline)
+	slices.SortFunc(recs, func(a, b *record[T]) int {
+		return cmp.Compare(a.offset, b.offset)
+	})
+
+	for _, rec := range recs {
+		data, err := s.readFrame(rec.offset, rec.size)
+		if err != nil {
+			return err
+		}
+		v, err := s.decodeScratch(data)
+		if err != nil {
+			return err
+		}
+		ok, err := callPredicate(p, v)
+		if err != nil {
+			return err
+		}
+		if ok {
+			if err := fn(v, rec.offset+rec.size); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// BulkLoad reads newline-delimited JSON values of T from r and stores them,
+// returning how many were loaded. It is meant for cold loads of large data
+// sets: values that the residency settings would offload are written
+// straight to the data file instead of being held in memory first, and the
+// WAL is bypassed. A snapshot is taken before BulkLoad returns, so loaded
+// values are durable once it does, even when it fails halfway.
+//
+// Values are stored as they are: checkers and AfterWrite functions don't
+// run, and an id already in the store is overwritten.
+func (s *Store[ID, T]) BulkLoad(r io.Reader) (int, error) {
+	s.mu.Lock()
+	if s.readOnly {
+		s.mu.Unlock()
+		return 0, ErrReadOnly
+	}
+	n, err := s.bulkLoad(r)
+	s.mu.Unlock()
+
+	if serr := s.snapshot(); err == nil {
+		err = serr
+	}
+	return n, err
+}
+
+func (s *Store[ID, T]) bulkLoad(r io.Reader) (int, error) {
+	var w *bufio.Writer
+	var offset int64
+	if s.dataFile != nil {
+		w = bufio.NewWriter(s.dataFile)
+		end, err := s.dataFileEnd(w)
+		if err != nil {
+			return 0, err
+		}
+		offset = end
+	}
+
+	n := 0
+	now := time.Now().UnixNano()
+	err := func() error {
+		dec := json.NewDecoder(r)
+		for {
+			var v T
+			if err := dec.Decode(&v); err == io.EOF {
+				return nil
+			} else if err != nil {
+				return fmt.Errorf("value %d: %w", n, err)
+			}
+			s.normalize(&v)
+			if err := s.checkValue(v); err != nil {
+				return fmt.Errorf("value %d: %w", n, err)
+			}
+			id, err := s.idFunc(v)
+			if err != nil {
+				return fmt.Errorf("value %d: %w: %w", n, ErrIDFunc, err)
+			}
+
+			created, updated := s.timesOf(id, now)
+			blob, err := s.ensureBlob(&v, blobRef{})
+			if err != nil {
+				return err
+			}
+			if _, ok := s.index[id]; ok || w == nil || !s.offloadOnLoad(v) {
+				s.addOrUpdate(id, &v)
+			} else {
+				b, err := s.encode(v, blob)
+				if err != nil {
+					return fmt.Errorf("value %d: %w", n, err)
+				}
+				if err := s.writeFrame(w, b); err != nil {
+					return err
+				}
+				rec := &record[T]{offloaded: true, offset: offset + s.framePrefix(), size: int64(len(b)), version: 1}
+				offset += s.frameLen(rec.size)
+				s.records = append(s.records, rec)
+				s.index[id] = rec
+				s.offlineCount++
+				s.indexPut(id, v)
+			}
+			rec := s.index[id]
+			if created != 0 {
+				rec.createdAt, rec.updatedAt = created, updated
+			}
+			rec.blob = blob
+			s.notify(EventPut, id, v)
+			n++
+		}
+	}()
+
+	if w != nil {
+		if ferr := w.Flush(); err == nil {
+			err = ferr
+		}
+	}
+	if err != nil {
+		return n, err
+	}
+	return n, s.handleResidency()
+}
+
+// offloadOnLoad reports whether BulkLoad should write v straight to disk.
+func (s *Store[ID, T]) offloadOnLoad(v T) bool {
+	if s.residencyFn == nil || s.residencyFn(v) {
+		return false
+	}
+	return s.maxInMemory < 0 || s.onlineCount >= s.maxInMemory
 }
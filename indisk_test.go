@@ -1,8 +1,11 @@
 package flea
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
+	"slices"
 	"testing"
 	"time"
 )
@@ -90,7 +93,7 @@ func TestInDiskLargeDatasetResidency(t *testing.T) {
 	store.PutAll(users)
 
 	for _, rec := range store.records {
-		if rec.value != nil {
+		if !rec.offloaded {
 			if !store.residencyFn(*rec.value) {
 				t.Fatalf("invalid online record: %+v", *rec.value)
 			}
@@ -174,7 +177,7 @@ func TestInDiskLargeDatasetSnapshotReopen(t *testing.T) {
 	}
 
 	for _, rec := range store2.records {
-		if rec.value != nil {
+		if !rec.offloaded {
 			u := *rec.value
 			if !(u.Active && u.Age < 30) {
 				t.Fatalf(
@@ -215,3 +218,897 @@ func TestInDiskLargeDatasetGetStreaming(t *testing.T) {
 		}
 	}
 }
+
+func TestCompactReclaimsDeletedRecords(t *testing.T) {
+	dir := t.TempDir()
+
+	store := openUserStoreWithOpts(t, Options[uint64, User]{
+		Dir:    dir,
+		IDFunc: userID,
+		ResidencyFunc: func(u User) bool {
+			return u.Id%10 == 0
+		},
+	})
+	defer store.Close()
+
+	if _, err := store.PutAll(users[:1000]); err != nil {
+		t.Fatalf("put failed: %v", err)
+	}
+
+	before, err := os.Stat(store.getDataPath())
+	if err != nil {
+		t.Fatalf("offline data missing: %v", err)
+	}
+
+	if _, err := store.Delete(func(u User) bool { return u.Id%2 == 0 }); err != nil {
+		t.Fatalf("delete failed: %v", err)
+	}
+
+	if len(store.records) != 1000 {
+		t.Fatalf("expected tombstones to remain before compaction, got %d records", len(store.records))
+	}
+
+	if err := store.Compact(); err != nil {
+		t.Fatalf("compact failed: %v", err)
+	}
+
+	if len(store.records) != 500 {
+		t.Fatalf("expected 500 records after compaction, got %d", len(store.records))
+	}
+
+	after, err := os.Stat(store.getDataPath())
+	if err != nil {
+		t.Fatalf("offline data missing: %v", err)
+	}
+	if after.Size() >= before.Size() {
+		t.Fatalf("expected data file to shrink, got %d -> %d bytes", before.Size(), after.Size())
+	}
+
+	res := store.Get(all[User])
+	if len(res) != 500 {
+		t.Fatalf("expected 500 users after compaction, got %d", len(res))
+	}
+	for _, u := range res {
+		if u.Id%2 == 0 {
+			t.Fatalf("deleted user returned: %+v", u)
+		}
+		if u.Name != fmt.Sprintf("user-%d", u.Id) {
+			t.Fatalf("corrupted user after compaction: %+v", u)
+		}
+	}
+}
+
+func TestDeleteWhereLimitAcrossTiers(t *testing.T) {
+	dir := t.TempDir()
+
+	store := openUserStoreWithOpts(t, Options[uint64, User]{
+		Dir:    dir,
+		IDFunc: userID,
+		ResidencyFunc: func(u User) bool {
+			return u.Id%2 == 0
+		},
+	})
+	defer store.Close()
+
+	if _, err := store.PutAll(users[:10_000]); err != nil {
+		t.Fatalf("put failed: %v", err)
+	}
+
+	n, err := store.DeleteWhere(func(u User) bool { return u.Country == "PT" }, 100)
+	if err != nil {
+		t.Fatalf("delete failed: %v", err)
+	}
+	if n != 100 {
+		t.Fatalf("expected 100 deletes, got %d", n)
+	}
+
+	remaining := store.Get(func(u User) bool { return u.Country == "PT" })
+	if len(remaining) != 2_000-100 {
+		t.Fatalf("expected %d remaining PT users, got %d", 2_000-100, len(remaining))
+	}
+
+	// the oldest matches go first, across both tiers
+	if remaining[0].Id != 500 {
+		t.Fatalf("expected first remaining PT user to be 500, got %d", remaining[0].Id)
+	}
+
+	n, err = store.DeleteWhere(func(u User) bool { return u.Country == "PT" }, 0)
+	if err != nil {
+		t.Fatalf("delete failed: %v", err)
+	}
+	if n != 2_000-100 {
+		t.Fatalf("expected %d deletes, got %d", 2_000-100, n)
+	}
+
+	if err := store.Close(); err != nil {
+		t.Fatalf("close failed: %v", err)
+	}
+
+	store = openUserStoreWithOpts(t, Options[uint64, User]{
+		Dir:    dir,
+		IDFunc: userID,
+	})
+	defer store.Close()
+
+	if res := store.Get(func(u User) bool { return u.Country == "PT" }); len(res) != 0 {
+		t.Fatalf("expected PT users to stay deleted after restart, got %d", len(res))
+	}
+}
+
+func TestSnapshotKeepsOfflineRecordsAcrossReopen(t *testing.T) {
+	dir := t.TempDir()
+
+	opts := Options[uint64, User]{
+		Dir:    dir,
+		IDFunc: userID,
+		ResidencyFunc: func(u User) bool {
+			return u.Id%10 == 0
+		},
+	}
+
+	store := openUserStoreWithOpts(t, opts)
+
+	if _, err := store.PutAll(users[:1000]); err != nil {
+		t.Fatalf("put failed: %v", err)
+	}
+
+	// makes the store dirty so the snapshot compacts
+	if _, err := store.Delete(func(u User) bool { return u.Id == 1 }); err != nil {
+		t.Fatalf("delete failed: %v", err)
+	}
+
+	if err := store.snapshot(); err != nil {
+		t.Fatalf("snapshot failed: %v", err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("close failed: %v", err)
+	}
+
+	store = openUserStoreWithOpts(t, opts)
+	defer store.Close()
+
+	res := store.Get(all[User])
+	if len(res) != 999 {
+		t.Fatalf("expected 999 users after reopen, got %d", len(res))
+	}
+	for _, u := range res {
+		if u.Name != fmt.Sprintf("user-%d", u.Id) {
+			t.Fatalf("corrupted user after reopen: %+v", u)
+		}
+	}
+
+	if store.onlineCount != 100 {
+		t.Fatalf("expected 100 online users after reopen, got %d", store.onlineCount)
+	}
+}
+
+func TestScanFromResumesAtCheckpoint(t *testing.T) {
+	dir := t.TempDir()
+
+	store := openUserStoreWithOpts(t, Options[uint64, User]{
+		Dir:    dir,
+		IDFunc: userID,
+		ResidencyFunc: func(u User) bool {
+			return false
+		},
+	})
+	defer store.Close()
+
+	if _, err := store.PutAll(users[:1000]); err != nil {
+		t.Fatalf("put failed: %v", err)
+	}
+
+	// the stale copy of user 4 must be skipped, its new copy is appended
+	// at the end of the data file
+	if _, err := store.Put(User{Id: 4, Name: "updated", Active: true}); err != nil {
+		t.Fatalf("put failed: %v", err)
+	}
+
+	errStop := errors.New("stop")
+	active := func(u User) bool { return u.Active }
+
+	var seen []uint64
+	var checkpoint int64
+	err := store.ScanFrom(0, active, func(u User, next int64) error {
+		seen = append(seen, u.Id)
+		checkpoint = next
+		if len(seen) == 300 {
+			return errStop
+		}
+		return nil
+	})
+	if !errors.Is(err, errStop) {
+		t.Fatalf("expected scan to stop, got %v", err)
+	}
+
+	err = store.ScanFrom(checkpoint, active, func(u User, next int64) error {
+		seen = append(seen, u.Id)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("resume failed: %v", err)
+	}
+
+	var expected []uint64
+	for _, u := range users[:1000] {
+		if u.Active && u.Id != 4 {
+			expected = append(expected, u.Id)
+		}
+	}
+	expected = append(expected, 4)
+
+	if len(seen) != len(expected) {
+		t.Fatalf("expected %d users, got %d", len(expected), len(seen))
+	}
+	for i := range expected {
+		if seen[i] != expected[i] {
+			t.Fatalf("mismatch at %d: expected %d, got %d", i, expected[i], seen[i])
+		}
+	}
+}
+
+func TestFramedDataFile(t *testing.T) {
+	dir := t.TempDir()
+
+	opts := Options[uint64, User]{
+		Dir:            dir,
+		IDFunc:         userID,
+		FramedDataFile: true,
+		ResidencyFunc: func(u User) bool {
+			return false
+		},
+	}
+	store := openUserStoreWithOpts(t, opts)
+
+	for i := 1; i <= 10; i++ {
+		u := User{Id: uint64(i), Name: fmt.Sprintf("line one\nline %d", i), Active: i%2 == 0}
+		if _, err := store.Put(u); err != nil {
+			t.Fatalf("put failed: %v", err)
+		}
+	}
+	if _, err := store.Delete(func(u User) bool { return u.Id == 3 }); err != nil {
+		t.Fatalf("delete failed: %v", err)
+	}
+	if err := store.Compact(); err != nil {
+		t.Fatalf("compact failed: %v", err)
+	}
+
+	u, ok, err := store.GetByID(7)
+	if err != nil || !ok {
+		t.Fatalf("expected user 7, got %v", err)
+	}
+	if u.Name != "line one\nline 7" {
+		t.Fatalf("unexpected name %q", u.Name)
+	}
+
+	var seen []uint64
+	var checkpoint int64
+	errStop := errors.New("stop")
+	active := func(u User) bool { return u.Active }
+	err = store.ScanFrom(0, active, func(u User, next int64) error {
+		seen = append(seen, u.Id)
+		checkpoint = next
+		return errStop
+	})
+	if !errors.Is(err, errStop) {
+		t.Fatalf("expected scan to stop, got %v", err)
+	}
+	err = store.ScanFrom(checkpoint, active, func(u User, next int64) error {
+		seen = append(seen, u.Id)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("resume failed: %v", err)
+	}
+	if !slices.Equal(seen, []uint64{2, 4, 6, 8, 10}) {
+		t.Fatalf("unexpected scan %v", seen)
+	}
+	store.Close()
+
+	store = openUserStoreWithOpts(t, opts)
+	defer store.Close()
+	if store.Len() != 9 {
+		t.Fatalf("expected 9 users after reopen, got %d", store.Len())
+	}
+	u, _, err = store.GetByID(10)
+	if err != nil || u.Name != "line one\nline 10" {
+		t.Fatalf("unexpected user 10 after reopen: %+v, %v", u, err)
+	}
+}
+
+func TestCompactionTombstoneRatioTriggersCompaction(t *testing.T) {
+	dir := t.TempDir()
+
+	store := openUserStoreWithOpts(t, Options[uint64, User]{
+		Dir:                      dir,
+		IDFunc:                   userID,
+		SnapshotInterval:         time.Hour,
+		CompactionTombstoneRatio: 0.3,
+		ResidencyFunc: func(u User) bool {
+			return false
+		},
+	})
+	defer store.Close()
+
+	if _, err := store.PutAll(users[:100]); err != nil {
+		t.Fatalf("put failed: %v", err)
+	}
+	dataSize := func() int64 {
+		info, err := os.Stat(store.getDataPath())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info.Size()
+	}
+	before := dataSize()
+
+	records := func() int {
+		store.mu.Lock()
+		defer store.mu.Unlock()
+		return len(store.records)
+	}
+
+	// 20% wasted stays under the ratio
+	store.Delete(func(u User) bool { return u.Id <= 20 })
+	time.Sleep(50 * time.Millisecond)
+	if n := records(); n != 100 {
+		t.Fatalf("expected no compaction under the ratio, got %d records", n)
+	}
+
+	store.Delete(func(u User) bool { return u.Id <= 40 })
+	deadline := time.Now().Add(5 * time.Second)
+	for records() != store.Len() {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected compaction to drop the tombstones, got %d records", records())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if after := dataSize(); after >= before {
+		t.Fatalf("expected the data file to shrink, got %d bytes from %d", after, before)
+	}
+}
+
+func TestSnapshotToOpensAsNewStore(t *testing.T) {
+	store := openUserStoreWithOpts(t, Options[uint64, User]{
+		Dir:    t.TempDir(),
+		IDFunc: userID,
+		ResidencyFunc: func(u User) bool {
+			return u.Id%2 == 0
+		},
+	})
+	defer store.Close()
+
+	if _, err := store.PutAll(users[:100]); err != nil {
+		t.Fatalf("put failed: %v", err)
+	}
+	walBefore, err := os.ReadFile(store.getWalPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backup := t.TempDir()
+	exported := openUserStoreWithOpts(t, Options[uint64, User]{Dir: backup, IDFunc: userID})
+	path := exported.getSnapshotPath()
+	exported.Close()
+
+	if err := store.SnapshotTo(path); err != nil {
+		t.Fatalf("snapshot failed: %v", err)
+	}
+
+	walAfter, err := os.ReadFile(store.getWalPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(walBefore) != string(walAfter) {
+		t.Fatalf("expected the WAL to be left untouched")
+	}
+	if _, err := os.Stat(store.getSnapshotPath()); !os.IsNotExist(err) {
+		t.Fatalf("expected no live snapshot, got %v", err)
+	}
+
+	exported = openUserStoreWithOpts(t, Options[uint64, User]{Dir: backup, IDFunc: userID})
+	defer exported.Close()
+
+	got := exported.GetAll()
+	want := store.GetAll()
+	if len(got) != len(want) {
+		t.Fatalf("expected %d users, got %d", len(want), len(got))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("mismatch at %d: expected %+v, got %+v", i, want[i], got[i])
+		}
+	}
+}
+
+func TestDeterministicSnapshotIsByteIdentical(t *testing.T) {
+	snapshotOf := func(ids []uint64) []byte {
+		store := openUserStoreWithOpts(t, Options[uint64, User]{
+			Dir:                   t.TempDir(),
+			IDFunc:                userID,
+			DeterministicSnapshot: true,
+			ResidencyFunc: func(u User) bool {
+				return u.Id%3 == 0
+			},
+		})
+		defer store.Close()
+
+		for _, id := range ids {
+			if _, err := store.Put(User{Id: id, Name: fmt.Sprint("user ", id)}); err != nil {
+				t.Fatalf("put failed: %v", err)
+			}
+		}
+		if err := store.snapshot(); err != nil {
+			t.Fatalf("snapshot failed: %v", err)
+		}
+		b, err := os.ReadFile(store.getSnapshotPath())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+
+	a := snapshotOf([]uint64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10})
+	b := snapshotOf([]uint64{10, 3, 7, 1, 9, 2, 8, 4, 6, 5})
+	if string(a) != string(b) {
+		t.Fatalf("expected identical snapshots, got\n%s\nand\n%s", a, b)
+	}
+}
+
+func TestSnapshotSkipsUnreadableOfflineRecord(t *testing.T) {
+	dir := t.TempDir()
+	opts := Options[uint64, User]{
+		Dir:    dir,
+		IDFunc: userID,
+		ResidencyFunc: func(u User) bool {
+			return u.Id%2 == 0
+		},
+	}
+
+	store := openUserStoreWithOpts(t, opts)
+	for i := 1; i <= 6; i++ {
+		if _, err := store.Put(User{Id: uint64(i)}); err != nil {
+			t.Fatalf("put failed: %v", err)
+		}
+	}
+
+	store.mu.Lock()
+	rec := store.index[3]
+	if !rec.offloaded {
+		store.mu.Unlock()
+		t.Fatalf("expected user 3 offline")
+	}
+	rec.offset = 1 << 30
+	store.mu.Unlock()
+
+	err := store.snapshot()
+	var skipped *SkippedRecordsError[uint64]
+	if !errors.As(err, &skipped) || !errors.Is(err, ErrIO) {
+		t.Fatalf("expected a SkippedRecordsError, got %v", err)
+	}
+	if !slices.Equal(skipped.IDs, []uint64{3}) {
+		t.Fatalf("expected user 3 to be reported, got %v", skipped.IDs)
+	}
+	if err := store.Stats().SnapshotErr; !errors.As(err, &skipped) {
+		t.Fatalf("expected Stats to report the skipped records, got %v", err)
+	}
+	store.Close()
+
+	// the snapshot and the WAL were kept, so user 3 survives a restart
+	store = openUserStoreWithOpts(t, opts)
+	defer store.Close()
+	if store.Len() != 6 {
+		t.Fatalf("expected 6 records, got %d", store.Len())
+	}
+	if u, ok, _ := store.GetByID(3); !ok || u.Id != 3 {
+		t.Fatalf("expected user 3 to survive the restart, got %+v", u)
+	}
+}
+
+func TestSnapshotDoesNotBlockConcurrentPuts(t *testing.T) {
+	dir := t.TempDir()
+
+	opts := Options[uint64, User]{
+		Dir:    dir,
+		IDFunc: userID,
+		ResidencyFunc: func(u User) bool {
+			return u.Id%2 == 0
+		},
+	}
+
+	store := openUserStoreWithOpts(t, opts)
+
+	if _, err := store.PutAll(users[:20_000]); err != nil {
+		t.Fatalf("put failed: %v", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 20_000; i < 20_500; i++ {
+			if _, err := store.Put(users[i]); err != nil {
+				t.Errorf("put failed: %v", err)
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < 3; i++ {
+		if err := store.snapshot(); err != nil {
+			t.Fatalf("snapshot failed: %v", err)
+		}
+	}
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("puts stalled during snapshot")
+	}
+
+	if err := store.Close(); err != nil {
+		t.Fatalf("close failed: %v", err)
+	}
+
+	store = openUserStoreWithOpts(t, opts)
+	defer store.Close()
+
+	if n := store.Len(); n != 20_500 {
+		t.Fatalf("expected 20500 users after reopen, got %d", n)
+	}
+}
+
+func TestGetWithTimeoutReturnsPartialResults(t *testing.T) {
+	dir := t.TempDir()
+
+	store := openUserStoreWithOpts(t, Options[uint64, User]{
+		Dir:    dir,
+		IDFunc: userID,
+		ResidencyFunc: func(u User) bool {
+			return false
+		},
+	})
+	defer store.Close()
+
+	if _, err := store.PutAll(users[:50_000]); err != nil {
+		t.Fatalf("put failed: %v", err)
+	}
+
+	res, err := store.GetWithTimeout(func(u User) bool {
+		time.Sleep(10 * time.Microsecond)
+		return true
+	}, 20*time.Millisecond)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+	if len(res) == 0 || len(res) == 50_000 {
+		t.Fatalf("expected partial results, got %d", len(res))
+	}
+	for i, u := range res {
+		if u.Id != uint64(i) {
+			t.Fatalf("unexpected partial result at %d: %+v", i, u)
+		}
+	}
+
+	res, err = store.GetWithTimeout(func(u User) bool { return u.Id < 10 }, time.Minute)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(res) != 10 {
+		t.Fatalf("expected 10 results, got %d", len(res))
+	}
+}
+
+// flakyCodec encodes to a form it can't decode back while breakCodec is set.
+type flakyCodec struct {
+	Id uint64
+}
+
+var breakCodec bool
+
+func (f flakyCodec) MarshalJSON() ([]byte, error) {
+	if breakCodec {
+		return []byte(`{"Id":"broken"}`), nil
+	}
+	return []byte(fmt.Sprintf(`{"Id":%d}`, f.Id)), nil
+}
+
+func TestVerifySnapshotKeepsPreviousSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	defer func() { breakCodec = false }()
+
+	opts := Options[uint64, flakyCodec]{
+		Dir:            dir,
+		IDFunc:         func(f flakyCodec) (uint64, error) { return f.Id, nil },
+		VerifySnapshot: true,
+	}
+
+	s, err := Open[uint64, flakyCodec](opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.Put(flakyCodec{Id: 1})
+	if err := s.snapshot(); err != nil {
+		t.Fatalf("snapshot failed: %v", err)
+	}
+	s.Put(flakyCodec{Id: 2})
+
+	good, err := os.ReadFile(s.getSnapshotPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	breakCodec = true
+	if err := s.snapshot(); !errors.Is(err, ErrInvalidSnapshot) {
+		t.Fatalf("expected ErrInvalidSnapshot, got %v", err)
+	}
+	breakCodec = false
+
+	current, err := os.ReadFile(s.getSnapshotPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(current) != string(good) {
+		t.Fatalf("previous snapshot was replaced")
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = Open[uint64, flakyCodec](opts)
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	defer s.Close()
+
+	if s.Len() != 2 {
+		t.Fatalf("expected 2 records after reopen, got %d", s.Len())
+	}
+}
+
+func TestStatsCountsOfflineReadErrors(t *testing.T) {
+	store := openUserStoreWithOpts(t, Options[uint64, User]{
+		Dir:    t.TempDir(),
+		IDFunc: userID,
+		ResidencyFunc: func(u User) bool {
+			return u.Id%2 == 0
+		},
+	})
+	defer store.Close()
+	for i := 1; i <= 4; i++ {
+		if _, err := store.Put(User{Id: uint64(i)}); err != nil {
+			t.Fatalf("put failed: %v", err)
+		}
+	}
+	if n := store.Stats().ReadErrors; n != 0 {
+		t.Fatalf("expected no read errors yet, got %d", n)
+	}
+
+	store.mu.Lock()
+	store.index[3].offset = 1 << 30
+	store.mu.Unlock()
+
+	if got := store.Get(nil); got != nil {
+		t.Fatalf("expected Get to return nil, got %v", got)
+	}
+	if _, err := store.GetE(nil); !errors.Is(err, ErrIO) {
+		t.Fatalf("expected GetE to return ErrIO, got %v", err)
+	}
+	if n := store.Stats().ReadErrors; n != 2 {
+		t.Fatalf("expected 2 read errors, got %d", n)
+	}
+}
+
+type attachment struct {
+	Id   uint64
+	Name string
+	Data []byte
+}
+
+func TestBlobFieldKeepsDataFileSmall(t *testing.T) {
+	dir := t.TempDir()
+	opts := Options[uint64, attachment]{
+		Dir:    dir,
+		IDFunc: func(a attachment) (uint64, error) { return a.Id, nil },
+		ResidencyFunc: func(attachment) bool {
+			return false
+		},
+		BlobField: func(a *attachment) *[]byte { return &a.Data },
+	}
+	store, err := Open[uint64, attachment](opts)
+	if err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	blob := make([]byte, 1<<20)
+	for i := range blob {
+		blob[i] = byte(i * 7)
+	}
+	if _, err := store.Put(attachment{Id: 1, Name: "photo", Data: blob}); err != nil {
+		t.Fatalf("put failed: %v", err)
+	}
+
+	size := func(path string) int64 {
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Fatalf("stat %s: %v", path, err)
+		}
+		return fi.Size()
+	}
+	if n := size(store.getDataPath()); n > 4096 {
+		t.Fatalf("expected a small data file, got %d bytes", n)
+	}
+	if n := size(store.getWalPath()); n > 4096 {
+		t.Fatalf("expected a small WAL, got %d bytes", n)
+	}
+	if n := size(store.getBlobPath()); n < int64(len(blob)) {
+		t.Fatalf("expected the blob in %s, got %d bytes", store.getBlobPath(), n)
+	}
+
+	check := func(s *Store[uint64, attachment]) {
+		t.Helper()
+		got := s.Get(nil)
+		if len(got) != 1 || got[0].Name != "photo" || !slices.Equal(got[0].Data, blob) {
+			t.Fatalf("blob did not round-trip")
+		}
+	}
+	check(store)
+
+	if err := store.snapshot(); err != nil {
+		t.Fatalf("snapshot failed: %v", err)
+	}
+	if n := size(store.getSnapshotPath()); n > 4096 {
+		t.Fatalf("expected a small snapshot, got %d bytes", n)
+	}
+	store.Close()
+
+	store, err = Open[uint64, attachment](opts)
+	if err != nil {
+		t.Fatalf("failed to reopen store: %v", err)
+	}
+	defer store.Close()
+	check(store)
+}
+
+func TestMaxSnapshotAgeSnapshotsOnRead(t *testing.T) {
+	store := openUserStoreWithOpts(t, Options[uint64, User]{
+		Dir:              t.TempDir(),
+		IDFunc:           userID,
+		SnapshotInterval: time.Hour,
+		MaxSnapshotAge:   time.Minute,
+	})
+	defer store.Close()
+
+	clock := time.Now()
+	store.mu.Lock()
+	store.now = func() time.Time { return clock }
+	store.lastSnapshot = clock
+	store.mu.Unlock()
+
+	if _, err := store.Put(users[0]); err != nil {
+		t.Fatalf("put failed: %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if _, err := os.Stat(store.getSnapshotPath()); err == nil {
+		t.Fatalf("expected no snapshot within MaxSnapshotAge")
+	}
+
+	store.mu.Lock()
+	clock = clock.Add(2 * time.Minute)
+	store.mu.Unlock()
+	if age := store.SnapshotAge(); age != 2*time.Minute {
+		t.Fatalf("expected a snapshot age of 2m, got %v", age)
+	}
+
+	store.Get(nil)
+	deadline := time.Now().Add(5 * time.Second)
+	for store.SnapshotAge() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected a stale read to trigger a snapshot")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := os.Stat(store.getSnapshotPath()); err != nil {
+		t.Fatalf("expected a snapshot file: %v", err)
+	}
+}
+
+func TestSnapshotViewIgnoresLaterDeletesAndCompaction(t *testing.T) {
+	store := openUserStoreWithOpts(t, Options[uint64, User]{
+		Dir:              t.TempDir(),
+		IDFunc:           userID,
+		SnapshotInterval: time.Hour,
+		ResidencyFunc: func(u User) bool {
+			return u.Id%2 == 0
+		},
+	})
+	defer store.Close()
+
+	if _, err := store.PutAll(users[:200]); err != nil {
+		t.Fatalf("put failed: %v", err)
+	}
+	view, err := store.SnapshotView()
+	if err != nil {
+		t.Fatalf("snapshot view failed: %v", err)
+	}
+	defer view.Close()
+
+	done := make(chan error)
+	go func() {
+		for i := 0; i < 200; i += 10 {
+			lo := uint64(i)
+			store.Delete(func(u User) bool { return u.Id >= lo && u.Id < lo+10 })
+			if err := store.Compact(); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+
+	for {
+		got, err := view.Get(nil)
+		if err != nil {
+			t.Fatalf("view query failed: %v", err)
+		}
+		if !slices.Equal(got, users[:200]) {
+			t.Fatalf("expected the view to keep the 200 records, got %d", len(got))
+		}
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatalf("compaction failed: %v", err)
+			}
+			if store.Len() != 0 {
+				t.Fatalf("expected every record deleted from the store, got %d", store.Len())
+			}
+			odd, err := view.Get(func(u User) bool { return u.Id%2 == 1 })
+			if err != nil || len(odd) != 100 {
+				t.Fatalf("expected 100 offline records in the view, got %d: %v", len(odd), err)
+			}
+			return
+		default:
+		}
+	}
+}
+
+func TestSnapshotViewSurvivesDeleteAll(t *testing.T) {
+	store := openUserStoreWithOpts(t, Options[uint64, User]{
+		Dir:    t.TempDir(),
+		IDFunc: userID,
+		ResidencyFunc: func(u User) bool {
+			return u.Id%2 == 0
+		},
+	})
+	defer store.Close()
+
+	if _, err := store.PutAll(users[:50]); err != nil {
+		t.Fatalf("put failed: %v", err)
+	}
+	view, err := store.SnapshotView()
+	if err != nil {
+		t.Fatalf("snapshot view failed: %v", err)
+	}
+	defer view.Close()
+
+	if _, err := store.DeleteAll(); err != nil {
+		t.Fatalf("delete all failed: %v", err)
+	}
+	check := func() {
+		t.Helper()
+		got, err := view.Get(nil)
+		if err != nil {
+			t.Fatalf("view query failed: %v", err)
+		}
+		if !slices.Equal(got, users[:50]) {
+			t.Fatalf("expected the view to keep the 50 records, got %d", len(got))
+		}
+	}
+	check()
+
+	// new offline records go to the new data file, not over the old one
+	if _, err := store.PutAll(users[50:100]); err != nil {
+		t.Fatalf("put failed: %v", err)
+	}
+	check()
+}
@@ -0,0 +1,16 @@
+//go:build !unix
+
+package flea
+
+import "os"
+
+// Cross-process locking is only implemented on unix platforms.
+// Elsewhere the LOCK file is created but not enforced.
+
+func lockFile(f *os.File) error {
+	return nil
+}
+
+func unlockFile(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,138 @@
+package flea
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Migrate moves the store written with records of the type named from to
+// the model directory of T, both under opts.Dir, so that renaming a Go type
+// doesn't orphan its records. from is the old type name as reflect prints
+// it, e.g. "main.Customer", or the name of its directory, e.g.
+// "main_customer".
+//
+// The types recorded in the snapshot and the WAL are checked against ID and
+// T like on Open, except for their name, and are rewritten with the name of
+// T. Migrate fails with ErrLocked while the old store is open, and fails if
+// T already has a directory under Dir. A migration cut short can be run
+// again.
+func Migrate[ID comparable, T any](opts Options[ID, T], from string) error {
+	s, err := newStore(opts)
+	if err != nil {
+		return err
+	}
+
+	src := filepath.Join(s.dir, sanitizeTypeName(from))
+	dst := s.Path()
+	if src == dst {
+		return nil
+	}
+	if _, err := s.fs.Stat(src); err != nil {
+		return fmt.Errorf("flea: no store to migrate at %s: %w", src, err)
+	}
+	if _, err := s.fs.Stat(dst); err == nil {
+		return fmt.Errorf("flea: can't migrate %s to %s: it already exists", src, dst)
+	}
+
+	lock, err := s.fs.OpenFile(filepath.Join(src, "LOCK"), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	if osf, ok := lock.(*os.File); ok {
+		if err := lockFile(osf); err != nil {
+			return err
+		}
+		defer unlockFile(osf)
+	}
+
+	if err := s.retype(filepath.Join(src, "snapshot.ndjson"), func(line []byte) ([]byte, error) {
+		var h snapshotHeaderLine
+		if json.Unmarshal(line, &h) != nil || h.Header == nil || h.Header.Type == nil {
+			return nil, nil
+		}
+		if err := s.renamedFrom(h.Header.Type); err != nil {
+			return nil, err
+		}
+		h.Header.Type = s.typeSig
+		return json.Marshal(h)
+	}); err != nil {
+		return err
+	}
+	if err := s.retype(filepath.Join(src, "wal.log"), func(line []byte) ([]byte, error) {
+		var l walTypeLine
+		if json.Unmarshal(line, &l) != nil || l.Op != opType || l.Type == nil {
+			return nil, nil
+		}
+		if err := s.renamedFrom(l.Type); err != nil {
+			return nil, err
+		}
+		l.Type = s.typeSig
+		return json.Marshal(l)
+	}); err != nil {
+		return err
+	}
+
+	return s.fs.Rename(src, dst)
+}
+
+// renamedFrom returns ErrTypeMismatch unless records written with stored
+// decode into the types of s once renamed.
+func (s *Store[ID, T]) renamedFrom(stored *typeSig) error {
+	renamed := *stored
+	renamed.Name = s.typeSig.Name
+	return s.typeSig.compatible(&renamed)
+}
+
+// retype replaces the first line of the file at path with what fn returns
+// for it, leaving the file as it is when fn returns nil. The new file is
+// written aside and renamed over the old one.
+func (s *Store[ID, T]) retype(path string, fn func(line []byte) ([]byte, error)) error {
+	f, err := s.fs.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	line, err := r.ReadBytes('\n')
+	if err != nil && err != io.EOF {
+		return err
+	}
+	first, err := fn(line)
+	if err != nil || first == nil {
+		return err
+	}
+
+	tmp := path + ".migrate"
+	out, err := s.fs.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(out)
+	w.Write(first)
+	w.WriteByte('\n')
+	if _, err := io.Copy(w, r); err != nil {
+		out.Close()
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return s.fs.Rename(tmp, path)
+}
@@ -2,22 +2,215 @@ package flea
 
 import (
 	"errors"
+	"fmt"
+	"log/slog"
+	"reflect"
 	"time"
 )
 
 var LOW int = -1
 
+// ResidencyMode selects when ResidencyFunc is applied.
+type ResidencyMode int
+
+const (
+	// ResidencyDefault derives the mode from MaxInMemoryRecords: nil or -1
+	// behave as ResidencyAlways, a value >= 0 as ResidencyCapped.
+	ResidencyDefault ResidencyMode = iota
+	// ResidencyAlways applies ResidencyFunc after every write.
+	// MaxInMemoryRecords must be left nil.
+	ResidencyAlways
+	// ResidencyCapped applies ResidencyFunc only while more than
+	// MaxInMemoryRecords records are in memory. MaxInMemoryRecords must be
+	// set to a value >= 0.
+	ResidencyCapped
+	// ResidencyDisabled keeps every record in memory and ignores
+	// ResidencyFunc.
+	ResidencyDisabled
+)
+
 type Options[ID comparable, T any] struct {
 	// Path to local where store will be created.
 	Dir string
+	// File system the store persists to. Defaults to OSFS. The directory
+	// lock is only taken on the local disk.
+	FS FS
 
 	// Time interval for snapshot creation
 	SnapshotInterval time.Duration
-	IDFunc           IDFunc[ID, T]
-	Checkers         []Checker[T]
+	// Snapshots the store on the ticks of a Scheduler shared with other
+	// stores, instead of a goroutine and ticker of its own. SnapshotInterval
+	// is then ignored.
+	Scheduler *Scheduler
+	// Snapshots the store in the background as soon as a read or a write
+	// finds the last snapshot older than this, so that a store that is
+	// rarely written doesn't keep a long WAL to replay until the next
+	// interval. 0 leaves snapshots to SnapshotInterval alone.
+	MaxSnapshotAge time.Duration
+	// How long a Put waits for other writers to share its WAL fsync. Puts
+	// within the same window are made durable by a single fsync, which
+	// raises throughput with many concurrent writers at the cost of latency.
+	// A write is visible to readers before its fsync returns, and is rolled
+	// back if the fsync fails; watchers and AfterWrite functions only see it
+	// once it is durable. 0 syncs every Put on its own.
+	GroupCommitWindow time.Duration
+	// Holds WAL writes in memory until WriteBufferRecords ops or
+	// WriteBufferBytes bytes are pending, then writes and fsyncs them at
+	// once, so bursty writers don't wait for an fsync each. Buffered writes
+	// are lost on a crash; Flush, Close and snapshots write them out. 0
+	// means no limit; the buffer is off when both are 0.
+	WriteBufferRecords int
+	WriteBufferBytes   int
+	// Only matters for a custom FS whose Sync can fail with EINTR or
+	// EAGAIN: such a WAL fsync is retried up to SyncRetries times, waiting
+	// SyncRetryBackoff before the first retry and twice as long before each
+	// next one. OSFS never reports these, as os.File.Sync already retries
+	// EINTR, so it is unaffected. Other errors are never retried: after a
+	// failed fsync the kernel may have dropped the unwritten data, and a
+	// retry that succeeds would not mean it is on disk. The store lock is
+	// held meanwhile. 0 fails on the first error.
+	SyncRetries      int
+	SyncRetryBackoff time.Duration
+	// Writes snapshot records ordered by id instead of insertion order, so
+	// equal data always gives byte-identical snapshots. Numeric and string
+	// ids are ordered by value, others by their JSON encoding. As records
+	// are reloaded in snapshot order, insertion order becomes id order after
+	// a restart.
+	DeterministicSnapshot bool
+	// Decodes every new snapshot before it replaces the current one. A
+	// snapshot that fails is discarded and the WAL is kept.
+	VerifySnapshot bool
+	// Directory snapshots are written to before they replace the current
+	// one, instead of the model directory. It is joined with the name of T
+	// and a hash of the path of the store, so that several stores can share
+	// it. When it is on another file system than Dir, the finished
+	// snapshot is copied next to the current one and renamed from there.
+	TempDir string
+	// Records are persisted with encoding/json, which silently drops
+	// unexported and `json:"-"` fields. With StrictEncoding, Open fails with
+	// ErrLossyType when T has such fields, or channel, func or complex ones.
+	StrictEncoding bool
+	// Computes the id of a value. When nil, uint64, uint32 and string ids
+	// default to HashIDFunc, Hash32IDFunc and HexHashIDFunc.
+	IDFunc IDFunc[ID, T]
+	// Mixed into the digest of the default IDFunc, so that equal values get
+	// different ids in stores with different seeds, as with
+	// SeededHashIDFunc. Changing the seed of an existing store changes every
+	// id. 0 leaves the default IDFunc unseeded.
+	HashSeed uint64
+	// What a write does when its id is already taken by a different value.
+	OnIDCollision  CollisionPolicy
+	Checkers       []Checker[T]
+	DeleteCheckers []DeleteChecker[T]
+	AfterWrite     []AfterWrite[T]
+	// Returns the []byte field of a struct T to store apart, for large
+	// blobs that JSON would base64-encode into every file of the store.
+	// Blobs are written once to blobs.bin, and records only hold a short
+	// reference to theirs; values read back get their blob again.
+	BlobField func(*T) *[]byte
+	// Values derived from T by name, like a full name from a first and a
+	// last name, to index without adding them to T, see AddFieldIndex.
+	// They are computed on every write and never persisted.
+	ComputedFields map[string]func(T) any
+	// Deep-copies in-memory values returned by Get and GetByID. Without it
+	// the returned values are shallow copies, so pointers, maps and slices
+	// inside T are shared with the store. Cloning runs once per returned
+	// value and can dominate the cost of large queries.
+	CloneFunc func(T) T
+	// Reports whether two values are the same. When set, a write of a value
+	// equal to the stored one is a no-op: nothing is logged to the WAL and
+	// AfterWrite doesn't run. Off by default.
+	Equal func(a, b T) bool
+	// Largest encoded size of a record, in bytes. Writes of bigger values fail
+	// with ErrRecordTooLarge, and so do reads of bigger records from the
+	// snapshot, the WAL or the data file. 0 means no limit.
+	MaxRecordBytes int
+	// Called by GetByID for an id the store doesn't hold, so the store can
+	// sit in front of an external source such as a database. It runs
+	// without the store lock. Values it finds are returned as they are.
+	Loader func(id ID) (T, bool, error)
+	// Stores the values found by Loader with Put, so residency rules apply
+	// to them like to any other record. Ignored by read-only stores.
+	CacheLoaded bool
+	// Number of goroutines evaluating the predicate of Get, GetFunc,
+	// GetSorted and GetAny. Matches keep their insertion order. Only worth it
+	// for expensive predicates over large stores, since values are read and
+	// cloned before the predicate runs; 0 and 1 evaluate it sequentially.
+	GetParallelism int
+	// Called on every value decoded from disk: snapshot, WAL replay and
+	// offline reads. It can migrate or validate values persisted by an older
+	// version of T; an error fails the read. It never runs on values just
+	// written, but may run more than once for the same record, so it must be
+	// idempotent.
+	OnLoad func(*T) error
+	// Called while Open replays the WAL, every 1000 ops and once at the end,
+	// with the number of ops replayed so far. Never called without a WAL.
+	OnReplayProgress func(processed int)
 	// Experimental: controls which records remain resident in memory
 	ResidencyFunc      func(T) bool
 	MaxInMemoryRecords *int
+	ResidencyMode      ResidencyMode
+	// Sends the records that residency offloads and for which it returns
+	// true to archive.ndjson.gz instead of the data file. Get and the other
+	// predicate queries skip archived records; GetWithArchive includes them.
+	// The choice is made when a record is offloaded. Requires a
+	// ResidencyFunc.
+	ArchiveFunc func(T) bool
+	// Whether Open offloads records once the snapshot and the WAL are
+	// loaded. nil means true. With false, Open does no residency I/O and
+	// every record stays in memory until the first write or ApplyResidency.
+	ResidencyOnReplay *bool
+	// Records written since the last snapshot are never offloaded, so hot
+	// records that are updated often don't bounce between memory and disk.
+	// Until the next snapshot they may push the store over
+	// MaxInMemoryRecords.
+	KeepRecentWritesOnline bool
+	// Every record keeps the time of its first and its last write, outside
+	// of T, see Store.Meta. Records written while the option was off have
+	// no times until their next write.
+	TrackTimestamps bool
+	// How many times a record may be offloaded between two snapshots before
+	// a warning is logged, once per record and interval. A record that keeps
+	// bouncing between memory and disk is rewritten to the data file on
+	// every bounce. Defaults to 10.
+	ThrashThreshold int
+	// Writes offline records to the data file as length-prefixed frames
+	// instead of NDJSON lines. Every read checks the length prefix, and
+	// ScanFrom jumps from frame to frame without parsing lines. The data
+	// file is rebuilt on Open, so the setting can change between runs.
+	FramedDataFile bool
+	// Compacts the store, offline data file included, as soon as more than
+	// this fraction of its entries are wasted: deleted records, and offline
+	// payloads superseded by an update. Compaction then runs in the
+	// background without waiting for the next snapshot. 0 only compacts
+	// with snapshots.
+	CompactionTombstoneRatio float64
+	// How long deleted records survive compaction, so Restore can bring them
+	// back. Retained tombstones live in memory only and are not written to
+	// snapshots, so a restart drops them. 0 drops them on the next compaction.
+	TombstoneRetention time.Duration
+	// Every Put appends a new record, even when a record already has its id:
+	// Get returns all of them in write order, GetByID the latest one. Meant
+	// for event logs; deletes fail with ErrAppendOnly, except DeleteAll, and
+	// sorted indexes only hold the latest record of each id.
+	AppendOnly bool
+	// Opens the store without taking the directory lock. A read-only store
+	// keeps every record in memory, never writes to Dir and rejects writes
+	// with ErrReadOnly.
+	ReadOnly bool
+	// Keeps every record in memory only: no file is created in Dir, nothing
+	// is persisted, and the data is gone once the store is closed. Meant for
+	// tests and ephemeral caches.
+	InMemory bool
+	// Receives the warnings of the store, such as residency thrashing. No
+	// logging when nil.
+	Logger *slog.Logger
+	// Debugging aid: every record written to the data file or the archive
+	// is decoded back and compared with its in-memory value, using Equal
+	// or reflect.DeepEqual, and a mismatch is logged as a warning. It
+	// catches values whose offline copy reads back differently, e.g. a
+	// field set by a Checker that doesn't survive JSON. Requires a Logger.
+	VerifyOffload bool
 }
 
 func (o *Options[ID, T]) Validate() error {
@@ -26,19 +219,107 @@ func (o *Options[ID, T]) Validate() error {
 		o.Dir = "."
 	}
 
+	if o.FS == nil {
+		o.FS = OSFS{}
+	}
+
 	// SnapshotInterval default: 30s
 	if o.SnapshotInterval == 0 {
 		o.SnapshotInterval = 30 * time.Second
 	}
 
+	// ThrashThreshold default: 10
+	if o.ThrashThreshold == 0 {
+		o.ThrashThreshold = 10
+	}
+
 	if o.Checkers == nil {
 		o.Checkers = []Checker[T]{}
 	}
 
+	switch o.ResidencyMode {
+	case ResidencyAlways:
+		if o.ResidencyFunc == nil {
+			return errors.New("ResidencyAlways requires a ResidencyFunc")
+		}
+		if o.MaxInMemoryRecords != nil && *o.MaxInMemoryRecords >= 0 {
+			return errors.New("MaxInMemoryRecords can't be used with ResidencyAlways")
+		}
+	case ResidencyCapped:
+		if o.ResidencyFunc == nil {
+			return errors.New("ResidencyCapped requires a ResidencyFunc")
+		}
+		if o.MaxInMemoryRecords == nil || *o.MaxInMemoryRecords < 0 {
+			return errors.New("ResidencyCapped requires MaxInMemoryRecords >= 0")
+		}
+	case ResidencyDisabled:
+		o.ResidencyFunc = nil
+		o.ArchiveFunc = nil
+	}
+
+	if o.ArchiveFunc != nil && o.ResidencyFunc == nil {
+		return errors.New("ArchiveFunc requires a ResidencyFunc")
+	}
+
 	if o.MaxInMemoryRecords == nil {
 		o.MaxInMemoryRecords = &LOW
 	}
 
+	if o.MaxSnapshotAge < 0 {
+		return errors.New("MaxSnapshotAge must be >= 0")
+	}
+
+	if o.GetParallelism < 0 {
+		return errors.New("GetParallelism must be >= 0")
+	}
+
+	if o.SyncRetries < 0 || o.SyncRetryBackoff < 0 {
+		return errors.New("SyncRetries and SyncRetryBackoff must be >= 0")
+	}
+
+	if o.WriteBufferRecords < 0 || o.WriteBufferBytes < 0 {
+		return errors.New("WriteBufferRecords and WriteBufferBytes must be >= 0")
+	}
+	if (o.WriteBufferRecords > 0 || o.WriteBufferBytes > 0) && o.GroupCommitWindow > 0 {
+		return errors.New("a write buffer can't be used with GroupCommitWindow")
+	}
+
+	if o.CompactionTombstoneRatio < 0 || o.CompactionTombstoneRatio >= 1 {
+		return errors.New("CompactionTombstoneRatio must be in [0, 1)")
+	}
+
+	if o.AppendOnly && o.DeterministicSnapshot {
+		return errors.New("AppendOnly can't be used with DeterministicSnapshot")
+	}
+	if o.AppendOnly && o.OnIDCollision == CollisionReject {
+		return errors.New("AppendOnly can't be used with CollisionReject")
+	}
+
+	if o.VerifyOffload && o.Logger == nil {
+		return errors.New("VerifyOffload requires a Logger")
+	}
+
+	if o.BlobField != nil && reflect.TypeFor[T]().Kind() != reflect.Struct {
+		return errors.New("BlobField requires a struct T")
+	}
+
+	for name, fn := range o.ComputedFields {
+		if fn == nil {
+			return fmt.Errorf("computed field %q has no function", name)
+		}
+	}
+
+	if o.InMemory && o.ReadOnly {
+		return errors.New("InMemory can't be used with ReadOnly")
+	}
+
+	// IDFunc default: a content hash, for uint64, uint32 and string ids
+	if o.IDFunc != nil && o.HashSeed != 0 {
+		return errors.New("HashSeed only applies to the default IDFunc")
+	}
+	if o.IDFunc == nil {
+		o.IDFunc = defaultIDFunc[ID, T](o.HashSeed)
+	}
 	if o.IDFunc == nil {
 		return errors.New("IDFunc must be provided")
 	}
@@ -1,43 +1,113 @@
 package flea
 
 import (
-	"bufio"
 	"encoding/json"
-	"os"
+	"reflect"
 )
 
-func (s *Store[ID, T]) replayWAL() error {
+// replayProgressInterval is how many WAL ops are replayed between two
+// OnReplayProgress calls.
+const replayProgressInterval = 1000
+
+// walOverhead is an upper bound of the bytes a WAL op adds to its value and
+// its id.
+const walOverhead = len(`{"seq":`) + 20 + len(`,"op":"delete"`) + len(`,"Id":`) +
+	len(`,"Value":`) + len(`,"ver":`) + 20 + len(`,"cat":`) + 20 + len(`,"uat":`) + 20 + 1
+
+// walLineLimit returns the longest WAL line replayWAL reads under
+// MaxRecordBytes, 0 when there is no limit. Numeric ids have a bounded
+// encoding; other ids are bounded like the values.
+func (s *Store[ID, T]) walLineLimit() int {
+	if s.maxRecordBytes <= 0 {
+		return 0
+	}
+	id := s.maxRecordBytes
+	switch reflect.TypeFor[ID]().Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64, reflect.Bool:
+		id = 24
+	}
+	return s.maxRecordBytes + id + walOverhead
+}
+
+// replayWAL applies the WAL ops newer than the snapshot sequence number
+// after and returns the sequence number of the last op. Ops written before
+// sequence numbers existed have Seq 0 and are always applied.
+func (s *Store[ID, T]) replayWAL(after uint64) (uint64, error) {
+	last := after
 	path := s.getWalPath()
-	f, err := os.Open(path)
+	f, err := s.fs.Open(path)
 	if err != nil {
-		return nil
+		return last, nil
 	}
 	defer f.Close()
 
-	sc := bufio.NewScanner(f)
+	processed := 0
+	sc := newLineScanner(f, s.walLineLimit())
 	for sc.Scan() {
 		var op walOp[ID, T]
 		if err := json.Unmarshal(sc.Bytes(), &op); err != nil {
-			return err
+			return 0, err
+		}
+		if op.Op == opType {
+			if err := s.typeSig.compatible(op.Type); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		if op.Seq != 0 && op.Seq <= after {
+			continue
 		}
+		var blob blobRef
+		if op.Op == opPut {
+			if blob, err = s.attachBlob(&op.Value); err != nil {
+				return 0, err
+			}
+		}
+		if op.Op == opPut && s.onLoad != nil {
+			if err := s.onLoad(&op.Value); err != nil {
+				return 0, err
+			}
+		}
+		last = max(last, op.Seq)
 		switch op.Op {
 		case opPut:
 			s.addOrUpdate(op.ID, &op.Value)
+			if op.Version != 0 {
+				s.index[op.ID].version = op.Version
+			}
+			if op.Created != 0 {
+				rec := s.index[op.ID]
+				rec.createdAt, rec.updatedAt = op.Created, op.Updated
+			}
+			if s.index[op.ID].blob, err = s.ensureBlob(&op.Value, blob); err != nil {
+				return 0, err
+			}
 		case opDelete:
 			s.deleteByID(op.ID)
+		case opClear:
+			if err := s.clear(); err != nil {
+				return 0, err
+			}
+		}
+		processed++
+		if s.onReplayProgress != nil && processed%replayProgressInterval == 0 {
+			s.onReplayProgress(processed)
 		}
 	}
-	truncate(f)
-	s.handleResidency()
-	return nil
-}
-
-func truncate(f *os.File) error {
-	if err := f.Truncate(0); err != nil {
-		return err
+	if err := sc.Err(); err != nil {
+		return 0, scanErr(err)
+	}
+	if s.onReplayProgress != nil && processed%replayProgressInterval != 0 {
+		s.onReplayProgress(processed)
 	}
-	_, err := f.Seek(0, 0)
-	return err
+	// The WAL is left untouched: replayed ops only live in memory until the
+	// next snapshot, which is the one trimming the WAL.
+	if s.residencyOnReplay {
+		s.handleResidency()
+	}
+	return last, nil
 }
 
 func (s *Store[ID, T]) deleteByID(id ID) {
@@ -46,8 +116,5 @@ func (s *Store[ID, T]) deleteByID(id ID) {
 		return
 	}
 
-	rec.deleted = true
-	delete(s.index, id)
-
-	s.dirty = true
+	s.tombstone(id, rec)
 }
@@ -0,0 +1,374 @@
+package flea
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReplayProgressReported(t *testing.T) {
+	dir := t.TempDir()
+
+	var progress []int
+	opts := Options[uint64, User]{
+		Dir:    dir,
+		IDFunc: userID,
+		OnReplayProgress: func(processed int) {
+			progress = append(progress, processed)
+		},
+	}
+
+	s := openUserStoreWithOpts(t, opts)
+	if len(progress) != 0 {
+		t.Fatalf("progress reported without a WAL: %v", progress)
+	}
+
+	if _, err := s.PutAll(users[:5500]); err != nil {
+		t.Fatalf("put failed: %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("close failed: %v", err)
+	}
+
+	s = openUserStoreWithOpts(t, opts)
+	defer s.Close()
+
+	expected := []int{1000, 2000, 3000, 4000, 5000, 5500}
+	if len(progress) != len(expected) {
+		t.Fatalf("expected progress %v, got %v", expected, progress)
+	}
+	for i := range expected {
+		if progress[i] != expected[i] {
+			t.Fatalf("expected progress %v, got %v", expected, progress)
+		}
+	}
+}
+
+// crashCopy copies the files of a store as they are on disk into a new
+// directory, simulating a crash of the process owning src.
+func crashCopy(t *testing.T, src string) string {
+	t.Helper()
+
+	dst := t.TempDir()
+	err := filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return os.MkdirAll(filepath.Join(dst, rel), 0755)
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(filepath.Join(dst, rel), b, 0644)
+	})
+	if err != nil {
+		t.Fatalf("copy failed: %v", err)
+	}
+	return dst
+}
+
+func TestFlushSurvivesCrashBeforeSnapshot(t *testing.T) {
+	dir := t.TempDir()
+
+	s := openUserStore(t, dir)
+	defer s.Close()
+
+	s.Put(User{Id: 1, Name: "Alice"})
+	s.PutAll([]User{{Id: 2, Name: "Bob"}, {Id: 3, Name: "Carol"}})
+
+	if err := s.Flush(); err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+
+	crashed := crashCopy(t, dir)
+
+	s2 := openUserStore(t, crashed)
+	defer s2.Close()
+
+	if n := s2.Len(); n != 3 {
+		t.Fatalf("expected 3 users after crash, got %d", n)
+	}
+}
+
+func TestReplaySkipsOpsCoveredBySnapshot(t *testing.T) {
+	dir := t.TempDir()
+
+	s := openUserStore(t, dir)
+
+	s.Put(User{Id: 1, Name: "stale"})
+
+	stale, err := os.ReadFile(s.getWalPath())
+	if err != nil {
+		t.Fatalf("read wal failed: %v", err)
+	}
+
+	s.Put(User{Id: 1, Name: "fresh"})
+	if err := s.snapshot(); err != nil {
+		t.Fatalf("snapshot failed: %v", err)
+	}
+	s.Put(User{Id: 2, Name: "Bob"})
+
+	walPath := s.getWalPath()
+	if err := s.Close(); err != nil {
+		t.Fatalf("close failed: %v", err)
+	}
+
+	// a WAL that still holds ops already covered by the snapshot, as left
+	// by a crash between the snapshot rename and the WAL trim
+	current, err := os.ReadFile(walPath)
+	if err != nil {
+		t.Fatalf("read wal failed: %v", err)
+	}
+	if err := os.WriteFile(walPath, append(stale, current...), 0644); err != nil {
+		t.Fatalf("write wal failed: %v", err)
+	}
+
+	s = openUserStore(t, dir)
+	defer s.Close()
+
+	u, ok, err := s.GetByID(1)
+	if err != nil || !ok {
+		t.Fatalf("user 1 missing: %v", err)
+	}
+	if u.Name != "fresh" {
+		t.Fatalf("stale WAL op was replayed: %+v", u)
+	}
+	if _, ok, _ := s.GetByID(2); !ok {
+		t.Fatalf("WAL op newer than the snapshot was not replayed")
+	}
+
+	// new writes keep counting from the last sequence number
+	s.Put(User{Id: 3, Name: "Carol"})
+	if s.wal.seq != 4 {
+		t.Fatalf("expected seq 4, got %d", s.wal.seq)
+	}
+}
+
+func TestReplayKeepsWALUntilSnapshot(t *testing.T) {
+	dir := t.TempDir()
+
+	s := openUserStore(t, dir)
+	s.PutAll([]User{{Id: 1, Name: "Alice"}, {Id: 2, Name: "Bob"}})
+	if err := s.Close(); err != nil {
+		t.Fatalf("close failed: %v", err)
+	}
+
+	// replays the WAL, then crashes before any snapshot
+	s = openUserStore(t, dir)
+	defer s.Close()
+	crashed := crashCopy(t, dir)
+
+	s2 := openUserStore(t, crashed)
+	defer s2.Close()
+
+	if n := s2.Len(); n != 2 {
+		t.Fatalf("expected 2 users after crash, got %d", n)
+	}
+}
+
+func TestReopenWithRecordOver64KB(t *testing.T) {
+	dir := t.TempDir()
+	big := strings.Repeat("x", 100*1024)
+
+	s := openUserStore(t, dir)
+	s.Put(User{Id: 1, Name: big})
+	s.Close()
+
+	// replayed from the WAL
+	s = openUserStore(t, dir)
+	if u, ok, err := s.GetByID(1); err != nil || !ok || u.Name != big {
+		t.Fatalf("large record lost on WAL replay: ok=%v err=%v", ok, err)
+	}
+	s.Put(User{Id: 2, Name: big})
+	if err := s.snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	// loaded from the snapshot
+	s = openUserStore(t, dir)
+	defer s.Close()
+	if s.Len() != 2 {
+		t.Fatalf("expected 2 records after snapshot load, got %d", s.Len())
+	}
+	if u, _, _ := s.GetByID(2); u.Name != big {
+		t.Fatalf("large record lost on snapshot load")
+	}
+}
+
+func TestOpenRejectsRecordsOfAnotherType(t *testing.T) {
+	dir := t.TempDir()
+
+	// both types are named item, so they share the model directory
+	write := func(snapshot bool) {
+		type item struct {
+			Id   uint64
+			Name string
+		}
+		s, err := Open[uint64, item](Options[uint64, item]{
+			Dir:    dir,
+			IDFunc: func(i item) (uint64, error) { return i.Id, nil },
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		s.Put(item{Id: 1, Name: "one"})
+		if snapshot {
+			if err := s.snapshot(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	open := func() error {
+		type item struct {
+			Id   uint64
+			Name int
+		}
+		s, err := Open[uint64, item](Options[uint64, item]{
+			Dir:    dir,
+			IDFunc: func(i item) (uint64, error) { return i.Id, nil },
+		})
+		if err == nil {
+			s.Close()
+		}
+		return err
+	}
+	openExtended := func() error {
+		type item struct {
+			Id    uint64
+			Name  string
+			Added bool
+		}
+		s, err := Open[uint64, item](Options[uint64, item]{
+			Dir:    dir,
+			IDFunc: func(i item) (uint64, error) { return i.Id, nil },
+		})
+		if err == nil {
+			s.Close()
+		}
+		return err
+	}
+
+	// checked against the WAL
+	write(false)
+	if err := open(); !errors.Is(err, ErrTypeMismatch) {
+		t.Fatalf("expected ErrTypeMismatch from the WAL, got %v", err)
+	}
+
+	// checked against the snapshot
+	write(true)
+	if err := open(); !errors.Is(err, ErrTypeMismatch) {
+		t.Fatalf("expected ErrTypeMismatch from the snapshot, got %v", err)
+	}
+
+	// added fields are compatible
+	if err := openExtended(); err != nil {
+		t.Fatalf("expected a field addition to open, got %v", err)
+	}
+}
+
+func TestWriteBufferLosesOnlyUnflushedWritesOnCrash(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open[uint64, User](Options[uint64, User]{
+		Dir:                dir,
+		IDFunc:             userID,
+		WriteBufferRecords: 3,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// the third put fills the buffer, which is written out
+	s.Put(User{Id: 1})
+	s.Put(User{Id: 2})
+	s.Put(User{Id: 3})
+	// buffered
+	s.Put(User{Id: 4})
+	if s.Len() != 4 {
+		t.Fatalf("expected buffered writes to be visible, got %d", s.Len())
+	}
+
+	crashed := crashCopy(t, dir)
+	s2 := openUserStore(t, crashed)
+	if n := s2.Len(); n != 3 {
+		t.Fatalf("expected the 3 flushed users after a crash, got %d", n)
+	}
+	if _, ok, _ := s2.GetByID(4); ok {
+		t.Fatal("expected the buffered user to be lost")
+	}
+	s2.Close()
+
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	crashed = crashCopy(t, dir)
+	s2 = openUserStore(t, crashed)
+	defer s2.Close()
+	if n := s2.Len(); n != 4 {
+		t.Fatalf("expected 4 users once flushed, got %d", n)
+	}
+}
+
+type customer struct {
+	Id   uint64
+	Name string
+}
+
+type client struct {
+	Id   uint64
+	Name string
+}
+
+func TestMigrateMovesStoreToRenamedType(t *testing.T) {
+	dir := t.TempDir()
+
+	old, err := Open[uint64, customer](Options[uint64, customer]{
+		Dir:    dir,
+		IDFunc: func(c customer) (uint64, error) { return c.Id, nil },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	old.Put(customer{Id: 1, Name: "one"})
+	if err := old.snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	old.Put(customer{Id: 2, Name: "two"})
+
+	opts := Options[uint64, client]{
+		Dir:    dir,
+		IDFunc: func(c client) (uint64, error) { return c.Id, nil },
+	}
+	if err := Migrate(opts, "flea.customer"); !errors.Is(err, ErrLocked) {
+		t.Fatalf("expected ErrLocked while the old store is open, got %v", err)
+	}
+	old.Close()
+
+	if err := Migrate(opts, "flea.customer"); err != nil {
+		t.Fatalf("migrate failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "flea_customer")); !os.IsNotExist(err) {
+		t.Fatalf("expected the old directory to be gone, got %v", err)
+	}
+
+	s, err := Open[uint64, client](opts)
+	if err != nil {
+		t.Fatalf("failed to open the migrated store: %v", err)
+	}
+	defer s.Close()
+	got := s.Get(nil)
+	if len(got) != 2 || got[0] != (client{Id: 1, Name: "one"}) || got[1] != (client{Id: 2, Name: "two"}) {
+		t.Fatalf("expected both records under the new name, got %v", got)
+	}
+}
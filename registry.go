@@ -0,0 +1,188 @@
+package flea
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"sync"
+)
+
+// registry holds the stores opened on the local disk by this process, by
+// the absolute path of their model directory, so that opening a store twice
+// shares one storeState instead of two sets of handles racing on the same
+// files.
+var registry = struct {
+	mu     sync.Mutex
+	stores map[string]*registered
+}{stores: make(map[string]*registered)}
+
+// registered is a store of the registry.
+type registered struct {
+	// closed once the first Open is done, with store or err set
+	opened chan struct{}
+	store  any
+	err    error
+	// Opens not matched by a Close yet
+	refs int
+	// set once the last reference is released, and closed once the files
+	// of the store are
+	closed chan struct{}
+}
+
+// openShared is Open for stores kept in the registry: the first Open of a
+// path opens the store, and later ones return a new handle on it until
+// every handle is closed. A later Open fails with ErrLocked when its
+// options differ from those of the first one.
+func openShared[ID comparable, T any](s *Store[ID, T]) (*Store[ID, T], error) {
+	key, err := filepath.Abs(s.Path())
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		registry.mu.Lock()
+		r, ok := registry.stores[key]
+		if !ok {
+			break
+		}
+		if r.closed != nil {
+			// the last reference is closing it
+			registry.mu.Unlock()
+			<-r.closed
+			continue
+		}
+		r.refs++
+		registry.mu.Unlock()
+
+		<-r.opened
+		if r.err != nil {
+			return nil, r.err
+		}
+		shared, ok := r.store.(*storeState[ID, T])
+		if !ok {
+			registry.mu.Lock()
+			r.refs--
+			registry.mu.Unlock()
+			return nil, fmt.Errorf("%w: %s is open as %T", ErrLocked, key, r.store)
+		}
+		// Dir may name the same directory another way
+		a, b := shared.opts, s.opts
+		a.Dir, b.Dir = "", ""
+		if !sameOptions(reflect.ValueOf(a), reflect.ValueOf(b)) {
+			registry.mu.Lock()
+			r.refs--
+			registry.mu.Unlock()
+			return nil, fmt.Errorf("%w: %s is open with other options", ErrLocked, key)
+		}
+		return &Store[ID, T]{storeState: shared}, nil
+	}
+
+	r := &registered{opened: make(chan struct{}), refs: 1}
+	registry.stores[key] = r
+	registry.mu.Unlock()
+
+	err = s.openStorage()
+
+	registry.mu.Lock()
+	if err != nil {
+		r.err = err
+		delete(registry.stores, key)
+	} else {
+		r.store = s.storeState
+		s.registryKey = key
+	}
+	registry.mu.Unlock()
+	close(r.opened)
+
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// release drops a reference to the registered store s, and reports
+// whether it was the last one, in which case the caller closes s and then
+// calls unregister. Once s is unregistered, release always reports true.
+func release(key string, s any) bool {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+
+	r, ok := registry.stores[key]
+	if !ok || r.store != s {
+		return true
+	}
+	if r.closed != nil {
+		// already being closed
+		return false
+	}
+	r.refs--
+	if r.refs > 0 {
+		return false
+	}
+	r.closed = make(chan struct{})
+	return true
+}
+
+// unregister removes the closed store s from the registry.
+func unregister(key string, s any) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+
+	if r, ok := registry.stores[key]; ok && r.store == s && r.closed != nil {
+		delete(registry.stores, key)
+		close(r.closed)
+	}
+}
+
+// sameOptions reports whether the options a and b open a store the same
+// way. Functions are compared by their code and pointers to structs, like
+// the Scheduler or the Logger, by identity; everything else by value.
+func sameOptions(a, b reflect.Value) bool {
+	if a.Kind() != b.Kind() {
+		return false
+	}
+	switch a.Kind() {
+	case reflect.Func:
+		return a.Pointer() == b.Pointer()
+	case reflect.Pointer:
+		if a.IsNil() || b.IsNil() || a.Elem().Kind() == reflect.Struct {
+			return a.Pointer() == b.Pointer()
+		}
+		return sameOptions(a.Elem(), b.Elem())
+	case reflect.Interface:
+		if a.IsNil() || b.IsNil() {
+			return a.IsNil() == b.IsNil()
+		}
+		return a.Elem().Type() == b.Elem().Type() && sameOptions(a.Elem(), b.Elem())
+	case reflect.Slice:
+		if a.Len() != b.Len() {
+			return false
+		}
+		for i := range a.Len() {
+			if !sameOptions(a.Index(i), b.Index(i)) {
+				return false
+			}
+		}
+		return true
+	case reflect.Map:
+		if a.Len() != b.Len() {
+			return false
+		}
+		for _, k := range a.MapKeys() {
+			v := b.MapIndex(k)
+			if !v.IsValid() || !sameOptions(a.MapIndex(k), v) {
+				return false
+			}
+		}
+		return true
+	case reflect.Struct:
+		for i := range a.NumField() {
+			if !sameOptions(a.Field(i), b.Field(i)) {
+				return false
+			}
+		}
+		return true
+	default:
+		return a.Equal(b)
+	}
+}
@@ -1,7 +1,14 @@
 package flea
 
 import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
 	"testing"
+	"time"
 )
 
 type testUser struct {
@@ -34,7 +41,7 @@ func TestMaxInMemoryNilUnlimited(t *testing.T) {
 
 	count := 0
 	for _, rec := range store.records {
-		if rec.value != nil && !rec.deleted {
+		if !rec.offloaded && !rec.deleted {
 			count++
 		}
 	}
@@ -72,7 +79,7 @@ func TestMaxInMemoryCap(t *testing.T) {
 
 	count := 0
 	for _, rec := range store.records {
-		if rec.value != nil && !rec.deleted {
+		if !rec.offloaded && !rec.deleted {
 			count++
 		}
 	}
@@ -110,7 +117,7 @@ func TestMaxInMemoryMinusOneAlwaysRunsResidency(t *testing.T) {
 
 	count := 0
 	for _, rec := range store.records {
-		if rec.value != nil && !rec.deleted {
+		if !rec.offloaded && !rec.deleted {
 			count++
 		}
 	}
@@ -148,7 +155,7 @@ func TestMaxInMemoryRecordsNilUnlimited(t *testing.T) {
 
 	count := 0
 	for _, rec := range store.records {
-		if rec.value != nil && !rec.deleted {
+		if !rec.offloaded && !rec.deleted {
 			count++
 		}
 	}
@@ -189,7 +196,7 @@ func TestMaxInMemoryRecordsMinusOneAlwaysRunsResidency(t *testing.T) {
 
 	count := 0
 	for _, rec := range store.records {
-		if rec.value != nil && !rec.deleted {
+		if !rec.offloaded && !rec.deleted {
 			count++
 		}
 	}
@@ -229,7 +236,7 @@ func TestMaxInMemoryRecordsCap(t *testing.T) {
 
 	count := 0
 	for _, rec := range store.records {
-		if rec.value != nil && !rec.deleted {
+		if !rec.offloaded && !rec.deleted {
 			count++
 		}
 	}
@@ -238,3 +245,1281 @@ func TestMaxInMemoryRecordsCap(t *testing.T) {
 		t.Fatalf("expected exactly 10 in-memory records, got %d", count)
 	}
 }
+
+func TestResidencyEvictsOldestFirst(t *testing.T) {
+	dir := t.TempDir()
+	max := 10
+
+	store, err := Open[uint64, testUser](Options[uint64, testUser]{
+		Dir: dir,
+		IDFunc: func(u testUser) (uint64, error) {
+			return u.Id, nil
+		},
+		ResidencyFunc: func(u testUser) bool {
+			return false
+		},
+		MaxInMemoryRecords: &max,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	for i := 1; i <= 50; i++ {
+		if _, err := store.Put(testUser{Id: uint64(i), Val: i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := uint64(1); i <= 50; i++ {
+		rec := store.index[i]
+		if i <= 40 && !rec.offloaded {
+			t.Fatalf("expected id %d to be offline", i)
+		}
+		if i > 40 && rec.offloaded {
+			t.Fatalf("expected id %d to be online", i)
+		}
+	}
+}
+
+func TestLenTracksPutDeleteAndOffload(t *testing.T) {
+	dir := t.TempDir()
+	max := 5
+
+	store, err := Open[uint64, testUser](Options[uint64, testUser]{
+		Dir: dir,
+		IDFunc: func(u testUser) (uint64, error) {
+			return u.Id, nil
+		},
+		ResidencyFunc: func(u testUser) bool {
+			return false
+		},
+		MaxInMemoryRecords: &max,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	for i := 1; i <= 20; i++ {
+		store.Put(testUser{Id: uint64(i), Val: i})
+	}
+	if store.Len() != 20 {
+		t.Fatalf("expected len 20, got %d", store.Len())
+	}
+
+	// update an offline record, bringing it back online
+	store.Put(testUser{Id: 1, Val: 100})
+	if store.Len() != 20 {
+		t.Fatalf("expected len 20 after update, got %d", store.Len())
+	}
+
+	if _, err := store.Delete(func(u testUser) bool { return u.Id%2 == 0 }); err != nil {
+		t.Fatal(err)
+	}
+	if store.Len() != 10 {
+		t.Fatalf("expected len 10 after delete, got %d", store.Len())
+	}
+
+	if store.Len() != len(store.Get(all[testUser])) {
+		t.Fatalf("len disagrees with Get")
+	}
+	if store.onlineCount > max {
+		t.Fatalf("expected at most %d online records, got %d", max, store.onlineCount)
+	}
+}
+
+func TestInspectReportsResidency(t *testing.T) {
+	dir := t.TempDir()
+	max := 1
+
+	store, err := Open[uint64, testUser](Options[uint64, testUser]{
+		Dir: dir,
+		IDFunc: func(u testUser) (uint64, error) {
+			return u.Id, nil
+		},
+		ResidencyFunc: func(u testUser) bool {
+			return false
+		},
+		MaxInMemoryRecords: &max,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	store.Put(testUser{Id: 1, Val: 1})
+
+	info, ok := store.Inspect(1)
+	if !ok || !info.Online || info.Deleted {
+		t.Fatalf("expected id 1 online, got %+v", info)
+	}
+
+	store.Put(testUser{Id: 2, Val: 2})
+	store.Put(testUser{Id: 3, Val: 3})
+
+	info, ok = store.Inspect(2)
+	if !ok || info.Online || info.Deleted {
+		t.Fatalf("expected id 2 offline, got %+v", info)
+	}
+	if info.Offset == 0 || info.Size == 0 {
+		t.Fatalf("expected id 2 after id 1 in the data file, got %+v", info)
+	}
+
+	store.Delete(func(u testUser) bool { return u.Id == 2 })
+
+	info, ok = store.Inspect(2)
+	if !ok || !info.Deleted {
+		t.Fatalf("expected id 2 tombstoned, got %+v", info)
+	}
+
+	if _, ok := store.Inspect(99); ok {
+		t.Fatalf("expected unknown id to be reported missing")
+	}
+}
+
+func TestOffloadAndReloadKeepsZeroValues(t *testing.T) {
+	dir := t.TempDir()
+	max := 1
+
+	store, err := Open[uint64, testUser](Options[uint64, testUser]{
+		Dir: dir,
+		IDFunc: func(u testUser) (uint64, error) {
+			return u.Id, nil
+		},
+		ResidencyFunc: func(u testUser) bool {
+			return false
+		},
+		MaxInMemoryRecords: &max,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	// id 0 holds the zero value of testUser
+	for i := 0; i < 4; i++ {
+		if _, err := store.Put(testUser{Id: uint64(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := uint64(0); i < 4; i++ {
+		rec := store.index[i]
+		if offline := i < 3; rec.offloaded != offline || (rec.value == nil) != offline {
+			t.Fatalf("id %d: offloaded %v with value %v", i, rec.offloaded, rec.value)
+		}
+	}
+	if got, ok, err := store.GetByID(0); err != nil || !ok || got != (testUser{}) {
+		t.Fatalf("expected the zero value from disk, got %+v %v %v", got, ok, err)
+	}
+
+	store.mu.Lock()
+	store.maxInMemory = 4
+	store.mu.Unlock()
+	if err := store.WarmAll(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := uint64(0); i < 4; i++ {
+		rec := store.index[i]
+		if rec.offloaded || rec.value == nil || *rec.value != (testUser{Id: i}) {
+			t.Fatalf("id %d: expected it back online, got offloaded %v with value %v", i, rec.offloaded, rec.value)
+		}
+		if info, _ := store.Inspect(i); !info.Online {
+			t.Fatalf("id %d: expected Inspect to report it online, got %+v", i, info)
+		}
+	}
+	if stats := store.Stats(); stats.Online != 4 || stats.Offline != 0 {
+		t.Fatalf("expected 4 online records, got %+v", stats)
+	}
+}
+
+func TestKeepRecentWritesOnlineAvoidsOffloadChurn(t *testing.T) {
+	hammer := func(keepRecent bool) (*Store[uint64, testUser], int64) {
+		minusOne := -1
+		store, err := Open[uint64, testUser](Options[uint64, testUser]{
+			Dir: t.TempDir(),
+			IDFunc: func(u testUser) (uint64, error) {
+				return u.Id, nil
+			},
+			ResidencyFunc: func(u testUser) bool {
+				return false
+			},
+			MaxInMemoryRecords:     &minusOne,
+			KeepRecentWritesOnline: keepRecent,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < 1000; i++ {
+			store.Put(testUser{Id: uint64(i % 5), Val: i})
+		}
+
+		info, err := os.Stat(store.getDataPath())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return store, info.Size()
+	}
+
+	plain, churned := hammer(false)
+	defer plain.Close()
+	if churned == 0 {
+		t.Fatalf("expected updates to be offloaded without the option")
+	}
+
+	store, size := hammer(true)
+	defer store.Close()
+	if size != 0 {
+		t.Fatalf("expected no offline writes for hot records, got %d bytes", size)
+	}
+	if store.onlineCount != 5 {
+		t.Fatalf("expected 5 online records, got %d", store.onlineCount)
+	}
+
+	// a snapshot ends the interval, the next write offloads cold records
+	if err := store.snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	store.Put(testUser{Id: 1, Val: -1})
+	if store.onlineCount != 1 {
+		t.Fatalf("expected only the last written record online, got %d", store.onlineCount)
+	}
+}
+
+func TestThrashingRecordIsLogged(t *testing.T) {
+	var logs strings.Builder
+	store, err := Open[uint64, testUser](Options[uint64, testUser]{
+		Dir: t.TempDir(),
+		IDFunc: func(u testUser) (uint64, error) {
+			return u.Id, nil
+		},
+		ResidencyFunc: func(u testUser) bool {
+			return false
+		},
+		ThrashThreshold: 5,
+		Logger:          slog.New(slog.NewTextHandler(&logs, nil)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	// every update brings record 7 back online, and residency sends it
+	// straight back to disk
+	for i := 0; i < 4; i++ {
+		store.Put(testUser{Id: 7, Val: i})
+	}
+	if logs.Len() != 0 {
+		t.Fatalf("expected no warning below the threshold, got %q", logs.String())
+	}
+
+	for i := 4; i < 20; i++ {
+		store.Put(testUser{Id: 7, Val: i})
+	}
+	if n := strings.Count(logs.String(), "level=WARN"); n != 1 {
+		t.Fatalf("expected a single warning, got %d: %q", n, logs.String())
+	}
+	if !strings.Contains(logs.String(), "id=7") {
+		t.Fatalf("expected the warning to name the record, got %q", logs.String())
+	}
+
+	// a snapshot starts a new interval
+	if err := store.snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		store.Put(testUser{Id: 7, Val: i})
+	}
+	if n := strings.Count(logs.String(), "level=WARN"); n != 2 {
+		t.Fatalf("expected a new warning after the snapshot, got %d", n)
+	}
+}
+
+func openResidencyModeStore(t *testing.T, mode ResidencyMode, max *int) (*Store[uint64, testUser], error) {
+	t.Helper()
+
+	return Open[uint64, testUser](Options[uint64, testUser]{
+		Dir: t.TempDir(),
+		IDFunc: func(u testUser) (uint64, error) {
+			return u.Id, nil
+		},
+		ResidencyFunc: func(u testUser) bool {
+			return false
+		},
+		MaxInMemoryRecords: max,
+		ResidencyMode:      mode,
+	})
+}
+
+func TestResidencyModes(t *testing.T) {
+	ten := 10
+
+	cases := []struct {
+		name   string
+		mode   ResidencyMode
+		max    *int
+		online int
+	}{
+		{"always", ResidencyAlways, nil, 0},
+		{"capped", ResidencyCapped, &ten, 10},
+		{"disabled", ResidencyDisabled, nil, 50},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			store, err := openResidencyModeStore(t, c.mode, c.max)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer store.Close()
+
+			values := make([]testUser, 50)
+			for i := range values {
+				values[i] = testUser{Id: uint64(i + 1), Val: i}
+			}
+			if _, err := store.PutAll(values); err != nil {
+				t.Fatal(err)
+			}
+
+			if store.onlineCount != c.online {
+				t.Fatalf("expected %d online records, got %d", c.online, store.onlineCount)
+			}
+			if store.Len() != 50 {
+				t.Fatalf("expected 50 records, got %d", store.Len())
+			}
+		})
+	}
+}
+
+func TestResidencyModeRejectsAmbiguousOptions(t *testing.T) {
+	ten := 10
+	minusOne := -1
+
+	if _, err := openResidencyModeStore(t, ResidencyAlways, &ten); err == nil {
+		t.Fatalf("expected ResidencyAlways with a cap to be rejected")
+	}
+	if _, err := openResidencyModeStore(t, ResidencyCapped, nil); err == nil {
+		t.Fatalf("expected ResidencyCapped without a cap to be rejected")
+	}
+	if _, err := openResidencyModeStore(t, ResidencyCapped, &minusOne); err == nil {
+		t.Fatalf("expected ResidencyCapped with a negative cap to be rejected")
+	}
+}
+
+func TestForEachDoesNotBlockWriters(t *testing.T) {
+	max := 10
+	store, err := Open[uint64, testUser](Options[uint64, testUser]{
+		Dir:                t.TempDir(),
+		IDFunc:             func(u testUser) (uint64, error) { return u.Id, nil },
+		MaxInMemoryRecords: &max,
+		ResidencyFunc:      func(testUser) bool { return false },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	values := make([]testUser, 50)
+	for i := range values {
+		values[i] = testUser{Id: uint64(i + 1), Val: i}
+	}
+	if _, err := store.PutAll(values); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 100; i < 200; i++ {
+			store.Put(testUser{Id: uint64(i), Val: i})
+		}
+	}()
+
+	var seen []uint64
+	err = store.ForEach(func(u testUser) error {
+		seen = append(seen, u.Id)
+		// writing from fn must not deadlock, and is not visible to ForEach
+		_, err := store.Put(testUser{Id: 1000 + u.Id})
+		return err
+	})
+	<-done
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(seen) < 50 {
+		t.Fatalf("expected at least the 50 initial records, got %d", len(seen))
+	}
+	for i := 0; i < 50; i++ {
+		if seen[i] != uint64(i+1) {
+			t.Fatalf("expected id %d at %d, got %d", i+1, i, seen[i])
+		}
+	}
+	for _, id := range seen {
+		if id >= 1000 {
+			t.Fatalf("ForEach saw record %d written during the iteration", id)
+		}
+	}
+}
+
+func TestDeletedOfflineRecordIsNotReturned(t *testing.T) {
+	dir := t.TempDir()
+	max := 0
+	opts := Options[uint64, testUser]{
+		Dir:                dir,
+		IDFunc:             func(u testUser) (uint64, error) { return u.Id, nil },
+		MaxInMemoryRecords: &max,
+		ResidencyFunc:      func(testUser) bool { return false },
+	}
+
+	store, err := Open[uint64, testUser](opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store.PutAll([]testUser{{Id: 1, Val: 1}, {Id: 2, Val: 2}, {Id: 3, Val: 3}})
+	if info, _ := store.Inspect(2); info.Online {
+		t.Fatalf("expected record 2 to be offline")
+	}
+
+	if _, err := store.Delete(func(u testUser) bool { return u.Id == 2 }); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(s *Store[uint64, testUser]) {
+		t.Helper()
+		for _, u := range s.Get(all[testUser]) {
+			if u.Id == 2 {
+				t.Fatalf("Get returned deleted offline record")
+			}
+		}
+		if _, ok, _ := s.GetByID(2); ok {
+			t.Fatalf("GetByID returned deleted offline record")
+		}
+		s.ScanFrom(0, all[testUser], func(u testUser, _ int64) error {
+			if u.Id == 2 {
+				t.Fatalf("ScanFrom returned deleted offline record")
+			}
+			return nil
+		})
+	}
+
+	check(store)
+
+	if err := store.snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	store, err = Open[uint64, testUser](opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	check(store)
+	if store.Len() != 2 {
+		t.Fatalf("expected 2 records, got %d", store.Len())
+	}
+}
+
+func TestReindexRecoversDriftedIndex(t *testing.T) {
+	max := 2
+	store, err := Open[uint64, testUser](Options[uint64, testUser]{
+		Dir:                t.TempDir(),
+		IDFunc:             func(u testUser) (uint64, error) { return u.Id, nil },
+		MaxInMemoryRecords: &max,
+		ResidencyFunc:      func(testUser) bool { return false },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	store.PutAll([]testUser{{Id: 1, Val: 1}, {Id: 2, Val: 2}, {Id: 3, Val: 3}, {Id: 4, Val: 4}})
+
+	// corrupt the index and the counters
+	store.mu.Lock()
+	delete(store.index, 1)
+	delete(store.index, 4)
+	store.index[99] = store.records[1]
+	store.onlineCount = 0
+	store.offlineCount = 7
+	store.mu.Unlock()
+
+	if err := store.Reindex(); err != nil {
+		t.Fatal(err)
+	}
+
+	for id := uint64(1); id <= 4; id++ {
+		u, ok, err := store.GetByID(id)
+		if err != nil || !ok || u.Val != int(id) {
+			t.Fatalf("record %d not recovered: %+v %v %v", id, u, ok, err)
+		}
+	}
+	if _, ok, _ := store.GetByID(99); ok {
+		t.Fatalf("bogus id survived Reindex")
+	}
+	if store.onlineCount != 2 || store.offlineCount != 2 {
+		t.Fatalf("expected 2 online and 2 offline, got %d and %d", store.onlineCount, store.offlineCount)
+	}
+}
+
+func TestInsertionOrderSurvivesReopenAcrossTiers(t *testing.T) {
+	dir := t.TempDir()
+	max := 5
+	opts := Options[uint64, testUser]{
+		Dir:                dir,
+		IDFunc:             func(u testUser) (uint64, error) { return u.Id, nil },
+		MaxInMemoryRecords: &max,
+		ResidencyFunc:      func(u testUser) bool { return u.Id%3 == 0 },
+	}
+
+	store, err := Open[uint64, testUser](opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 20; i++ {
+		store.Put(testUser{Id: uint64(i), Val: i})
+	}
+	if err := store.snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	// only in the WAL: new records and an update of an offline one
+	for i := 21; i <= 30; i++ {
+		store.Put(testUser{Id: uint64(i), Val: i})
+	}
+	store.Put(testUser{Id: 1, Val: 100})
+	store.Close()
+
+	store, err = Open[uint64, testUser](opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	results := store.Get(all[testUser])
+	if len(results) != 30 {
+		t.Fatalf("expected 30 results, got %d", len(results))
+	}
+	for i, u := range results {
+		if u.Id != uint64(i+1) {
+			t.Fatalf("order broken at position %d: expected %d, got %d", i, i+1, u.Id)
+		}
+	}
+	if results[0].Val != 100 {
+		t.Fatalf("update of record 1 lost, got %d", results[0].Val)
+	}
+}
+
+func TestRangeByIndexMatchesBruteForce(t *testing.T) {
+	max := 20
+	store, err := Open[uint64, testUser](Options[uint64, testUser]{
+		Dir:                t.TempDir(),
+		IDFunc:             func(u testUser) (uint64, error) { return u.Id, nil },
+		MaxInMemoryRecords: &max,
+		ResidencyFunc:      func(testUser) bool { return false },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	values := make([]testUser, 100)
+	for i := range values {
+		values[i] = testUser{Id: uint64(i + 1), Val: (i * 37) % 100}
+	}
+	store.PutAll(values)
+
+	byVal := func(u testUser) int64 { return int64(u.Val) }
+	if err := store.AddSortedIndex("val", byVal); err != nil {
+		t.Fatal(err)
+	}
+
+	// changes made after the index was added
+	store.Put(testUser{Id: 1, Val: 55})
+	store.Put(testUser{Id: 101, Val: 40})
+	store.Delete(func(u testUser) bool { return u.Id == 2 || u.Id == 3 })
+
+	check := func(lo, hi int64) {
+		t.Helper()
+		got, err := store.RangeByIndex("val", lo, hi)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := 0
+		for _, u := range store.GetAll() {
+			if k := byVal(u); k >= lo && k <= hi {
+				want++
+			}
+		}
+		if len(got) != want {
+			t.Fatalf("[%d, %d]: expected %d values, got %d", lo, hi, want, len(got))
+		}
+		for i, u := range got {
+			if k := byVal(u); k < lo || k > hi {
+				t.Fatalf("[%d, %d]: value %+v out of range", lo, hi, u)
+			}
+			if i > 0 && byVal(got[i-1]) > byVal(u) {
+				t.Fatalf("[%d, %d]: results not sorted", lo, hi)
+			}
+		}
+	}
+
+	check(40, 60)
+	check(0, 99)
+	check(55, 55)
+	check(200, 300)
+
+	if _, err := store.RangeByIndex("missing", 0, 1); !errors.Is(err, ErrNoIndex) {
+		t.Fatalf("expected ErrNoIndex, got %v", err)
+	}
+}
+
+func TestFieldIndexOnComputedField(t *testing.T) {
+	type person struct {
+		Id    uint64
+		First string
+		Last  string
+	}
+	max := 2
+	store, err := Open[uint64, person](Options[uint64, person]{
+		Dir:                t.TempDir(),
+		IDFunc:             func(p person) (uint64, error) { return p.Id, nil },
+		MaxInMemoryRecords: &max,
+		ResidencyFunc:      func(person) bool { return false },
+		ComputedFields: map[string]func(person) any{
+			"fullName": func(p person) any { return p.First + " " + p.Last },
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	store.PutAll([]person{
+		{Id: 1, First: "Ada", Last: "Lovelace"},
+		{Id: 2, First: "Alan", Last: "Turing"},
+		{Id: 3, First: "Grace", Last: "Hopper"},
+		{Id: 4, First: "Ada", Last: "Lovelace"},
+	})
+	if err := store.AddFieldIndex("fullName"); err != nil {
+		t.Fatal(err)
+	}
+
+	// changes made after the index was added
+	store.Put(person{Id: 2, First: "Ada", Last: "Lovelace"})
+	store.Put(person{Id: 5, First: "Grace", Last: "Hopper"})
+	store.Delete(func(p person) bool { return p.Id == 1 })
+
+	ids := func(name string) []uint64 {
+		t.Helper()
+		got, err := store.GetByField("fullName", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []uint64
+		for _, p := range got {
+			ids = append(ids, p.Id)
+		}
+		return ids
+	}
+	if got := ids("Ada Lovelace"); !slices.Equal(got, []uint64{4, 2}) {
+		t.Fatalf("expected Ada Lovelace at [4 2], got %v", got)
+	}
+	if got := ids("Grace Hopper"); !slices.Equal(got, []uint64{3, 5}) {
+		t.Fatalf("expected Grace Hopper at [3 5], got %v", got)
+	}
+	if got := ids("Alan Turing"); len(got) != 0 {
+		t.Fatalf("expected no Alan Turing left, got %v", got)
+	}
+
+	if err := store.AddFieldIndex("missing"); !errors.Is(err, ErrNoField) {
+		t.Fatalf("expected ErrNoField, got %v", err)
+	}
+	if _, err := store.GetByField("missing", "x"); !errors.Is(err, ErrNoIndex) {
+		t.Fatalf("expected ErrNoIndex, got %v", err)
+	}
+}
+
+func TestBulkLoadOffloadsStraightToDisk(t *testing.T) {
+	dir := t.TempDir()
+	max := 100
+	opts := Options[uint64, testUser]{
+		Dir:                dir,
+		IDFunc:             func(u testUser) (uint64, error) { return u.Id, nil },
+		MaxInMemoryRecords: &max,
+		ResidencyFunc:      func(testUser) bool { return false },
+	}
+
+	store, err := Open[uint64, testUser](opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var input strings.Builder
+	for i := 1; i <= 1000; i++ {
+		fmt.Fprintf(&input, "{\"Id\":%d,\"Val\":%d}\n", i, i*2)
+	}
+
+	n, err := store.BulkLoad(strings.NewReader(input.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1000 {
+		t.Fatalf("expected 1000 values loaded, got %d", n)
+	}
+	if store.onlineCount > max {
+		t.Fatalf("expected at most %d records in memory, got %d", max, store.onlineCount)
+	}
+	if store.Len() != 1000 {
+		t.Fatalf("expected 1000 records, got %d", store.Len())
+	}
+	if u, ok, err := store.GetByID(777); err != nil || !ok || u.Val != 1554 {
+		t.Fatalf("unexpected record 777: %+v %v %v", u, ok, err)
+	}
+	store.Close()
+
+	store, err = Open[uint64, testUser](opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	users := store.GetAll()
+	if len(users) != 1000 {
+		t.Fatalf("expected 1000 records after reopen, got %d", len(users))
+	}
+	for i, u := range users {
+		if u.Id != uint64(i+1) || u.Val != (i+1)*2 {
+			t.Fatalf("unexpected record at %d: %+v", i, u)
+		}
+	}
+}
+
+func TestBulkLoadNormalizesTimes(t *testing.T) {
+	store, err := Open[uint64, timedRecord](Options[uint64, timedRecord]{
+		Dir:    t.TempDir(),
+		IDFunc: func(r timedRecord) (uint64, error) { return r.Id, nil },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	input := `{"Id":1,"At":"2024-01-01T10:00:00+01:00"}` + "\n"
+	if _, err := store.BulkLoad(strings.NewReader(input)); err != nil {
+		t.Fatal(err)
+	}
+	r, ok, err := store.GetByID(1)
+	if err != nil || !ok {
+		t.Fatalf("expected record 1, got %v", err)
+	}
+	if r.At.Location() != time.UTC {
+		t.Fatalf("expected the loaded time in UTC like a Put one, got %v", r.At)
+	}
+}
+
+func TestResidencyStatsSplit(t *testing.T) {
+	store, err := Open[uint64, testUser](Options[uint64, testUser]{
+		Dir:           t.TempDir(),
+		IDFunc:        func(u testUser) (uint64, error) { return u.Id, nil },
+		ResidencyFunc: func(u testUser) bool { return u.Id%4 == 0 },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	values := make([]testUser, 100)
+	for i := range values {
+		values[i] = testUser{Id: uint64(i + 1)}
+	}
+	store.PutAll(values)
+
+	if online, offline := store.ResidencyStats(); online != 25 || offline != 75 {
+		t.Fatalf("expected 25 online and 75 offline, got %d and %d", online, offline)
+	}
+
+	// reads don't promote, and an updated cold record goes back to disk
+	store.GetByID(1)
+	store.Put(testUser{Id: 2, Val: 1})
+	store.Delete(func(u testUser) bool { return u.Id == 3 || u.Id == 4 })
+
+	if online, offline := store.ResidencyStats(); online != 24 || offline != 74 {
+		t.Fatalf("expected 24 online and 74 offline, got %d and %d", online, offline)
+	}
+}
+
+func TestPartialLineInDataFileIsIgnored(t *testing.T) {
+	store, err := Open[uint64, testUser](Options[uint64, testUser]{
+		Dir:           t.TempDir(),
+		IDFunc:        func(u testUser) (uint64, error) { return u.Id, nil },
+		ResidencyFunc: func(testUser) bool { return false },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	store.PutAll([]testUser{{Id: 1, Val: 1}, {Id: 2, Val: 2}})
+
+	// a write cut short by a crash or a full disk
+	cut := func() {
+		t.Helper()
+		f, err := os.OpenFile(store.getDataPath(), os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.WriteString(`{"Id":99,"Va`)
+		f.Close()
+	}
+
+	cut()
+	store.PutAll([]testUser{{Id: 3, Val: 3}, {Id: 4, Val: 4}})
+	cut()
+	if _, err := store.BulkLoad(strings.NewReader("{\"Id\":5,\"Val\":5}\n{\"Id\":6,\"Val\":6}\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func() {
+		t.Helper()
+		users := store.GetAll()
+		if len(users) != 6 {
+			t.Fatalf("expected 6 users, got %+v", users)
+		}
+		for i, u := range users {
+			if u.Id != uint64(i+1) || u.Val != i+1 {
+				t.Fatalf("unexpected user at %d: %+v", i, u)
+			}
+		}
+		var scanned []uint64
+		err := store.ScanFrom(0, all[testUser], func(u testUser, _ int64) error {
+			scanned = append(scanned, u.Id)
+			return nil
+		})
+		if err != nil || len(scanned) != 6 {
+			t.Fatalf("ScanFrom returned %v, %v", scanned, err)
+		}
+	}
+
+	check()
+
+	if err := store.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(store.getDataPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), `"Id":99`) {
+		t.Fatalf("compaction kept the partial line")
+	}
+	check()
+}
+
+func TestExplainReportsScanTiers(t *testing.T) {
+	minusOne := -1
+	store, err := Open[uint64, testUser](Options[uint64, testUser]{
+		Dir: t.TempDir(),
+		IDFunc: func(u testUser) (uint64, error) {
+			return u.Id, nil
+		},
+		ResidencyFunc: func(u testUser) bool {
+			return u.Id < 30
+		},
+		MaxInMemoryRecords: &minusOne,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	for i := 0; i < 100; i++ {
+		store.Put(testUser{Id: uint64(i), Val: i})
+	}
+	store.Delete(func(u testUser) bool { return u.Id >= 90 })
+	store.AddSortedIndex("val", func(u testUser) int64 { return int64(u.Val) })
+
+	plan := store.Explain(func(u testUser) bool { return u.Val > 50 })
+	if plan.Online != 30 || plan.Offline != 60 {
+		t.Fatalf("expected 30 online and 60 offline, got %+v", plan)
+	}
+	if plan.OfflineBytes == 0 {
+		t.Fatalf("expected offline bytes to be reported")
+	}
+	if len(plan.Indexes) != 1 || plan.Indexes[0] != "val" {
+		t.Fatalf("expected the val index, got %v", plan.Indexes)
+	}
+}
+
+func TestKeysIncludesOfflineRecords(t *testing.T) {
+	minusOne := -1
+	store, err := Open[uint64, testUser](Options[uint64, testUser]{
+		Dir: t.TempDir(),
+		IDFunc: func(u testUser) (uint64, error) {
+			return u.Id, nil
+		},
+		ResidencyFunc: func(u testUser) bool {
+			return u.Id%4 == 0
+		},
+		MaxInMemoryRecords: &minusOne,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	var want []uint64
+	for i := 20; i > 0; i-- {
+		store.Put(testUser{Id: uint64(i), Val: i})
+		want = append(want, uint64(i))
+	}
+	store.Delete(func(u testUser) bool { return u.Id == 7 })
+	want = slices.DeleteFunc(want, func(id uint64) bool { return id == 7 })
+
+	if _, offline := store.ResidencyStats(); offline == 0 {
+		t.Fatalf("expected some records offline")
+	}
+	if keys := store.Keys(); !slices.Equal(keys, want) {
+		t.Fatalf("expected %v, got %v", want, keys)
+	}
+}
+
+func TestOfflineScanReusesDecodeBuffer(t *testing.T) {
+	type tagged struct {
+		Id   uint64
+		Tags []string
+	}
+
+	minusOne := -1
+	store, err := Open[uint64, tagged](Options[uint64, tagged]{
+		Dir: t.TempDir(),
+		IDFunc: func(v tagged) (uint64, error) {
+			return v.Id, nil
+		},
+		MaxInMemoryRecords: &minusOne,
+		ResidencyFunc:      func(tagged) bool { return false },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	for i := 1; i <= 3; i++ {
+		store.Put(tagged{Id: uint64(i), Tags: []string{fmt.Sprint("tag ", i)}})
+	}
+
+	// the decode buffer is reset between values, so they share no slice
+	got := store.Get(nil)
+	for i, v := range got {
+		if want := fmt.Sprint("tag ", i+1); len(v.Tags) != 1 || v.Tags[0] != want {
+			t.Fatalf("expected %q in value %d, got %v", want, i, v.Tags)
+		}
+	}
+
+	ints, err := Open[uint64, testUser](Options[uint64, testUser]{
+		Dir: t.TempDir(),
+		IDFunc: func(u testUser) (uint64, error) {
+			return u.Id, nil
+		},
+		MaxInMemoryRecords: &minusOne,
+		ResidencyFunc:      func(testUser) bool { return false },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ints.Close()
+
+	for i := 1; i <= 1000; i++ {
+		ints.Put(testUser{Id: uint64(i), Val: i})
+	}
+	// one allocation per record before the buffer was reused; the race
+	// detector adds some of its own
+	allocs := testing.AllocsPerRun(5, func() { ints.Get(nil) })
+	if allocs >= 1000 {
+		t.Fatalf("expected fewer allocations than offline records, got %v for 1000", allocs)
+	}
+}
+
+func TestForEachOfflineVisitsOnlyOfflineRecords(t *testing.T) {
+	minusOne := -1
+	store, err := Open[uint64, testUser](Options[uint64, testUser]{
+		Dir: t.TempDir(),
+		IDFunc: func(u testUser) (uint64, error) {
+			return u.Id, nil
+		},
+		ResidencyFunc: func(u testUser) bool {
+			return u.Id%3 == 0
+		},
+		MaxInMemoryRecords: &minusOne,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	for i := 1; i <= 30; i++ {
+		store.Put(testUser{Id: uint64(i), Val: i})
+	}
+	store.Delete(func(u testUser) bool { return u.Id == 4 || u.Id == 6 })
+
+	var got []uint64
+	err = store.ForEachOffline(func(u testUser) error {
+		got = append(got, u.Id)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var want []uint64
+	for i := uint64(1); i <= 30; i++ {
+		if i%3 != 0 && i != 4 {
+			want = append(want, i)
+		}
+	}
+	slices.Sort(got)
+	if !slices.Equal(got, want) {
+		t.Fatalf("expected offline ids %v, got %v", want, got)
+	}
+}
+
+func TestResidencyOnReplayDisabledKeepsRecordsOnline(t *testing.T) {
+	dir := t.TempDir()
+	minusOne := -1
+	opts := Options[uint64, testUser]{
+		Dir: dir,
+		IDFunc: func(u testUser) (uint64, error) {
+			return u.Id, nil
+		},
+		ResidencyFunc: func(u testUser) bool {
+			return u.Id%2 == 0
+		},
+		MaxInMemoryRecords: &minusOne,
+	}
+
+	store, err := Open[uint64, testUser](opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 10; i++ {
+		store.Put(testUser{Id: uint64(i), Val: i})
+	}
+	// half the records in the snapshot, half in the WAL
+	if err := store.snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 11; i <= 20; i++ {
+		store.Put(testUser{Id: uint64(i), Val: i})
+	}
+	store.Close()
+
+	off := false
+	opts.ResidencyOnReplay = &off
+	store, err = Open[uint64, testUser](opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	if online, offline := store.ResidencyStats(); online != 20 || offline != 0 {
+		t.Fatalf("expected every record online after Open, got %d online, %d offline", online, offline)
+	}
+
+	if err := store.ApplyResidency(); err != nil {
+		t.Fatal(err)
+	}
+	if online, offline := store.ResidencyStats(); online != 10 || offline != 10 {
+		t.Fatalf("expected 10 online and 10 offline, got %d and %d", online, offline)
+	}
+	if got := len(store.GetAll()); got != 20 {
+		t.Fatalf("expected 20 records, got %d", got)
+	}
+}
+
+func TestArchiveTierSkippedByDefaultQueries(t *testing.T) {
+	dir := t.TempDir()
+	minusOne := -1
+	opts := Options[uint64, testUser]{
+		Dir: dir,
+		IDFunc: func(u testUser) (uint64, error) {
+			return u.Id, nil
+		},
+		ResidencyFunc: func(u testUser) bool {
+			return u.Id%2 == 0
+		},
+		// odd records go offline, the cold ones among them to the archive
+		ArchiveFunc: func(u testUser) bool {
+			return u.Val > 20
+		},
+		MaxInMemoryRecords: &minusOne,
+	}
+
+	store, err := Open[uint64, testUser](opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 30; i++ {
+		store.Put(testUser{Id: uint64(i), Val: i})
+	}
+
+	check := func(store *Store[uint64, testUser]) {
+		t.Helper()
+		if plan := store.Explain(nil); plan.Online != 15 || plan.Offline != 10 || plan.Archived != 5 {
+			t.Fatalf("expected 15 online, 10 offline and 5 archived, got %+v", plan)
+		}
+		for _, u := range store.Get(nil) {
+			if u.Id%2 == 1 && u.Val > 20 {
+				t.Fatalf("expected Get to skip archived record %d", u.Id)
+			}
+		}
+		if n := len(store.Get(nil)); n != 25 {
+			t.Fatalf("expected 25 records without the archive, got %d", n)
+		}
+		all, err := store.GetWithArchive(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, u := range all {
+			if u.Id != uint64(i+1) {
+				t.Fatalf("expected every record in insertion order, got %+v", all)
+			}
+		}
+		if len(all) != 30 {
+			t.Fatalf("expected 30 records with the archive, got %d", len(all))
+		}
+		if u, ok, err := store.GetByID(23); err != nil || !ok || u.Val != 23 {
+			t.Fatalf("expected GetByID to read the archive, got %+v, %v, %v", u, ok, err)
+		}
+	}
+	check(store)
+
+	if err := store.snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	store, err = Open[uint64, testUser](opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	check(store)
+
+	// once warm again, a written record goes to the data file
+	store.Put(testUser{Id: 25, Val: 5})
+	if info, _ := store.Inspect(25); info.Online || info.Archived {
+		t.Fatalf("expected record 25 in the data file after a write, got %+v", info)
+	}
+	if n := len(store.Get(nil)); n != 26 {
+		t.Fatalf("expected 26 records without the archive, got %d", n)
+	}
+}
+
+func TestVerifyOffloadLogsDivergingCopies(t *testing.T) {
+	type stamped struct {
+		Id   uint64
+		Name string
+		// set by the checker, but never persisted
+		seen int64
+	}
+
+	open := func(checker Checker[stamped]) (*Store[uint64, stamped], *strings.Builder) {
+		var logs strings.Builder
+		store, err := Open[uint64, stamped](Options[uint64, stamped]{
+			Dir: t.TempDir(),
+			IDFunc: func(v stamped) (uint64, error) {
+				return v.Id, nil
+			},
+			Checkers:      []Checker[stamped]{checker},
+			ResidencyFunc: func(stamped) bool { return false },
+			VerifyOffload: true,
+			Logger:        slog.New(slog.NewTextHandler(&logs, nil)),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { store.Close() })
+		return store, &logs
+	}
+
+	deterministic, logs := open(func(old *stamped, v stamped) (*stamped, error) {
+		v.Name = strings.ToLower(v.Name)
+		return &v, nil
+	})
+	deterministic.Put(stamped{Id: 1, Name: "Alice"})
+	if logs.Len() != 0 {
+		t.Fatalf("expected no warning, got %q", logs.String())
+	}
+
+	var clock int64
+	stamping, logs := open(func(old *stamped, v stamped) (*stamped, error) {
+		clock++
+		v.seen = clock
+		return &v, nil
+	})
+	stamping.Put(stamped{Id: 2, Name: "Bob"})
+	if !strings.Contains(logs.String(), "level=WARN") || !strings.Contains(logs.String(), "id=2") {
+		t.Fatalf("expected a warning naming record 2, got %q", logs.String())
+	}
+}
+
+func TestWarmAllLoadsOfflineRecords(t *testing.T) {
+	open := func(maxOnline int) *Store[uint64, testUser] {
+		store, err := Open[uint64, testUser](Options[uint64, testUser]{
+			Dir: t.TempDir(),
+			IDFunc: func(u testUser) (uint64, error) {
+				return u.Id, nil
+			},
+			ResidencyFunc:      func(testUser) bool { return false },
+			MaxInMemoryRecords: &maxOnline,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { store.Close() })
+		return store
+	}
+
+	// without a cap, every record comes back and Get no longer reads disk
+	store := open(-1)
+	for i := 1; i <= 10; i++ {
+		store.Put(testUser{Id: uint64(i), Val: i})
+	}
+	if _, offline := store.ResidencyStats(); offline != 10 {
+		t.Fatalf("expected every record offline, got %d", offline)
+	}
+	if err := store.WarmAll(); err != nil {
+		t.Fatal(err)
+	}
+	if online, offline := store.ResidencyStats(); online != 10 || offline != 0 {
+		t.Fatalf("expected every record online, got %d online and %d offline", online, offline)
+	}
+	if err := os.Truncate(store.getDataPath(), 0); err != nil {
+		t.Fatal(err)
+	}
+	store.dataWindow = &dataWindow{}
+	if got := store.Get(nil); len(got) != 10 {
+		t.Fatalf("expected 10 records without reading the data file, got %d", len(got))
+	}
+
+	// with a cap, records beyond it stay offline
+	store = open(5)
+	for i := 1; i <= 10; i++ {
+		store.Put(testUser{Id: uint64(i), Val: i})
+	}
+	store.Delete(func(u testUser) bool { return u.Id >= 6 && u.Id <= 9 })
+	if err := store.WarmAll(); err != nil {
+		t.Fatal(err)
+	}
+	if online, offline := store.ResidencyStats(); online != 5 || offline != 1 {
+		t.Fatalf("expected 5 online and 1 offline, got %d and %d", online, offline)
+	}
+	if info, _ := store.Inspect(5); info.Online {
+		t.Fatalf("expected the newest offline record to stay offline")
+	}
+}
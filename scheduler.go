@@ -0,0 +1,118 @@
+package flea
+
+import (
+	"sync"
+	"time"
+)
+
+// Scheduler snapshots the stores opened with it as Options.Scheduler from a
+// single goroutine and ticker, instead of one loop per store. It also runs
+// the compactions requested by CompactionTombstoneRatio and the snapshots
+// requested by MaxSnapshotAge.
+type Scheduler struct {
+	mu     sync.Mutex
+	stores map[scheduled]struct{}
+	// held while a round runs, so remove can wait for it
+	running sync.Mutex
+	wake    chan struct{}
+	stop    chan struct{}
+	wg      sync.WaitGroup
+	once    sync.Once
+}
+
+// scheduled is what a Scheduler needs from a store.
+type scheduled interface {
+	snapshot() error
+	snapshotIfRequested()
+	compactIfRequested()
+}
+
+// NewScheduler starts a scheduler that snapshots every registered store
+// each interval. The interval defaults to 30s.
+func NewScheduler(interval time.Duration) *Scheduler {
+	if interval == 0 {
+		interval = 30 * time.Second
+	}
+
+	sc := &Scheduler{
+		stores: make(map[scheduled]struct{}),
+		wake:   make(chan struct{}, 1),
+		stop:   make(chan struct{}),
+	}
+
+	sc.wg.Add(1)
+	go sc.loop(interval)
+
+	return sc
+}
+
+// Close stops the scheduler. Stores still using it are no longer
+// snapshotted in the background, and must be closed on their own.
+func (sc *Scheduler) Close() {
+	sc.once.Do(func() {
+		close(sc.stop)
+		sc.wg.Wait()
+	})
+}
+
+func (sc *Scheduler) add(s scheduled) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.stores[s] = struct{}{}
+}
+
+// remove unregisters s and waits for a round that may still be using it.
+func (sc *Scheduler) remove(s scheduled) {
+	sc.mu.Lock()
+	delete(sc.stores, s)
+	sc.mu.Unlock()
+
+	sc.running.Lock()
+	sc.running.Unlock()
+}
+
+// request wakes the scheduler to run the pending snapshots and
+// compactions.
+func (sc *Scheduler) request() {
+	select {
+	case sc.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (sc *Scheduler) loop(interval time.Duration) {
+	defer sc.wg.Done()
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-sc.stop:
+			return
+		case <-t.C:
+			sc.run(func(s scheduled) { _ = s.snapshot() })
+		case <-sc.wake:
+			sc.run(func(s scheduled) {
+				s.snapshotIfRequested()
+				s.compactIfRequested()
+			})
+		}
+	}
+}
+
+func (sc *Scheduler) run(fn func(scheduled)) {
+	sc.running.Lock()
+	defer sc.running.Unlock()
+
+	sc.mu.Lock()
+	stores := make([]scheduled, 0, len(sc.stores))
+	for s := range sc.stores {
+		stores = append(stores, s)
+	}
+	sc.mu.Unlock()
+
+	for _, s := range stores {
+		fn(s)
+	}
+}
@@ -0,0 +1,54 @@
+package flea
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestScheduler_SnapshotsEveryStore(t *testing.T) {
+	sc := NewScheduler(20 * time.Millisecond)
+	defer sc.Close()
+
+	stores := make([]*Store[uint64, User], 3)
+	for i := range stores {
+		s, err := Open[uint64, User](Options[uint64, User]{
+			Dir:       t.TempDir(),
+			IDFunc:    userID,
+			Scheduler: sc,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		if s.stop != nil {
+			t.Fatalf("expected no snapshot loop of its own")
+		}
+		if _, err := s.Put(User{Id: uint64(i + 1)}); err != nil {
+			t.Fatal(err)
+		}
+		stores[i] = s
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for i, s := range stores {
+		for {
+			if _, err := os.Stat(s.getSnapshotPath()); err == nil {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("store %d was never snapshotted", i)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// a closed store is no longer scheduled
+	stores[0].Close()
+	sc.mu.Lock()
+	n := len(sc.stores)
+	sc.mu.Unlock()
+	if n != 2 {
+		t.Fatalf("expected 2 scheduled stores, got %d", n)
+	}
+}
@@ -2,104 +2,756 @@ package flea
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/json"
-	"os"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"strconv"
+	"syscall"
 	"time"
 )
 
+// startSnapshots schedules the snapshots of the store: on the Scheduler of
+// its options when there is one, on a loop of its own otherwise.
+func (s *Store[ID, T]) startSnapshots() {
+	if s.scheduler != nil {
+		s.loop = s
+		s.scheduler.add(s)
+		return
+	}
+	s.stop = make(chan struct{})
+	s.loopWG.Add(1)
+	go s.snapshotLoop(s.snapshotInterval)
+}
+
 func (s *Store[ID, T]) snapshotLoop(interval time.Duration) {
+	defer s.loopWG.Done()
+
 	t := time.NewTicker(interval)
 	defer t.Stop()
 
-	for range t.C {
-		s.mu.Lock()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-t.C:
+			_ = s.snapshot()
+		case <-s.snapshotCh:
+			_ = s.snapshot()
+		case <-s.compactCh:
+			_ = s.Compact()
+		}
+	}
+}
+
+// snapshotIfRequested takes the snapshot requested by checkSnapshotAge, if
+// any.
+func (s *Store[ID, T]) snapshotIfRequested() {
+	select {
+	case <-s.snapshotCh:
 		_ = s.snapshot()
-		s.mu.Unlock()
+	default:
 	}
 }
 
-func (s *Store[ID, T]) loadSnapshot() error {
+// compactIfRequested runs the compaction requested by checkCompaction, if
+// any.
+func (s *Store[ID, T]) compactIfRequested() {
+	select {
+	case <-s.compactCh:
+		_ = s.Compact()
+	default:
+	}
+}
+
+// snapshotHeader is written as the first line of a snapshot. Seq is the
+// sequence number of the last WAL op included in the snapshot.
+type snapshotHeader struct {
+	Seq uint64 `json:"seq"`
+	// the types the snapshot was written with
+	Type *typeSig `json:"type,omitempty"`
+}
+
+// snapshotHeaderLine wraps the header under a key no record is expected to
+// use, so snapshots written before headers existed still load.
+type snapshotHeaderLine struct {
+	Header *snapshotHeader `json:"__flea_snapshot__"`
+}
+
+// loadSnapshot loads the records of the snapshot and returns its sequence
+// number.
+func (s *Store[ID, T]) loadSnapshot() (uint64, error) {
 	path := s.getSnapshotPath()
-	f, err := os.Open(path)
+	f, err := s.fs.Open(path)
 	if err != nil {
-		return nil
+		return 0, nil
 	}
 	defer f.Close()
 
-	sc := bufio.NewScanner(f)
+	var seq uint64
+	first := true
+	limit := s.maxRecordBytes
+	if limit > 0 {
+		limit += versionedOverhead
+	}
+	sc := newLineScanner(f, limit)
 	for sc.Scan() {
+		if first {
+			first = false
+			var h snapshotHeaderLine
+			if json.Unmarshal(sc.Bytes(), &h) == nil && h.Header != nil {
+				if err := s.typeSig.compatible(h.Header.Type); err != nil {
+					return 0, err
+				}
+				seq = h.Header.Seq
+				continue
+			}
+		}
+		meta, payload, err := parseSnapshotLine(sc.Bytes())
+		if err != nil {
+			return 0, err
+		}
+		if s.maxRecordBytes > 0 && len(payload) > s.maxRecordBytes {
+			return 0, fmt.Errorf("%w: %d bytes in the snapshot, limit is %d", ErrRecordTooLarge, len(payload), s.maxRecordBytes)
+		}
 		var i T
-		//TODO: Os arquivos offline sao escritos como null no snapshot e precisam ser rehidratados corretamente.
-		//Atualmente está criando objetos vazios
-		if err := json.Unmarshal(sc.Bytes(), &i); err != nil {
-			return err
+		blob, err := s.decodeRef(payload, &i)
+		if err != nil {
+			return 0, err
+		}
+		if blob, err = s.ensureBlob(&i, blob); err != nil {
+			return 0, err
 		}
-		s.records = append(s.records, &record[T]{value: &i})
+		s.records = append(s.records, &record[T]{value: &i, version: meta.version, createdAt: meta.created, updatedAt: meta.updated, blob: blob})
 		s.onlineCount++
 	}
+	if err := scanErr(sc.Err()); err != nil {
+		return 0, err
+	}
 	s.recreateIndex()
-	s.handleResidency()
-	return nil
+	if s.residencyOnReplay {
+		s.handleResidency()
+	}
+	return seq, nil
 }
 
-func (s *Store[ID, T]) snapshot() error {
-	tmp := s.getPath("snapshot.tmp")
-	final := s.getSnapshotPath()
+// newLineScanner returns a scanner over the lines of r. With max > 0, lines
+// longer than max bytes make it fail with bufio.ErrTooLong; otherwise line
+// length is unbounded, unlike the 64KB default of bufio.Scanner.
+func newLineScanner(r io.Reader, max int) *bufio.Scanner {
+	sc := bufio.NewScanner(r)
+	limit := math.MaxInt
+	if max > 0 {
+		// +1 leaves room for the newline
+		limit = max + 1
+	}
+	sc.Buffer(make([]byte, 0, min(limit, 64*1024)), limit)
+	return sc
+}
 
-	f, err := os.Create(tmp)
+// scanErr reports a line over the scanner limit as ErrRecordTooLarge.
+func scanErr(err error) error {
+	if errors.Is(err, bufio.ErrTooLong) {
+		return fmt.Errorf("%w: %w", ErrRecordTooLarge, err)
+	}
+	return err
+}
+
+// verifySnapshot decodes the snapshot at path and checks it holds exactly
+// count records.
+func verifySnapshot[T any](fs FS, path string, count int) error {
+	f, err := fs.Open(path)
 	if err != nil {
 		return err
 	}
+	defer f.Close()
+
+	sc := newLineScanner(f, 0)
+	if !sc.Scan() {
+		return fmt.Errorf("%w: missing header", ErrInvalidSnapshot)
+	}
+	var h snapshotHeaderLine
+	if err := json.Unmarshal(sc.Bytes(), &h); err != nil || h.Header == nil {
+		return fmt.Errorf("%w: invalid header", ErrInvalidSnapshot)
+	}
+
+	n := 0
+	for sc.Scan() {
+		_, payload, err := parseSnapshotLine(sc.Bytes())
+		if err != nil {
+			return fmt.Errorf("%w: record %d: %w", ErrInvalidSnapshot, n, err)
+		}
+		var v T
+		if err := json.Unmarshal(payload, &v); err != nil {
+			return fmt.Errorf("%w: record %d: %w", ErrInvalidSnapshot, n, err)
+		}
+		n++
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	if n != count {
+		return fmt.Errorf("%w: expected %d records, found %d", ErrInvalidSnapshot, count, n)
+	}
+	return nil
+}
+
+// snapshotEntry is the state of a live record captured for a snapshot.
+type snapshotEntry[T any] struct {
+	value     *T
+	offloaded bool
+	offset    int64
+	size      int64
+	version   uint64
+	created   int64
+	updated   int64
+	blob      blobRef
+	// the captured record, to name it when it can't be read
+	rec *record[T]
+	// see record.archived
+	archived bool
+	member   int64
+}
+
+// entryOf captures the state of r. It runs under s.mu.
+func entryOf[T any](r *record[T]) snapshotEntry[T] {
+	return snapshotEntry[T]{
+		value:     r.value,
+		offloaded: r.offloaded,
+		offset:    r.offset,
+		size:      r.size,
+		version:   r.version,
+		created:   r.createdAt,
+		updated:   r.updatedAt,
+		blob:      r.blob,
+		rec:       r,
+		archived:  r.archived,
+		member:    r.member,
+	}
+}
+
+// offlineReader reads the offline values of captured entries without
+// s.mu, with its own buffers. The files it holds are only appended to, and
+// are neither rewritten nor truncated while snapMu is held; DeleteAll
+// replaces them with new files instead, see retire.
+type offlineReader struct {
+	data, archive File
+	window        archiveWindow
+	buf           []byte
+}
+
+// offlineReader returns a reader over the current offline files. It runs
+// under s.mu and snapMu, so the files retired before are no longer read.
+func (s *Store[ID, T]) offlineReader() *offlineReader {
+	s.closeRetired()
+	return &offlineReader{data: s.dataFile, archive: s.archiveFile}
+}
+
+// read returns the payload of an offline entry, which is only valid until
+// the next read.
+func (r *offlineReader) read(archived bool, member, offset, size int64) ([]byte, error) {
+	if archived {
+		return r.window.read(r.archive, member, offset, size)
+	}
+	if int64(cap(r.buf)) < size {
+		r.buf = make([]byte, size)
+	}
+	r.buf = r.buf[:size]
+	if _, err := r.data.ReadAt(r.buf, offset); err != nil {
+		return nil, err
+	}
+	return r.buf, nil
+}
+
+// entriesByID captures the live records ordered by id, see
+// Options.DeterministicSnapshot.
+func (s *Store[ID, T]) entriesByID() []snapshotEntry[T] {
+	type keyed struct {
+		id ID
+		e  snapshotEntry[T]
+	}
+	sorted := make([]keyed, 0, len(s.index))
+	for id, r := range s.index {
+		sorted = append(sorted, keyed{id: id, e: entryOf(r)})
+	}
+	order := idOrder[ID]()
+	slices.SortFunc(sorted, func(a, b keyed) int { return order(a.id, b.id) })
+
+	entries := make([]snapshotEntry[T], 0, len(sorted))
+	for _, k := range sorted {
+		entries = append(entries, k.e)
+	}
+	return entries
+}
+
+// A record with a version is written to the snapshot wrapped as
+// {"__flea_version__":N,"value":<record>}, or as
+// {"__flea_version__":N,"__flea_times__":[C,U],"value":<record>} when it
+// has timestamps. Like the header, the wrapper uses keys no record is
+// expected to have, so records written before versions existed still load,
+// with version 0.
+const (
+	versionedPrefix = `{"__flea_version__":`
+	versionedTimes  = `,"__flea_times__":[`
+	versionedValue  = `,"value":`
+	// upper bound of the bytes the wrapper adds to a record
+	versionedOverhead = len(versionedPrefix) + 20 + len(versionedTimes) + 20 + 1 + 20 + 1 + len(versionedValue) + 1
+)
+
+// lineMeta is what a snapshot line holds besides the record.
+type lineMeta struct {
+	version          uint64
+	created, updated int64
+}
+
+// appendSnapshotLine appends the snapshot line of a record to buf.
+func appendSnapshotLine(buf []byte, meta lineMeta, payload []byte) []byte {
+	if meta.version == 0 && meta.created == 0 {
+		buf = append(buf, payload...)
+		return append(buf, '\n')
+	}
+	buf = append(buf, versionedPrefix...)
+	buf = strconv.AppendUint(buf, meta.version, 10)
+	if meta.created != 0 {
+		buf = append(buf, versionedTimes...)
+		buf = strconv.AppendInt(buf, meta.created, 10)
+		buf = append(buf, ',')
+		buf = strconv.AppendInt(buf, meta.updated, 10)
+		buf = append(buf, ']')
+	}
+	buf = append(buf, versionedValue...)
+	buf = append(buf, payload...)
+	return append(buf, '}', '\n')
+}
+
+// parseSnapshotLine returns the version, the timestamps and the encoded
+// record of a snapshot line.
+func parseSnapshotLine(line []byte) (lineMeta, []byte, error) {
+	var meta lineMeta
+	rest, ok := bytes.CutPrefix(line, []byte(versionedPrefix))
+	if !ok {
+		return meta, line, nil
+	}
+	head, payload, ok := bytes.Cut(rest, []byte(versionedValue))
+	if !ok || len(payload) == 0 || payload[len(payload)-1] != '}' {
+		return meta, nil, errors.New("malformed versioned record")
+	}
+	num, times, hasTimes := bytes.Cut(head, []byte(versionedTimes))
+	version, err := strconv.ParseUint(string(num), 10, 64)
+	if err != nil {
+		return meta, nil, err
+	}
+	meta.version = version
+	if hasTimes {
+		created, updated, ok := bytes.Cut(bytes.TrimSuffix(times, []byte("]")), []byte(","))
+		if !ok {
+			return meta, nil, errors.New("malformed record timestamps")
+		}
+		if meta.created, err = strconv.ParseInt(string(created), 10, 64); err != nil {
+			return meta, nil, err
+		}
+		if meta.updated, err = strconv.ParseInt(string(updated), 10, 64); err != nil {
+			return meta, nil, err
+		}
+	}
+	return meta, payload[:len(payload)-1], nil
+}
+
+// snapshot writes every live record to snapshot.ndjson and drops the WAL
+// ops it covers. When offline records can't be read, the current snapshot
+// and the WAL are kept, as they may be all that holds them, and a
+// *SkippedRecordsError is returned. The result is kept for Stats.
+//
+// The store lock is only held to capture the records and, at the end, to
+// trim the WAL, so reads and writes keep going while the file is written.
+// Captured records are safe to use without the lock: stored values are
+// never mutated in place, and the data file only grows while snapMu is held.
+func (s *Store[ID, T]) snapshot() error {
+	err := s.takeSnapshot()
+	s.mu.Lock()
+	s.snapshotErr = err
+	s.mu.Unlock()
+	return err
+}
+
+func (s *Store[ID, T]) takeSnapshot() error {
+	s.snapMu.Lock()
+	defer s.snapMu.Unlock()
+
+	s.mu.Lock()
+	if s.wal == nil {
+		// in-memory and read-only stores have nothing to snapshot
+		s.mu.Unlock()
+		return nil
+	}
 
 	if s.dirty {
 		s.compact()
-		s.dirty = false
 	}
 
-	enc := json.NewEncoder(f)
 	for _, r := range s.records {
-		if r.value == nil {
-			continue
-		}
-		if r.deleted {
-			continue
+		// a new residency interval starts with every snapshot
+		r.recent = false
+		r.offloads = 0
+	}
+	entries := s.liveEntries()
+
+	seq := s.wal.seq
+	walMark, err := s.wal.size()
+	files := s.offlineReader()
+	s.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	tmp := s.getSnapshotTmpPath()
+	if err := s.syncBlobs(); err != nil {
+		return err
+	}
+	skipped, err := s.writeSnapshot(tmp, seq, entries, files, false)
+	if err != nil {
+		s.fs.Remove(tmp)
+		return err
+	}
+	if len(skipped.recs) > 0 {
+		s.mu.Lock()
+		err := s.skippedError(skipped)
+		s.mu.Unlock()
+		if err != nil {
+			s.fs.Remove(tmp)
+			return err
 		}
-		if err := enc.Encode(r.value); err != nil {
-			f.Close()
+	}
+
+	if s.verifySnapshot {
+		if err := verifySnapshot[T](s.fs, tmp, len(entries)-len(skipped.recs)); err != nil {
+			s.fs.Remove(tmp)
 			return err
 		}
 	}
 
-	if err := f.Sync(); err != nil {
-		f.Close()
+	if err := s.replaceSnapshot(tmp); err != nil {
 		return err
 	}
-	f.Close()
 
-	if err := os.Rename(tmp, final); err != nil {
+	// drop the WAL ops covered by the snapshot, keeping the ones written
+	// while it was being taken
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.wal.dropBefore(walMark); err != nil {
 		return err
 	}
+	s.lastSnapshot = s.now()
+	return nil
+}
 
-	// reset WAL
-	truncate(s.wal.file)
+// replaceSnapshot moves the snapshot written to tmp over the current one.
+// A rename can't cross file systems, so a tmp on another one than the
+// model directory is first copied and synced next to the snapshot.
+func (s *Store[ID, T]) replaceSnapshot(tmp string) error {
+	err := s.fs.Rename(tmp, s.getSnapshotPath())
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
 
+	staged := s.getPath("snapshot.tmp")
+	if err := s.copyFile(tmp, staged); err != nil {
+		s.fs.Remove(staged)
+		return err
+	}
+	if err := s.fs.Rename(staged, s.getSnapshotPath()); err != nil {
+		return err
+	}
+	s.fs.Remove(tmp)
 	return nil
 }
 
+// copyFile copies src to dst and syncs dst.
+func (s *Store[ID, T]) copyFile(src, dst string) error {
+	in, err := s.fs.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := s.fs.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// SnapshotTo writes a point-in-time snapshot of every live record, offline
+// ones included, to path, for exports and backups. The store's own snapshot
+// and WAL are left untouched. The file has the layout of snapshot.ndjson,
+// so a store opened on a directory holding it loads its records.
+func (s *Store[ID, T]) SnapshotTo(path string) error {
+	s.snapMu.Lock()
+	defer s.snapMu.Unlock()
+
+	s.mu.Lock()
+	entries := s.liveEntries()
+	var seq uint64
+	if s.wal != nil {
+		seq = s.wal.seq
+	}
+	files := s.offlineReader()
+	s.mu.Unlock()
+
+	tmp := path + ".tmp"
+	skipped, err := s.writeSnapshot(tmp, seq, entries, files, true)
+	if err != nil {
+		s.fs.Remove(tmp)
+		return err
+	}
+	if err := s.fs.Rename(tmp, path); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.skippedError(skipped)
+}
+
+// liveEntries captures the live records for a snapshot, in insertion order
+// or by id with DeterministicSnapshot. It runs under s.mu.
+func (s *Store[ID, T]) liveEntries() []snapshotEntry[T] {
+	if s.deterministicSnapshot {
+		return s.entriesByID()
+	}
+	entries := make([]snapshotEntry[T], 0, len(s.index))
+	for _, r := range s.records {
+		if r.deleted {
+			continue
+		}
+		entries = append(entries, entryOf(r))
+	}
+	return entries
+}
+
+// skippedRecords are the offline records a snapshot left out because
+// they could not be read, and the first read error.
+type skippedRecords[T any] struct {
+	recs []*record[T]
+	err  error
+}
+
+// writeSnapshot writes a snapshot of entries with sequence number seq to
+// path and syncs it.
+//
+// Offline records are copied from the data file so the snapshot holds
+// every live value; data.ndjson is only a spill area rebuilt on Open. An
+// offline record that can't be read, or doesn't hold JSON, is left out
+// and returned in skipped, so one bad offset doesn't prevent checkpointing
+// the others.
+//
+// Blobs stay in blobs.bin unless inlineBlobs is set, for a snapshot meant
+// to be read without it.
+func (s *Store[ID, T]) writeSnapshot(path string, seq uint64, entries []snapshotEntry[T], files *offlineReader, inlineBlobs bool) (skipped skippedRecords[T], err error) {
+	f, err := s.fs.Create(path)
+	if err != nil {
+		return skipped, err
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(snapshotHeaderLine{Header: &snapshotHeader{Seq: seq, Type: s.typeSig}}); err != nil {
+		return skipped, err
+	}
+	var line []byte
+	for _, e := range entries {
+		var payload []byte
+		blob := e.blob
+		if inlineBlobs {
+			blob = blobRef{}
+		}
+		if !e.offloaded {
+			payload, err = s.encode(*e.value, blob)
+			if err != nil {
+				return skipped, err
+			}
+		} else {
+			buf, err := files.read(e.archived, e.member, e.offset, e.size)
+			if err == nil && !json.Valid(buf) {
+				err = fmt.Errorf("invalid JSON at offset %d", e.offset)
+			}
+			if err == nil && inlineBlobs && e.blob.valid() {
+				buf, err = s.inlineBlob(buf)
+			}
+			if err != nil {
+				skipped.recs = append(skipped.recs, e.rec)
+				if skipped.err == nil {
+					skipped.err = err
+				}
+				continue
+			}
+			payload = buf
+		}
+		line = appendSnapshotLine(line[:0], lineMeta{version: e.version, created: e.created, updated: e.updated}, payload)
+		if _, err := w.Write(line); err != nil {
+			return skipped, err
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		return skipped, err
+	}
+	return skipped, f.Sync()
+}
+
+// skippedError logs the records a completed snapshot left out and reports
+// them as a *SkippedRecordsError, or returns nil when there are none. It
+// runs under s.mu.
+func (s *Store[ID, T]) skippedError(skipped skippedRecords[T]) error {
+	if len(skipped.recs) == 0 {
+		return nil
+	}
+	s.readErrors += uint64(len(skipped.recs))
+
+	want := make(map[*record[T]]bool, len(skipped.recs))
+	for _, rec := range skipped.recs {
+		want[rec] = true
+	}
+	e := &SkippedRecordsError[ID]{Err: fmt.Errorf("%w: %w", ErrIO, skipped.err)}
+	for id, rec := range s.index {
+		if want[rec] {
+			e.IDs = append(e.IDs, id)
+		}
+	}
+	if len(e.IDs) == 0 {
+		// deleted while the snapshot was written
+		return nil
+	}
+
+	if s.logger != nil {
+		s.logger.Warn("flea: snapshot skipped unreadable offline records",
+			"ids", e.IDs, "err", skipped.err, "path", s.Path())
+	}
+	return e
+}
+
+// compact drops deleted records from s.records and rebuilds the index from
+// the remaining ones. Offline records are kept as they are, and so are the
+// deleted records still within TombstoneRetention, which leave the store
+// dirty for the next compaction.
 func (s *Store[ID, T]) compact() {
+	retained := 0
+	cutoff := time.Now().Add(-s.tombstoneRetention).UnixNano()
 	out := make([]*record[T], 0, len(s.index))
-	newIndex := make(map[ID]*record[T], len(s.index))
+	live := make(map[*record[T]]ID, len(s.index))
+
+	for id, rec := range s.index {
+		live[rec] = id
+	}
 
+	newIndex := make(map[ID]*record[T], len(s.index))
 	for _, rec := range s.records {
 		if rec.deleted {
+			if s.tombstoneRetention > 0 && rec.deletedAt > cutoff {
+				out = append(out, rec)
+				retained++
+			}
+			continue
+		}
+		id, ok := live[rec]
+		if !ok {
+			// an earlier record of an id in an append-only store
+			if s.appendOnly {
+				out = append(out, rec)
+			}
 			continue
 		}
-		id, _ := s.idFunc(*rec.value)
 		newIndex[id] = rec
 		out = append(out, rec)
 	}
 	s.records = out
 	s.index = newIndex
+	s.dirty = retained > 0
+	s.retained = retained
+}
+
+// Compact reclaims the space held by deleted records, both in memory and in
+// the offline data file, without waiting for the next snapshot.
+func (s *Store[ID, T]) Compact() error {
+	s.snapMu.Lock()
+	defer s.snapMu.Unlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.readOnly {
+		return ErrReadOnly
+	}
+
+	s.compact()
+
+	return s.rewriteDataFile()
+}
+
+// Reindex rebuilds the index and the online and offline counters from the
+// records themselves, reading offline values back from the data file to
+// recompute their ids. It is a recovery tool for an index that drifted from
+// the records; when two live records share an id, the later one wins and the
+// earlier one is deleted.
+func (s *Store[ID, T]) Reindex() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	index := make(map[ID]*record[T], len(s.index))
+	online, offline, archived := 0, 0, 0
+	for _, rec := range s.records {
+		if rec.deleted {
+			continue
+		}
+		v, err := s.valueOf(rec)
+		if err != nil {
+			return err
+		}
+		id, err := s.idFunc(v)
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrIDFunc, err)
+		}
+		if prev, ok := index[id]; ok && !s.appendOnly {
+			prev.deleted = true
+			if !prev.offloaded {
+				online--
+			} else {
+				offline--
+			}
+			if prev.archived {
+				archived--
+			}
+			s.dirty = true
+		}
+		index[id] = rec
+		if !rec.offloaded {
+			online++
+		} else {
+			offline++
+		}
+		if rec.archived {
+			archived++
+		}
+	}
+
+	s.index = index
+	s.onlineCount = online
+	s.offlineCount = offline
+	s.archivedCount = archived
+	return nil
 }
 
 func (s *Store[ID, T]) recreateIndex() {
@@ -0,0 +1,159 @@
+package flea
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+)
+
+// sortedIndex keeps the ids of the live records ordered by an int64 key.
+// Ids sharing a key are kept in the order they were indexed.
+type sortedIndex[ID comparable, T any] struct {
+	key     func(T) int64
+	entries []sortedEntry[ID]
+	keys    map[ID]int64
+}
+
+type sortedEntry[ID comparable] struct {
+	key int64
+	id  ID
+}
+
+func (x *sortedIndex[ID, T]) put(id ID, v T) {
+	k := x.key(v)
+	if old, ok := x.keys[id]; ok {
+		if old == k {
+			return
+		}
+		x.remove(id, old)
+	}
+
+	i := sort.Search(len(x.entries), func(i int) bool { return x.entries[i].key > k })
+	x.entries = slices.Insert(x.entries, i, sortedEntry[ID]{key: k, id: id})
+	x.keys[id] = k
+}
+
+func (x *sortedIndex[ID, T]) drop(id ID) {
+	if k, ok := x.keys[id]; ok {
+		x.remove(id, k)
+		delete(x.keys, id)
+	}
+}
+
+func (x *sortedIndex[ID, T]) remove(id ID, k int64) {
+	i := sort.Search(len(x.entries), func(i int) bool { return x.entries[i].key >= k })
+	for ; i < len(x.entries) && x.entries[i].key == k; i++ {
+		if x.entries[i].id == id {
+			x.entries = slices.Delete(x.entries, i, i+1)
+			return
+		}
+	}
+}
+
+// between returns the ids whose key is in [lo, hi], by ascending key.
+func (x *sortedIndex[ID, T]) between(lo, hi int64) []ID {
+	i := sort.Search(len(x.entries), func(i int) bool { return x.entries[i].key >= lo })
+	j := sort.Search(len(x.entries), func(i int) bool { return x.entries[i].key > hi })
+	ids := make([]ID, 0, max(j-i, 0))
+	for ; i < j; i++ {
+		ids = append(ids, x.entries[i].id)
+	}
+	return ids
+}
+
+func (x *sortedIndex[ID, T]) reset() {
+	x.entries = nil
+	x.keys = make(map[ID]int64)
+}
+
+// indexPut updates the sorted and field indexes for a write of v under id.
+func (s *Store[ID, T]) indexPut(id ID, v T) {
+	for _, x := range s.sortedIndexes {
+		x.put(id, v)
+	}
+	for _, x := range s.fieldIndexes {
+		x.put(id, v)
+	}
+}
+
+// indexDrop removes id from the sorted and field indexes.
+func (s *Store[ID, T]) indexDrop(id ID) {
+	for _, x := range s.sortedIndexes {
+		x.drop(id)
+	}
+	for _, x := range s.fieldIndexes {
+		x.drop(id)
+	}
+}
+
+// resetIndexes empties the sorted and field indexes, keeping them defined.
+func (s *Store[ID, T]) resetIndexes() {
+	for _, x := range s.sortedIndexes {
+		x.reset()
+	}
+	for _, x := range s.fieldIndexes {
+		x.reset()
+	}
+}
+
+// AddSortedIndex maintains an in-memory index of the live records ordered by
+// key, for RangeByIndex. Offline records are read once to build it. The
+// index costs one entry per record and an O(n) shift on every write that
+// changes a key; it is not persisted and must be added again after Open.
+func (s *Store[ID, T]) AddSortedIndex(name string, key func(T) int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.sortedIndexes[name]; ok {
+		return fmt.Errorf("flea: index %q already exists", name)
+	}
+
+	x := &sortedIndex[ID, T]{key: key, keys: make(map[ID]int64, len(s.index))}
+	for _, rec := range s.records {
+		if rec.deleted {
+			continue
+		}
+		v, err := s.valueOf(rec)
+		if err != nil {
+			return err
+		}
+		id, err := s.idFunc(v)
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrIDFunc, err)
+		}
+		x.put(id, v)
+	}
+
+	if s.sortedIndexes == nil {
+		s.sortedIndexes = make(map[string]*sortedIndex[ID, T])
+	}
+	s.sortedIndexes[name] = x
+	return nil
+}
+
+// RangeByIndex returns the values whose key in the named index lies in
+// [lo, hi], by ascending key. Offline values are loaded from disk.
+func (s *Store[ID, T]) RangeByIndex(name string, lo, hi int64) ([]T, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	x, ok := s.sortedIndexes[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrNoIndex, name)
+	}
+
+	ids := x.between(lo, hi)
+	results := make([]T, 0, len(ids))
+	for _, id := range ids {
+		rec := s.index[id]
+		v, err := s.valueOf(rec)
+		if err != nil {
+			return nil, err
+		}
+		if !rec.offloaded {
+			v = s.clone(v)
+		}
+		results = append(results, v)
+	}
+	return results, nil
+}
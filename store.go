@@ -1,8 +1,32 @@
 package flea
 
 import (
-	"os"
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"reflect"
+	"slices"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CollisionPolicy defines what a write does when its id is already taken by
+// a stored value.
+type CollisionPolicy int
+
+const (
+	// CollisionOverwrite replaces the stored value. This is the default.
+	CollisionOverwrite CollisionPolicy = iota
+	// CollisionReject fails the write with ErrIDCollision when the serialized
+	// form of the new value differs from the stored one. Writing an identical
+	// value is still allowed.
+	CollisionReject
 )
 
 // Predicate represents a pure boolean function used to filter stored values.
@@ -32,6 +56,22 @@ type Predicate[T any] func(T) bool
 // and no state is modified.
 type Checker[T any] func(old *T, new T) (*T, error)
 
+// DeleteChecker is a pre-delete function executed for every record matched
+// by a delete operation.
+//
+// Returning a non-nil error vetoes the delete. When any DeleteChecker rejects
+// any matched record, the whole operation is aborted and no state is modified.
+type DeleteChecker[T any] func(value T) error
+
+// AfterWrite is a post-commit function executed after a record has been
+// durably written to the WAL and applied in memory.
+//
+// It receives the previous value (nil on inserts) and the value that was
+// stored. AfterWrite functions never run during recovery, which makes them
+// the right place for cache invalidation or denormalization that must only
+// happen once a write has succeeded.
+type AfterWrite[T any] func(old *T, new T)
+
 // IDFunc defines how the logical identity of a record is computed.
 // Records producing the same Id are considered duplicates.
 // When not provided, the default implementation uses the hash of the
@@ -39,265 +79,2036 @@ type Checker[T any] func(old *T, new T) (*T, error)
 type IDFunc[ID comparable, T any] func(T) (ID, error)
 
 type record[T any] struct {
-	value   *T
-	deleted bool
-	offset  int64
-	size    int64
+	// nil while the record is offloaded
+	value *T
+	// the value is offline, in the data file or the archive, instead of in
+	// value
+	offloaded bool
+	deleted   bool
+	offset    int64
+	size      int64
+	// written since the last snapshot, see Options.KeepRecentWritesOnline
+	recent bool
+	// unix nanoseconds of the delete, see Options.TombstoneRetention
+	deletedAt int64
+	// times offloaded since the last snapshot, see Options.ThrashThreshold
+	offloads int32
+	// incremented by every write, see PutIfVersion
+	version uint64
+	// the offline value is in the archive, at offset in the member that
+	// starts at byte member of the file; see Options.ArchiveFunc
+	archived bool
+	member   int64
+	// unix nanoseconds of the first and the last write, see
+	// Options.TrackTimestamps
+	createdAt int64
+	updatedAt int64
+	// where the blob of the value went, see Options.BlobField
+	blob blobRef
 }
 
+// Store is a handle on a store. Every Open returns a handle of its own, and
+// the handles of a store shared by several Opens point to the same
+// storeState.
 type Store[ID comparable, T any] struct {
-	mu             sync.Mutex
-	records        []*record[T]
-	dir            string
-	wal            *wal[ID, T]
-	idFunc         IDFunc[ID, T]
-	index          map[ID]*record[T]
-	dirty          bool
-	checkers       []Checker[T]
-	residencyFn    func(T) bool
-	hasOfflineData bool
-	maxInMemory    int
-	onlineCount    int
-	dataFile       *os.File
-	dataWindow     *dataWindow
+	*storeState[ID, T]
+	// set by the first Close of the handle
+	released atomic.Bool
+}
+
+// storeState is the state of an open store.
+type storeState[ID comparable, T any] struct {
+	mu               sync.Mutex
+	snapMu           sync.Mutex
+	records          []*record[T]
+	dir              string
+	wal              *wal[ID, T]
+	idFunc           IDFunc[ID, T]
+	index            map[ID]*record[T]
+	dirty            bool
+	checkers         []Checker[T]
+	deleteCheckers   []DeleteChecker[T]
+	afterWrites      []AfterWrite[T]
+	onIDCollision    CollisionPolicy
+	cloneFn          func(T) T
+	onReplayProgress func(processed int)
+	residencyFn      func(T) bool
+	hasOfflineData   bool
+	maxInMemory      int
+	onlineCount      int
+	offlineCount     int
+	dataFile         File
+	dataWindow       *dataWindow
+	// offline values are decoded here and copied out, so that reading one
+	// doesn't allocate a T; guarded by mu
+	scratch          *T
+	lock             File
+	readOnly         bool
+	inMemory         bool
+	snapshotInterval time.Duration
+	keepRecentWrites bool
+	verifySnapshot   bool
+	tempDir          string
+	trackTimestamps  bool
+	// T can hold floats, so written values are checked with checkFinite
+	checkFloats bool
+	// T holds times for normalizeTimes
+	hasTimes bool
+	equal    func(a, b T) bool
+	fs       FS
+	// 0 means no limit
+	maxRecordBytes int
+	// closed by Close to stop the snapshot loop
+	stop     chan struct{}
+	loopWG   sync.WaitGroup
+	closed   bool
+	watchers map[*watcher[ID, T]]struct{}
+	// by name, see AddSortedIndex
+	sortedIndexes map[string]*sortedIndex[ID, T]
+	// by field name, see AddFieldIndex
+	fieldIndexes       map[string]*fieldIndex[ID, T]
+	computedFields     map[string]func(T) any
+	tombstoneRetention time.Duration
+	onLoad             func(*T) error
+	// the data file holds length-prefixed frames instead of NDJSON lines
+	framed            bool
+	logger            *slog.Logger
+	thrashThreshold   int32
+	groupCommitWindow time.Duration
+	// see Options.WriteBufferRecords
+	writeBufferRecords int
+	writeBufferBytes   int
+	// see Options.SyncRetries
+	syncRetries      int
+	syncRetryBackoff time.Duration
+	// snapshots list records by id, not insertion order
+	deterministicSnapshot bool
+	loader                func(id ID) (T, bool, error)
+	cacheLoaded           bool
+	// see Options.CompactionTombstoneRatio; compactCh wakes the snapshot
+	// loop for a compaction
+	compactionRatio float64
+	compactCh       chan struct{}
+	// see Options.MaxSnapshotAge; snapshotCh wakes the snapshot loop for a
+	// snapshot
+	maxSnapshotAge time.Duration
+	snapshotCh     chan struct{}
+	// when the last snapshot was taken, or the store opened without one
+	lastSnapshot time.Time
+	// the clock of lastSnapshot, replaced in tests
+	now func() time.Time
+	// see Options.AppendOnly
+	appendOnly bool
+	// snapshots the store instead of its own loop when set
+	scheduler *Scheduler
+	// offline payloads superseded by an update since the data file was
+	// last rewritten
+	superseded int
+	// tombstones kept by the last compaction for TombstoneRetention
+	retained int
+	// workers evaluating the predicates of Get; see Options.GetParallelism
+	getParallelism int
+	// Open applies residency once the records are loaded
+	residencyOnReplay bool
+	// see Options.ArchiveFunc; archivedCount counts the archived records
+	// within offlineCount
+	archiveFn     func(T) bool
+	archiveFile   File
+	archiveWindow *archiveWindow
+	archivedCount int
+	// offline files replaced by clear, see retire
+	retired []File
+	// see Options.VerifyOffload
+	verifyOffload bool
+	// offline values that couldn't be read, see Stats
+	readErrors uint64
+	// the result of the last snapshot, see Stats
+	snapshotErr error
+	// written to the snapshot and the WAL, and checked against them on Open
+	typeSig *typeSig
+	// grouped puts applied in memory whose fsync is still awaited, by the
+	// record they wrote, in the order they were written; see WatchFrom
+	pending map[*record[T]][]*groupedPut[ID, T]
+	// the key of the store in the registry, empty when it isn't shared
+	registryKey string
+	// the options it was opened with, checked against later Opens of a
+	// shared store
+	opts Options[ID, T]
+	// the handle the snapshot loop or the Scheduler runs on
+	loop *Store[ID, T]
+	// see Options.BlobField; blobFile is nil for in-memory stores
+	blobField func(*T) *[]byte
+	blobFile  File
 }
 
 // Put inserts a record or update in case the id is already in the index.
 func (s *Store[ID, T]) Put(value T) (ID, error) {
+	_, id, _, err := s.put(value, putOptions[T]{})
+	return id, err
+}
+
+// Upsert is like Put, but when a live record already has the id of value,
+// the stored value is merge(old, value) instead of value. merge runs under
+// the store lock against the current value, loaded from disk if it is
+// offline, so read-modify-write updates need no separate Get. The merged
+// value must keep the id of value.
+func (s *Store[ID, T]) Upsert(value T, merge func(old, new T) T) (ID, error) {
+	_, id, _, err := s.put(value, putOptions[T]{merge: merge})
+	return id, err
+}
+
+// PutIfVersion is like Put, but only writes value if the record with its id
+// is at version expected, and returns the new version. Every write to a
+// record increments its version, starting from 1; expected 0 means the
+// record must not exist. A mismatch fails with ErrConflict and writes
+// nothing, so concurrent writers can do compare-and-swap without locking.
+func (s *Store[ID, T]) PutIfVersion(value T, expected uint64) (uint64, error) {
+	_, _, version, err := s.put(value, putOptions[T]{expected: &expected})
+	return version, err
+}
+
+// Version returns the version of the live record stored under id.
+func (s *Store[ID, T]) Version(id ID) (uint64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rec, ok := s.index[id]
+	if !ok {
+		return 0, false
+	}
+	return rec.version, true
+}
+
+// RecordMeta holds the times a record keeps outside of its value, see
+// Options.TrackTimestamps. A time is zero when it isn't tracked.
+type RecordMeta struct {
+	// CreatedAt is the time of the write that inserted the record.
+	CreatedAt time.Time
+	// UpdatedAt is the time of the last write of the record.
+	UpdatedAt time.Time
+}
+
+// Meta returns the timestamps of the record stored under id, and whether
+// there is one.
+func (s *Store[ID, T]) Meta(id ID) (RecordMeta, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rec, ok := s.index[id]
+	if !ok {
+		return RecordMeta{}, false
+	}
+	var m RecordMeta
+	if rec.createdAt != 0 {
+		m.CreatedAt = time.Unix(0, rec.createdAt)
+		m.UpdatedAt = time.Unix(0, rec.updatedAt)
+	}
+	return m, true
+}
+
+// PutAndGet is like Put, but also returns the value as it was stored, after
+// every checker ran.
+func (s *Store[ID, T]) PutAndGet(value T) (T, ID, error) {
+	stored, id, _, err := s.put(value, putOptions[T]{})
+	if err != nil {
+		return stored, id, err
+	}
+	return s.clone(stored), id, nil
+}
+
+// Validate runs value through the checks of a Put against the record
+// currently stored under its id, and returns the value as Put would store
+// it, or the error Put would return. Nothing is written, and neither
+// AfterWrite functions nor watchers run.
+func (s *Store[ID, T]) Validate(value T) (T, error) {
+	var zeroT T
 
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	id, err := s.idFunc(value)
 	if err != nil {
-		return id, err
+		return zeroT, fmt.Errorf("%w: %w", ErrIDFunc, err)
 	}
 
-	var current *T
+	current, err := s.current(id)
+	if err != nil {
+		return zeroT, err
+	}
 
-	if rec, ok := s.index[id]; ok {
-		tmp := rec.value
-		current = tmp
+	value2, err := s.runCheckers(current, value)
+	if err != nil {
+		return zeroT, err
+	}
+	value = *value2
+
+	s.normalize(&value)
+
+	if err := s.checkValue(value); err != nil {
+		return zeroT, err
+	}
+
+	if err := s.checkCollision(current, value); err != nil {
+		return zeroT, err
+	}
+	return s.clone(value), nil
+}
+
+// putOptions tunes a single put.
+type putOptions[T any] struct {
+	// see Upsert
+	merge func(old, new T) T
+	// see PutIfVersion
+	expected *uint64
+}
+
+func (s *Store[ID, T]) put(value T, opts putOptions[T]) (T, ID, uint64, error) {
+	s.mu.Lock()
+	stored, id, version, pending, err := s.putLocked(value, opts)
+	w := s.wal
+	s.mu.Unlock()
+
+	// with group commit, the fsync is shared with the other writers and
+	// awaited without the lock
+	if pending != nil {
+		err := w.waitSync()
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.settle(pending)
+		if err != nil {
+			s.rollbackPut(pending)
+			var zeroT T
+			return zeroT, id, version - 1, fmt.Errorf("%w: %w", ErrIO, err)
+		}
+		s.notify(EventPut, id, pending.op.Value)
+		s.runAfterWrites(pending.old, stored)
+	}
+	return stored, id, version, err
+}
+
+// groupedPut is a put applied in memory whose WAL op still awaits the group
+// commit fsync. Its watchers and AfterWrite functions run once the fsync
+// succeeds, and a failed fsync rolls it back.
+type groupedPut[ID comparable, T any] struct {
+	op *walOp[ID, T]
+	// the record the put wrote
+	rec *record[T]
+	// the value the put replaced, nil on inserts
+	old *T
+	// what rollbackPut restores: the record the index held before the put,
+	// and the fields the put changed
+	prev             *record[T]
+	created, updated int64
+	blob             blobRef
+}
+
+// rollbackPut undoes in memory a put whose group commit fsync failed, like
+// a put that fails its own fsync is never applied. A put already
+// superseded by a later write of its id is left alone. It runs under s.mu.
+func (s *Store[ID, T]) rollbackPut(g *groupedPut[ID, T]) {
+	id := g.op.ID
+	rec, ok := s.index[id]
+	if !ok || rec.version != g.op.Version {
+		return
+	}
+	if g.old == nil || s.appendOnly {
+		s.tombstone(id, rec)
+		if g.prev != nil {
+			// the earlier record of an append-only id is the latest again
+			s.index[id] = g.prev
+			s.indexPut(id, *g.old)
+		}
+		return
+	}
+	s.addOrUpdate(id, g.old)
+	rec.version = g.op.Version - 1
+	rec.createdAt, rec.updatedAt = g.created, g.updated
+	rec.blob = g.blob
+}
+
+// settle drops g from the pending puts once its fsync returned. It runs
+// under s.mu.
+func (s *Store[ID, T]) settle(g *groupedPut[ID, T]) {
+	gs := slices.DeleteFunc(s.pending[g.rec], func(p *groupedPut[ID, T]) bool { return p == g })
+	if len(gs) == 0 {
+		delete(s.pending, g.rec)
+	} else {
+		s.pending[g.rec] = gs
+	}
+}
+
+// putLocked runs a put under s.mu, and returns the put when its WAL op
+// still awaits a group commit fsync.
+func (s *Store[ID, T]) putLocked(value T, opts putOptions[T]) (T, ID, uint64, *groupedPut[ID, T], error) {
+	var zeroT T
+
+	if s.readOnly {
+		var zero ID
+		return zeroT, zero, 0, nil, ErrReadOnly
+	}
+
+	id, err := s.idFunc(value)
+	if err != nil {
+		return zeroT, id, 0, nil, fmt.Errorf("%w: %w", ErrIDFunc, err)
+	}
+
+	version := s.version(id)
+	if opts.expected != nil && *opts.expected != version {
+		return zeroT, id, version, nil, fmt.Errorf("%w: %v is at version %d, expected %d", ErrConflict, id, version, *opts.expected)
+	}
+
+	current, err := s.current(id)
+	if err != nil {
+		return zeroT, id, version, nil, err
+	}
+
+	if opts.merge != nil && current != nil {
+		value = opts.merge(s.clone(*current), value)
+		merged, err := s.idFunc(value)
+		if err != nil {
+			return zeroT, id, version, nil, fmt.Errorf("%w: %w", ErrIDFunc, err)
+		}
+		if merged != id {
+			return zeroT, id, version, nil, fmt.Errorf("flea: merge changed the id from %v to %v", id, merged)
+		}
 	}
 
 	value2, err := s.runCheckers(current, value)
 
 	if err != nil {
-		return id, err
+		return zeroT, id, version, nil, err
 	}
 
 	if value2 != nil {
 		value = *value2
 	}
 
-	if err = s.wal.append(
-		[]walOp[ID, T]{
-			{
-				Op:    opPut,
-				ID:    id,
-				Value: value,
-			},
-		}); err != nil {
+	s.normalize(&value)
+
+	if err := s.checkValue(value); err != nil {
+		return zeroT, id, version, nil, err
+	}
+
+	if err := s.checkCollision(current, value); err != nil {
+		return zeroT, id, version, nil, err
+	}
+
+	if s.unchanged(current, value) {
+		return *current, id, version, nil, nil
+	}
+
+	ops := []walOp[ID, T]{
+		{
+			Op:      opPut,
+			ID:      id,
+			Value:   value,
+			Version: version + 1,
+		},
+	}
+	s.stamp(&ops[0], time.Now().UnixNano())
+	grouped := s.wal != nil && s.wal.group != nil
+	if grouped {
+		var logged []walOp[ID, T]
+		logged, err = s.walOps(ops)
+		if err == nil {
+			err = s.wal.write(logged)
+			if err != nil {
+				err = fmt.Errorf("%w: %w", ErrIO, err)
+			}
+		}
+	} else {
+		err = s.appendWAL(ops)
+	}
+	if err != nil {
 		var zero ID
-		return zero, err
+		return zeroT, zero, version, nil, err
 	}
 
-	s.addOrUpdate(id, &value)
+	if !grouped {
+		s.commitPut(&ops[0])
+		s.runAfterWrites(current, value)
+		s.handleResidency()
+		return value, id, version + 1, nil, nil
+	}
 
+	g := &groupedPut[ID, T]{op: &ops[0], old: current, prev: s.index[id]}
+	if g.prev != nil {
+		g.created, g.updated, g.blob = g.prev.createdAt, g.prev.updatedAt, g.prev.blob
+	}
+	s.applyPut(g.op)
+	g.rec = s.index[id]
+	if s.pending == nil {
+		s.pending = make(map[*record[T]][]*groupedPut[ID, T])
+	}
+	s.pending[g.rec] = append(s.pending[g.rec], g)
 	s.handleResidency()
+	return value, id, version + 1, g, nil
+}
 
-	return id, nil
+// PutAll writes values as a single batch. If any value fails its IDFunc or
+// checkers, a *BatchError carrying its index is returned and nothing is written.
+func (s *Store[ID, T]) PutAll(values []T) ([]ID, error) {
+	results, err := s.putAll(values)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]ID, len(results))
+	for i, r := range results {
+		ids[i] = r.ID
+	}
+	return ids, nil
+}
 
+// PutResult describes how PutAllEx stored one value of its batch.
+type PutResult[ID comparable, T any] struct {
+	ID ID
+	// Inserted reports that no record had the id before the value, neither
+	// in the store nor earlier in the batch.
+	Inserted bool
+	// Value is the value as it was stored, after every checker ran.
+	Value T
 }
 
-func (s *Store[ID, T]) PutAll(values []T) ([]ID, error) {
+// PutAllEx is like PutAll, but returns a PutResult for every value, in the
+// order of values, so callers can tell inserts from updates.
+func (s *Store[ID, T]) PutAllEx(values []T) ([]PutResult[ID, T], error) {
+	results, err := s.putAll(values)
+	if err != nil {
+		return nil, err
+	}
+	for i := range results {
+		results[i].Value = s.clone(results[i].Value)
+	}
+	return results, nil
+}
 
+func (s *Store[ID, T]) putAll(values []T) ([]PutResult[ID, T], error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	if s.readOnly {
+		return nil, ErrReadOnly
+	}
+
 	pending := make([]walOp[ID, T], 0, len(values))
-	ids := make([]ID, 0, len(values))
+	results := make([]PutResult[ID, T], 0, len(values))
+	olds := make([]*T, 0, len(values))
+	staged := make(map[ID]T)
+	versions := make(map[ID]uint64)
+	now := time.Now().UnixNano()
 
-	for _, value := range values {
+	for i, value := range values {
 		id, err := s.idFunc(value)
 		if err != nil {
-			return []ID{id}, err
+			return nil, &BatchError{Index: i, Err: fmt.Errorf("%w: %w", ErrIDFunc, err)}
 		}
 
-		var current *T
-
-		if rec, ok := s.index[id]; ok {
-			tmp := rec.value
-			current = tmp
+		current, err := s.current(id)
+		if err != nil {
+			return nil, &BatchError{Index: i, Err: err}
+		}
+		if prev, ok := staged[id]; ok {
+			current = &prev
 		}
 
-		_, err = s.runCheckers(current, value)
+		value2, err := s.runCheckers(current, value)
 
 		if err != nil {
-			return []ID{id}, err
+			return nil, &BatchError{Index: i, Err: err}
 		}
 
-		pending = append(pending, walOp[ID, T]{
-			Op:    opPut,
-			ID:    id,
-			Value: value,
-		})
+		if value2 != nil {
+			value = *value2
+		}
+
+		s.normalize(&value)
 
-		ids = append(ids, id)
+		if err := s.checkValue(value); err != nil {
+			return nil, &BatchError{Index: i, Err: err}
+		}
+
+		if err := s.checkCollision(current, value); err != nil {
+			return nil, &BatchError{Index: i, Err: err}
+		}
+		results = append(results, PutResult[ID, T]{ID: id, Inserted: current == nil, Value: value})
+		if s.unchanged(current, value) {
+			continue
+		}
+		staged[id] = value
+		olds = append(olds, current)
+		version, ok := versions[id]
+		if !ok {
+			version = s.version(id)
+		}
+		versions[id] = version + 1
 
+		pending = append(pending, walOp[ID, T]{
+			Op:      opPut,
+			ID:      id,
+			Value:   value,
+			Version: version + 1,
+		})
+		s.stamp(&pending[len(pending)-1], now)
 	}
 	// Phase 2: commit
-	if err := s.wal.append(pending); err != nil {
+	if err := s.appendWAL(pending); err != nil {
 		return nil, err
 	}
-	for _, p := range pending {
-		s.addOrUpdate(p.ID, &p.Value)
+	for i := range pending {
+		s.commitPut(&pending[i])
+		s.runAfterWrites(olds[i], pending[i].Value)
 	}
 
 	s.handleResidency()
 
-	return ids, nil
+	return results, nil
 }
 
+// Get returns every live value matching p, in insertion order. A nil p
+// matches every value, online and offline. Archived records are skipped,
+// see GetWithArchive.
+//
+// Get returns nil when an offline record can't be read, like when nothing
+// matches: use GetE to tell the two apart, or watch Stats.ReadErrors.
 func (s *Store[ID, T]) Get(p Predicate[T]) []T {
-	if p == nil {
+	results, err := s.GetE(p)
+	if err != nil {
 		return nil
 	}
+	return results
+}
+
+// GetE is like Get, but returns the error that made the query fail instead
+// of an empty result, such as an ErrIO reading an offline record.
+func (s *Store[ID, T]) GetE(p Predicate[T]) ([]T, error) {
+	if p == nil {
+		p = matchAll[T]
+	}
+
+	return s.GetFunc(func(v T) (bool, error) {
+		return p(v), nil
+	})
+}
+
+// GetAll returns every live value in insertion order, in a slice sized
+// exactly to Len, less the archived records it skips like Get. Like Get, it
+// returns nil if an offline record can't be read.
+func (s *Store[ID, T]) GetAll() []T {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	s.checkSnapshotAge()
 
-	results := make([]T, 0, len(s.records))
-
-	var v T
+	results := make([]T, 0, s.onlineCount+s.offlineCount-s.archivedCount)
 
 	for _, rec := range s.records {
-		if rec.deleted {
+		if rec.deleted || rec.archived {
 			continue
 		}
 
-		if rec.value != nil {
-			v = *rec.value
-		} else {
-			loaded, err := s.loadFromDisk(rec.offset, rec.size)
-			if err != nil {
-				return nil
-			}
-			v = loaded
+		if !rec.offloaded {
+			results = append(results, s.clone(*rec.value))
+			continue
 		}
 
-		if p(v) {
-			results = append(results, v)
+		v, err := s.loadFromDisk(rec.offset, rec.size)
+		if err != nil {
+			return nil
 		}
+		results = append(results, v)
 	}
 
 	return results
 }
 
-// Return the value if exists, a bool representing if the value exists or not, and an error if something goes wrong.
-func (s *Store[ID, T]) GetByID(id ID) (T, bool, error) {
-	var v T
-	rec, ok := s.index[id]
-	if !ok || rec.deleted {
-		return v, false, nil
+// GetWithTimeout is like Get, but gives up once d has elapsed. On timeout it
+// returns the matches collected so far together with
+// context.DeadlineExceeded; a nil error means the results are complete.
+// A nil p matches every value.
+func (s *Store[ID, T]) GetWithTimeout(p Predicate[T], d time.Duration) ([]T, error) {
+	if p == nil {
+		p = matchAll[T]
 	}
+	deadline := time.Now().Add(d)
 
-	if rec.value != nil {
-		v = *rec.value
-		return v, true, nil
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var results []T
+
+	for _, rec := range s.records {
+		if time.Now().After(deadline) {
+			return results, context.DeadlineExceeded
+		}
+
+		if rec.deleted || rec.archived {
+			continue
+		}
+
+		v, err := s.valueOf(rec)
+		if err != nil {
+			return results, err
+		}
+
+		ok, err := callPredicate(p, v)
+		if err != nil {
+			return results, err
+		}
+		if ok {
+			if !rec.offloaded {
+				v = s.clone(v)
+			}
+			results = append(results, v)
+		}
 	}
 
-	// carregar do disco
-	loaded, err := s.loadFromDisk(rec.offset, rec.size)
+	return results, nil
+}
+
+// GetFunc is like Get, but the predicate can fail. The first predicate
+// error aborts the query and is returned, together with any I/O error
+// reading offline records.
+func (s *Store[ID, T]) GetFunc(p func(T) (bool, error)) ([]T, error) {
+	return s.getFunc(p, false, false)
+}
+
+// GetSorted returns the values matching p ordered by less. The sort is
+// stable, so values less doesn't tell apart keep their insertion order.
+//
+// Every match is loaded in memory before sorting, offline ones included, so
+// a broad predicate costs as much memory as GetAll. A nil p matches every
+// value.
+func (s *Store[ID, T]) GetSorted(p Predicate[T], less func(a, b T) bool) ([]T, error) {
+	if p == nil {
+		p = matchAll[T]
+	}
+	results, err := s.getFunc(func(v T) (bool, error) {
+		return p(v), nil
+	}, false, false)
 	if err != nil {
-		return v, false, err
+		return nil, err
 	}
-
-	v = loaded
-	return v, true, nil
+	slices.SortStableFunc(results, func(a, b T) int {
+		switch {
+		case less(a, b):
+			return -1
+		case less(b, a):
+			return 1
+		}
+		return 0
+	})
+	return results, nil
 }
 
-func (s *Store[ID, T]) Delete(p Predicate[T]) ([]T, error) {
+// GetByPrefix returns the values of a string-keyed store whose id starts
+// with prefix, ordered by id, e.g. every "tenant:123:" record. Archived
+// records are included, like in GetByID.
+//
+// There is no index over ids, so every id of the store is compared with
+// prefix: the cost grows with Len, not with the number of matches. Only
+// the matching records are read from disk.
+func GetByPrefix[ID ~string, T any](s *Store[ID, T], prefix string) ([]T, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	var out []T
-	for idx, rec := range s.index {
-		if !rec.deleted && p(*rec.value) {
-			err := s.wal.append([]walOp[ID, T]{{Op: opDelete, ID: idx}})
-			if err != nil {
-				return nil, err
-			}
-			rec.deleted = true
-			delete(s.index, idx)
-			out = append(out, *rec.value)
-			s.dirty = true
+	var ids []ID
+	for id := range s.index {
+		if strings.HasPrefix(string(id), prefix) {
+			ids = append(ids, id)
 		}
 	}
-	return out, nil
-}
+	slices.Sort(ids)
 
-func Open[ID comparable, T any](opts Options[ID, T]) (*Store[ID, T], error) {
+	results := make([]T, 0, len(ids))
+	for _, id := range ids {
+		rec := s.index[id]
+		v, err := s.valueOf(rec)
+		if err != nil {
+			return nil, err
+		}
+		if !rec.offloaded {
+			v = s.clone(v)
+		}
+		results = append(results, v)
+	}
+	return results, nil
+}
 
-	if err := opts.Validate(); err != nil {
+// GetSortedBy is like GetSorted, ordering the matches by ascending key.
+func GetSortedBy[ID comparable, T any, K cmp.Ordered](s *Store[ID, T], p Predicate[T], key func(T) K) ([]T, error) {
+	if p == nil {
+		p = matchAll[T]
+	}
+	results, err := s.getFunc(func(v T) (bool, error) {
+		return p(v), nil
+	}, false, false)
+	if err != nil {
 		return nil, err
 	}
+	slices.SortStableFunc(results, func(a, b T) int {
+		return cmp.Compare(key(a), key(b))
+	})
+	return results, nil
+}
 
-	s := &Store[ID, T]{
-		dir:         opts.Dir,
-		idFunc:      opts.IDFunc,
-		index:       make(map[ID]*record[T]),
-		checkers:    opts.Checkers,
-		residencyFn: opts.ResidencyFunc,
-		maxInMemory: *opts.MaxInMemoryRecords,
-		dataWindow:  &dataWindow{},
+// Select returns project(v) for every live value v matching p, in insertion
+// order, skipping archived records like Get. Values are handed to project
+// without being cloned, so list endpoints pay only for the fields they
+// keep: project must not keep v, and the pointers, maps and slices it
+// returns are shared with the store.
+//
+// A nil p matches every value. Like GetE, Select returns the first error
+// reading an offline record or evaluating p.
+func Select[ID comparable, T any, R any](s *Store[ID, T], p Predicate[T], project func(T) R) ([]R, error) {
+	if p == nil {
+		p = matchAll[T]
 	}
 
-	s.makeDirs()
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	s.handleDataFile(s.residencyFn)
+	var results []R
+	for _, rec := range s.records {
+		if rec.deleted || rec.archived {
+			continue
+		}
 
-	if err := s.loadSnapshot(); err != nil {
-		return nil, err
+		v, err := s.valueOf(rec)
+		if err != nil {
+			return nil, err
+		}
+
+		ok, err := callPredicate(p, v)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			results = append(results, project(v))
+		}
 	}
+	return results, nil
+}
 
-	if err := s.replayWAL(); err != nil {
-		return nil, err
+func matchAll[T any](T) bool { return true }
+
+// callPredicate calls p on v, turning a panic into an ErrPredicatePanic so
+// that a bad predicate fails its query instead of the process.
+func callPredicate[T any](p Predicate[T], v T) (ok bool, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%w: %v", ErrPredicatePanic, r)
+		}
+	}()
+	return p(v), nil
+}
+
+// callPredicateFunc is callPredicate for predicates that can fail.
+func callPredicateFunc[T any](p func(T) (bool, error), v T) (ok bool, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%w: %v", ErrPredicatePanic, r)
+		}
+	}()
+	return p(v)
+}
+
+// GetAny is like Get, but with includeDeleted it also returns the deleted
+// records that were not compacted yet, in their insertion slot. It is meant
+// for audit and debugging; what it returns for deleted records depends on
+// when the last snapshot or Compact ran.
+func (s *Store[ID, T]) GetAny(p Predicate[T], includeDeleted bool) []T {
+	if p == nil {
+		p = matchAll[T]
 	}
 
-	w, err := openWAL[ID, T](s.getWalPath())
+	results, err := s.getFunc(func(v T) (bool, error) {
+		return p(v), nil
+	}, includeDeleted, false)
 	if err != nil {
-		return nil, err
+		return nil
 	}
-	s.wal = w
+	return results
+}
 
-	if _, err := os.Stat(s.getDataPath()); err == nil {
-		s.hasOfflineData = true
+// GetWithArchive is like GetFunc, but also evaluates p on the archived
+// records, decompressing them from the archive; see Options.ArchiveFunc.
+func (s *Store[ID, T]) GetWithArchive(p Predicate[T]) ([]T, error) {
+	if p == nil {
+		p = matchAll[T]
 	}
-
-	go s.snapshotLoop(opts.SnapshotInterval)
-
-	return s, nil
+	return s.getFunc(func(v T) (bool, error) {
+		return p(v), nil
+	}, false, true)
 }
 
-func (s *Store[ID, T]) Close() error {
+func (s *Store[ID, T]) getFunc(p func(T) (bool, error), includeDeleted, includeArchive bool) ([]T, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	s.checkSnapshotAge()
 
-	if s.wal != nil {
-		return s.wal.close()
+	if s.getParallelism > 1 && len(s.records) >= 2*minParallelChunk {
+		return s.getParallel(p, includeDeleted, includeArchive)
 	}
-	return nil
-}
 
-func (s *Store[ID, T]) addOrUpdate(id ID, value *T) {
-	if rec, ok := s.index[id]; ok {
+	results := make([]T, 0, len(s.records))
+
+	// records keep their slot in s.records when they change tier, so a
+	// single pass yields insertion order across memory and disk
+	for _, rec := range s.records {
+		if rec.deleted && !includeDeleted {
+			continue
+		}
+		if rec.archived && !includeArchive {
+			continue
+		}
+
+		v, err := s.valueOf(rec)
+		if err != nil {
+			return nil, err
+		}
+
+		ok, err := callPredicateFunc(p, v)
+		if err != nil {
+			return nil, err
+		}
+
+		if ok {
+			if !rec.offloaded {
+				v = s.clone(v)
+			}
+			results = append(results, v)
+		}
+	}
+
+	return results, nil
+}
+
+// minParallelChunk is the fewest values a worker of getParallel evaluates,
+// so small stores don't pay for goroutines they don't need.
+const minParallelChunk = 256
+
+// getParallel is getFunc spreading the predicate calls over
+// getParallelism workers. Values are read, and online ones cloned, before
+// any worker starts, so workers never touch the records or the data file.
+// It runs under s.mu.
+func (s *Store[ID, T]) getParallel(p func(T) (bool, error), includeDeleted, includeArchive bool) ([]T, error) {
+	values := make([]T, 0, len(s.records))
+	for _, rec := range s.records {
+		if rec.deleted && !includeDeleted {
+			continue
+		}
+		if rec.archived && !includeArchive {
+			continue
+		}
+		v, err := s.valueOf(rec)
+		if err != nil {
+			return nil, err
+		}
+		if !rec.offloaded {
+			v = s.clone(v)
+		}
+		values = append(values, v)
+	}
+
+	workers := min(s.getParallelism, len(values)/minParallelChunk)
+	if workers < 1 {
+		workers = 1
+	}
+	chunk := (len(values) + workers - 1) / workers
+	matched := make([]bool, len(values))
+	errs := make([]error, workers)
+
+	var wg sync.WaitGroup
+	for w := range workers {
+		lo, hi := w*chunk, min((w+1)*chunk, len(values))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := lo; i < hi; i++ {
+				ok, err := callPredicateFunc(p, values[i])
+				if err != nil {
+					errs[w] = err
+					return
+				}
+				matched[i] = ok
+			}
+		}()
+	}
+	wg.Wait()
+
+	// the error of the earliest value wins, like in a sequential scan
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	results := values[:0]
+	for i, v := range values {
+		if matched[i] {
+			results = append(results, v)
+		}
+	}
+	return results, nil
+}
+
+// ForEach calls fn for every live value in insertion order, stopping at the
+// first error, which is returned.
+//
+// The store lock is only held to capture the records, so writers are not
+// blocked while fn runs and fn may call back into the store, except for
+// Compact. ForEach sees the store as it was when it started: later writes
+// and deletes are not reflected. Snapshots and Compact wait for ForEach to
+// return.
+func (s *Store[ID, T]) ForEach(fn func(T) error) error {
+	s.snapMu.Lock()
+	defer s.snapMu.Unlock()
+
+	s.mu.Lock()
+	entries := make([]snapshotEntry[T], 0, s.onlineCount+s.offlineCount)
+	for _, rec := range s.records {
+		if rec.deleted {
+			continue
+		}
+		entries = append(entries, entryOf(rec))
+	}
+	files := s.offlineReader()
+	s.mu.Unlock()
+
+	return s.visit(entries, files, fn)
+}
+
+// ForEachOffline is like ForEach, but only visits the live offline records,
+// straight from the data file and by ascending offset; in-memory records
+// are never touched. It is meant for tooling that reconciles the data file,
+// e.g. to build an external index or to check what was offloaded.
+func (s *Store[ID, T]) ForEachOffline(fn func(T) error) error {
+	s.snapMu.Lock()
+	defer s.snapMu.Unlock()
+
+	s.mu.Lock()
+	entries := make([]snapshotEntry[T], 0, s.offlineCount)
+	for _, rec := range s.records {
+		if rec.deleted || !rec.offloaded || rec.archived {
+			continue
+		}
+		entries = append(entries, entryOf(rec))
+	}
+	files := s.offlineReader()
+	s.mu.Unlock()
+
+	slices.SortFunc(entries, func(a, b snapshotEntry[T]) int {
+		return cmp.Compare(a.offset, b.offset)
+	})
+	return s.visit(entries, files, fn)
+}
+
+// visit calls fn with the value of every entry, reading offline ones with
+// files. It runs without s.mu, under snapMu.
+func (s *Store[ID, T]) visit(entries []snapshotEntry[T], files *offlineReader, fn func(T) error) error {
+	var zero T
+	// s.scratch needs s.mu, so offline values get a scratch of their own
+	scratch := new(T)
+	for _, e := range entries {
+		var v T
+		if !e.offloaded {
+			v = s.clone(*e.value)
+		} else {
+			buf, err := files.read(e.archived, e.member, e.offset, e.size)
+			if err != nil {
+				return err
+			}
+			*scratch = zero
+			if err := s.decode(buf, scratch); err != nil {
+				return err
+			}
+			v = *scratch
+		}
+		if err := fn(v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Return the value if exists, a bool representing if the value exists or not, and an error if something goes wrong.
+// An id the store doesn't hold is looked up with the Loader, if any.
+func (s *Store[ID, T]) GetByID(id ID) (T, bool, error) {
+	v, ok, err := s.getByID(id)
+	if ok || err != nil || s.loader == nil {
+		return v, ok, err
+	}
+	return s.loadThrough(id)
+}
+
+func (s *Store[ID, T]) getByID(id ID) (T, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.checkSnapshotAge()
+
+	var v T
+	rec, ok := s.index[id]
+	if !ok || rec.deleted {
+		return v, false, nil
+	}
+
+	if !rec.offloaded {
+		v = s.clone(*rec.value)
+		return v, true, nil
+	}
+
+	// carregar do disco
+	loaded, err := s.valueOf(rec)
+	if err != nil {
+		return v, false, err
+	}
+
+	v = loaded
+	return v, true, nil
+}
+
+// loadThrough reads id through the Loader, without the store lock, and with
+// CacheLoaded stores what it finds.
+func (s *Store[ID, T]) loadThrough(id ID) (T, bool, error) {
+	v, ok, err := s.loader(id)
+	if err != nil || !ok {
+		return v, false, err
+	}
+	if s.cacheLoaded && !s.readOnly {
+		stored, err := s.Put(v)
+		if err != nil {
+			return v, false, err
+		}
+		if stored != id {
+			return v, false, fmt.Errorf("flea: Loader returned a value for %v when asked for %v", stored, id)
+		}
+	}
+	return v, true, nil
+}
+
+// GetOneByID returns the value stored under id, or ErrNotFound when there
+// is none, for callers that prefer a single error to GetByID's found flag.
+func (s *Store[ID, T]) GetOneByID(id ID) (T, error) {
+	v, ok, err := s.GetByID(id)
+	if err != nil {
+		return v, err
+	}
+	if !ok {
+		return v, fmt.Errorf("%w: %v", ErrNotFound, id)
+	}
+	return v, nil
+}
+
+// GetByIDOrDefault returns the value stored under id, or def when there is
+// none. An error reading an offline record is treated as a miss, so use
+// GetByID when the two must be told apart.
+func (s *Store[ID, T]) GetByIDOrDefault(id ID, def T) T {
+	v, ok, err := s.GetByID(id)
+	if err != nil || !ok {
+		return def
+	}
+	return v
+}
+
+// Delete deletes every record matching p and returns the deleted values. A
+// veto from a delete checker aborts it before anything is deleted, and all
+// deletes are persisted with a single WAL append.
+func (s *Store[ID, T]) Delete(p Predicate[T]) ([]T, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.readOnly {
+		return nil, ErrReadOnly
+	}
+	if s.appendOnly {
+		return nil, ErrAppendOnly
+	}
+
+	type match struct {
+		id  ID
+		rec *record[T]
+		v   T
+	}
+
+	var matches []match
+	for idx, rec := range s.index {
+		if rec.deleted {
+			continue
+		}
+		v, err := s.valueOf(rec)
+		if err != nil {
+			return nil, err
+		}
+		ok, err := callPredicate(p, v)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			if err := s.runDeleteCheckers(v); err != nil {
+				return nil, err
+			}
+			matches = append(matches, match{id: idx, rec: rec, v: v})
+		}
+	}
+
+	if len(matches) == 0 {
+		return nil, nil
+	}
+
+	// one WAL append for the whole batch, like PutAll
+	ops := make([]walOp[ID, T], len(matches))
+	for i, m := range matches {
+		ops[i] = walOp[ID, T]{Op: opDelete, ID: m.id}
+	}
+	if err := s.appendWAL(ops); err != nil {
+		return nil, err
+	}
+
+	out := make([]T, 0, len(matches))
+	for _, m := range matches {
+		s.tombstone(m.id, m.rec)
+		s.notify(EventDelete, m.id, m.v)
+		out = append(out, m.v)
+	}
+	return out, nil
+}
+
+// DeleteWhere deletes up to limit records matching p, in insertion order,
+// and returns how many were removed. A limit of 0 means unlimited.
+//
+// Matching records are looked up in memory and in offline storage, and all
+// deletes are persisted with a single WAL append.
+func (s *Store[ID, T]) DeleteWhere(p Predicate[T], limit int) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.readOnly {
+		return 0, ErrReadOnly
+	}
+	if s.appendOnly {
+		return 0, ErrAppendOnly
+	}
+
+	ids := make(map[*record[T]]ID, len(s.index))
+	for id, rec := range s.index {
+		ids[rec] = id
+	}
+
+	var ops []walOp[ID, T]
+	var recs []*record[T]
+	var vals []T
+
+	for _, rec := range s.records {
+		if limit > 0 && len(ops) == limit {
+			break
+		}
+		id, live := ids[rec]
+		if !live || rec.deleted {
+			continue
+		}
+		v, err := s.valueOf(rec)
+		if err != nil {
+			return 0, err
+		}
+		ok, err := callPredicate(p, v)
+		if err != nil {
+			return 0, err
+		}
+		if !ok {
+			continue
+		}
+		if err := s.runDeleteCheckers(v); err != nil {
+			return 0, err
+		}
+		ops = append(ops, walOp[ID, T]{Op: opDelete, ID: id})
+		recs = append(recs, rec)
+		vals = append(vals, v)
+	}
+
+	if len(ops) == 0 {
+		return 0, nil
+	}
+
+	if err := s.appendWAL(ops); err != nil {
+		return 0, err
+	}
+
+	for i, op := range ops {
+		s.tombstone(op.ID, recs[i])
+		s.notify(EventDelete, op.ID, vals[i])
+	}
+
+	return len(ops), nil
+}
+
+// DeleteAll deletes every record with a single WAL append and returns how
+// many there were. Delete checkers still run, and any veto aborts it. The
+// space is reclaimed right away, tombstones included, so deleted records
+// can't be restored.
+func (s *Store[ID, T]) DeleteAll() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.readOnly {
+		return 0, ErrReadOnly
+	}
+
+	type deleted struct {
+		id ID
+		v  T
+	}
+
+	var events []deleted
+	if len(s.deleteCheckers) > 0 || len(s.watchers) > 0 {
+		for _, rec := range s.records {
+			if rec.deleted {
+				continue
+			}
+			v, err := s.valueOf(rec)
+			if err != nil {
+				return 0, err
+			}
+			if err := s.runDeleteCheckers(v); err != nil {
+				return 0, err
+			}
+			id, err := s.idFunc(v)
+			if err != nil {
+				return 0, fmt.Errorf("%w: %w", ErrIDFunc, err)
+			}
+			events = append(events, deleted{id: id, v: v})
+		}
+	}
+
+	n := s.onlineCount + s.offlineCount
+	if err := s.appendWAL([]walOp[ID, T]{{Op: opClear}}); err != nil {
+		return 0, err
+	}
+	if err := s.clear(); err != nil {
+		return n, err
+	}
+
+	for _, e := range events {
+		s.notify(EventDelete, e.id, e.v)
+	}
+	return n, nil
+}
+
+// clear drops every record and empties the data file.
+func (s *Store[ID, T]) clear() error {
+	s.records = nil
+	s.index = make(map[ID]*record[T])
+	s.onlineCount = 0
+	s.offlineCount = 0
+	s.archivedCount = 0
+	s.dirty = false
+	s.superseded = 0
+	s.retained = 0
+	s.resetIndexes()
+
+	if s.archiveFile != nil {
+		f, err := s.emptyFile(s.getArchivePath())
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrIO, err)
+		}
+		s.retire(s.archiveFile)
+		s.archiveFile = f
+		s.archiveWindow = &archiveWindow{}
+	}
+	if s.dataFile == nil {
+		return nil
+	}
+	f, err := s.emptyFile(s.getDataPath())
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrIO, err)
+	}
+	s.retire(s.dataFile)
+	s.dataFile = f
+	s.dataWindow = &dataWindow{}
+	return nil
+}
+
+// retire closes a replaced offline file once no offlineReader can be
+// reading it: right away when snapMu is free, otherwise when the next
+// reader is made. It runs under s.mu.
+func (s *Store[ID, T]) retire(f File) {
+	s.retired = append(s.retired, f)
+	if s.snapMu.TryLock() {
+		s.closeRetired()
+		s.snapMu.Unlock()
+	}
+}
+
+// closeRetired closes the files passed to retire. It runs under s.mu, with
+// snapMu held or no longer needed.
+func (s *Store[ID, T]) closeRetired() {
+	for _, f := range s.retired {
+		f.Close()
+	}
+	s.retired = nil
+}
+
+// Restore brings back the most recent deleted record stored under id, as
+// long as compaction has not dropped it yet; see Options.TombstoneRetention.
+// It reports false when there is nothing to restore, or when id has been
+// written again since the delete.
+func (s *Store[ID, T]) Restore(id ID) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.readOnly {
+		return false, ErrReadOnly
+	}
+	if s.appendOnly {
+		return false, ErrAppendOnly
+	}
+	if _, ok := s.index[id]; ok {
+		return false, nil
+	}
+
+	for i := len(s.records) - 1; i >= 0; i-- {
+		rec := s.records[i]
+		if !rec.deleted {
+			continue
+		}
+		v, err := s.valueOf(rec)
+		if err != nil {
+			return false, err
+		}
+		recID, err := s.idFunc(v)
+		if err != nil || recID != id {
+			continue
+		}
+
+		if err := s.appendWAL([]walOp[ID, T]{{Op: opPut, ID: id, Value: v, Version: rec.version, Created: rec.createdAt, Updated: rec.updatedAt, blob: rec.blob}}); err != nil {
+			return false, err
+		}
+
+		rec.deleted = false
+		rec.deletedAt = 0
+		s.index[id] = rec
+		if !rec.offloaded {
+			s.onlineCount++
+		} else {
+			s.offlineCount++
+		}
+		if rec.archived {
+			s.archivedCount++
+		}
+		s.indexPut(id, v)
+		s.notify(EventPut, id, v)
+		return true, nil
+	}
+	return false, nil
+}
+
+func Open[ID comparable, T any](opts Options[ID, T]) (*Store[ID, T], error) {
+
+	s, err := newStore(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.shared() {
+		shared, err := openShared(s)
+		if err != nil || shared != s {
+			return shared, err
+		}
+	} else if err := s.openStorage(); err != nil {
+		return nil, err
+	}
+
+	if s.wal != nil {
+		s.startSnapshots()
+	}
+
+	return s, nil
+}
+
+func newStore[ID comparable, T any](opts Options[ID, T]) (*Store[ID, T], error) {
+
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
+	if opts.StrictEncoding {
+		if err := checkRoundTrip(reflect.TypeFor[T]()); err != nil {
+			return nil, err
+		}
+	}
+
+	s := &Store[ID, T]{storeState: &storeState[ID, T]{
+		opts:                  opts,
+		dir:                   opts.Dir,
+		idFunc:                opts.IDFunc,
+		index:                 make(map[ID]*record[T]),
+		checkers:              opts.Checkers,
+		deleteCheckers:        opts.DeleteCheckers,
+		afterWrites:           opts.AfterWrite,
+		onIDCollision:         opts.OnIDCollision,
+		cloneFn:               opts.CloneFunc,
+		onReplayProgress:      opts.OnReplayProgress,
+		residencyFn:           opts.ResidencyFunc,
+		maxInMemory:           *opts.MaxInMemoryRecords,
+		dataWindow:            &dataWindow{},
+		readOnly:              opts.ReadOnly,
+		inMemory:              opts.InMemory,
+		snapshotInterval:      opts.SnapshotInterval,
+		keepRecentWrites:      opts.KeepRecentWritesOnline,
+		trackTimestamps:       opts.TrackTimestamps,
+		verifySnapshot:        opts.VerifySnapshot,
+		tempDir:               opts.TempDir,
+		checkFloats:           hasFloats(reflect.TypeFor[T]()),
+		hasTimes:              hasInlineTimes(reflect.TypeFor[T]()),
+		equal:                 opts.Equal,
+		fs:                    opts.FS,
+		maxRecordBytes:        opts.MaxRecordBytes,
+		tombstoneRetention:    opts.TombstoneRetention,
+		onLoad:                opts.OnLoad,
+		framed:                opts.FramedDataFile,
+		logger:                opts.Logger,
+		thrashThreshold:       int32(opts.ThrashThreshold),
+		groupCommitWindow:     opts.GroupCommitWindow,
+		writeBufferRecords:    opts.WriteBufferRecords,
+		writeBufferBytes:      opts.WriteBufferBytes,
+		syncRetries:           opts.SyncRetries,
+		syncRetryBackoff:      opts.SyncRetryBackoff,
+		deterministicSnapshot: opts.DeterministicSnapshot,
+		loader:                opts.Loader,
+		cacheLoaded:           opts.CacheLoaded,
+		compactionRatio:       opts.CompactionTombstoneRatio,
+		compactCh:             make(chan struct{}, 1),
+		maxSnapshotAge:        opts.MaxSnapshotAge,
+		snapshotCh:            make(chan struct{}, 1),
+		now:                   time.Now,
+		scheduler:             opts.Scheduler,
+		appendOnly:            opts.AppendOnly,
+		getParallelism:        opts.GetParallelism,
+		residencyOnReplay:     opts.ResidencyOnReplay == nil || *opts.ResidencyOnReplay,
+		archiveFn:             opts.ArchiveFunc,
+		verifyOffload:         opts.VerifyOffload,
+		computedFields:        opts.ComputedFields,
+		typeSig:               typeSigOf[ID, T](),
+		blobField:             opts.BlobField,
+	}}
+
+	return s, nil
+}
+
+// shared reports whether the store is kept in the registry, so that every
+// Open of its directory in this process returns it. Like the directory
+// lock, this only applies to writable stores on the local disk.
+func (s *Store[ID, T]) shared() bool {
+	_, local := s.fs.(OSFS)
+	return local && !s.inMemory && !s.readOnly
+}
+
+// openStorage prepares what backs the store according to its mode: nothing
+// for an in-memory store, the persisted state for a read-only one, and the
+// locked directory with its WAL otherwise.
+func (s *Store[ID, T]) openStorage() error {
+	switch {
+	case s.inMemory:
+		s.residencyFn = nil
+		s.archiveFn = nil
+		return nil
+	case s.readOnly:
+		s.residencyFn = nil
+		s.archiveFn = nil
+		if err := s.openBlobs(); err != nil {
+			return err
+		}
+		_, err := s.load()
+		return err
+	}
+	return s.openLocked()
+}
+
+// openLocked takes the directory lock and opens the files of the store.
+func (s *Store[ID, T]) openLocked() error {
+
+	if err := s.makeDirs(); err != nil {
+		return err
+	}
+
+	if err := s.acquireLock(); err != nil {
+		return err
+	}
+
+	if err := s.open(); err != nil {
+		s.releaseLock()
+		return err
+	}
+
+	return nil
+}
+
+// load rebuilds the in-memory state from the snapshot and the WAL, and
+// returns the last sequence number seen.
+func (s *Store[ID, T]) load() (uint64, error) {
+	seq, err := s.loadSnapshot()
+	if err != nil {
+		return 0, err
+	}
+	return s.replayWAL(seq)
+}
+
+func (s *Store[ID, T]) open() error {
+
+	if err := s.handleDataFile(s.residencyFn); err != nil {
+		return err
+	}
+	if err := s.openArchive(); err != nil {
+		return err
+	}
+	if err := s.openBlobs(); err != nil {
+		return err
+	}
+
+	seq, err := s.load()
+	if err != nil {
+		return err
+	}
+
+	w, err := openWAL[ID, T](s.fs, s.getWalPath(), seq)
+	if err != nil {
+		return err
+	}
+	s.wal = w
+	w.syncRetries, w.syncBackoff = s.syncRetries, s.syncRetryBackoff
+	if err := w.writeType(s.typeSig); err != nil {
+		return err
+	}
+	if s.groupCommitWindow > 0 {
+		w.group = &groupCommit{window: s.groupCommitWindow}
+	}
+	if s.writeBufferRecords > 0 || s.writeBufferBytes > 0 {
+		w.buffer = &writeBuffer{maxOps: s.writeBufferRecords, maxBytes: s.writeBufferBytes}
+	}
+
+	if _, err := s.fs.Stat(s.getDataPath()); err == nil {
+		s.hasOfflineData = true
+	}
+
+	s.lastSnapshot = s.now()
+	if fi, err := s.fs.Stat(s.getSnapshotPath()); err == nil {
+		s.lastSnapshot = fi.ModTime()
+	}
+
+	return nil
+}
+
+// Close stops the snapshot loop, waiting for a snapshot in progress, and
+// closes the files of the store. Every error met on the way is returned
+// joined. Calling Close again is a no-op.
+//
+// A store shared by several Opens stays open until the handle of each of
+// them is closed.
+func (s *Store[ID, T]) Close() error {
+	if !s.released.CompareAndSwap(false, true) {
+		return nil
+	}
+	if s.registryKey != "" {
+		if !release(s.registryKey, s.storeState) {
+			return nil
+		}
+		defer unregister(s.registryKey, s.storeState)
+	}
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.mu.Unlock()
+
+	if s.stop != nil {
+		close(s.stop)
+		s.loopWG.Wait()
+	}
+	if s.scheduler != nil && s.loop != nil {
+		s.scheduler.remove(s.loop)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.stopWatchers()
+
+	var errs []error
+	if s.wal != nil {
+		errs = append(errs, s.wal.close())
+	}
+	if s.dataFile != nil {
+		errs = append(errs, s.dataFile.Close())
+	}
+	if s.archiveFile != nil {
+		errs = append(errs, s.archiveFile.Close())
+	}
+	if s.blobFile != nil {
+		errs = append(errs, s.blobFile.Close())
+	}
+	s.closeRetired()
+	errs = append(errs, s.releaseLock())
+	return errors.Join(errs...)
+}
+
+// appendWAL logs ops to the WAL. In-memory stores have no WAL and skip it.
+// Failures are wrapped in ErrIO.
+func (s *Store[ID, T]) appendWAL(ops []walOp[ID, T]) error {
+	if s.wal == nil {
+		return nil
+	}
+	ops, err := s.walOps(ops)
+	if err != nil {
+		return err
+	}
+	if err := s.wal.append(ops); err != nil {
+		return fmt.Errorf("%w: %w", ErrIO, err)
+	}
+	return nil
+}
+
+// Flush makes sure every write acknowledged so far is on disk, without
+// taking a snapshot. It is the durability barrier between two snapshots.
+func (s *Store[ID, T]) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.wal == nil {
+		return nil
+	}
+	return s.wal.flush()
+}
+
+// PlanInfo describes the work a Get would do, see Explain.
+type PlanInfo struct {
+	// Online is the number of live records evaluated in memory.
+	Online int
+	// Offline is the number of live records read from the data file, and
+	// OfflineBytes how many bytes that is.
+	Offline      int
+	OfflineBytes int64
+	// Archived is the number of archived records, which Get skips and
+	// GetWithArchive decompresses from the archive.
+	Archived int
+	// Indexes lists the sorted indexes, in name order. Predicates are opaque
+	// so Get never uses them, but RangeByIndex can answer range queries on
+	// their keys without a scan.
+	Indexes []string
+}
+
+// Explain reports how a Get with p would scan the store, without running
+// p: every live record is evaluated, in memory or read from disk. It is
+// meant to understand why a query is slow.
+func (s *Store[ID, T]) Explain(p Predicate[T]) PlanInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	plan := PlanInfo{Online: s.onlineCount, Offline: s.offlineCount - s.archivedCount, Archived: s.archivedCount}
+	for _, rec := range s.records {
+		if !rec.deleted && rec.offloaded && !rec.archived {
+			plan.OfflineBytes += rec.size
+		}
+	}
+	for name := range s.sortedIndexes {
+		plan.Indexes = append(plan.Indexes, name)
+	}
+	slices.Sort(plan.Indexes)
+	return plan
+}
+
+// RecordInfo describes where a record is stored.
+type RecordInfo struct {
+	// Online reports whether the value is resident in memory.
+	Online bool
+	// Offset and Size locate the value in the offline data file. They are
+	// only meaningful when Online is false.
+	Offset int64
+	Size   int64
+	// Deleted reports a tombstone not yet removed by compaction.
+	Deleted bool
+	// Archived reports a value offloaded to the archive instead of the
+	// data file. Offset and Size then locate it in its decompressed batch.
+	Archived bool
+}
+
+// Inspect reports the residency and tombstone state of the record stored
+// under id. It is meant for debugging, e.g. to understand unexpected disk
+// reads. Looking up a tombstone scans the records and may read from disk.
+func (s *Store[ID, T]) Inspect(id ID) (RecordInfo, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if rec, ok := s.index[id]; ok {
+		return recordInfo(rec), true
+	}
+
+	for i := len(s.records) - 1; i >= 0; i-- {
+		rec := s.records[i]
+		if !rec.deleted {
+			continue
+		}
+		v, err := s.valueOf(rec)
+		if err != nil {
+			continue
+		}
+		if recID, err := s.idFunc(v); err == nil && recID == id {
+			return recordInfo(rec), true
+		}
+	}
+
+	return RecordInfo{}, false
+}
+
+func recordInfo[T any](rec *record[T]) RecordInfo {
+	return RecordInfo{
+		Online:   !rec.offloaded,
+		Offset:   rec.offset,
+		Size:     rec.size,
+		Deleted:  rec.deleted,
+		Archived: rec.archived,
+	}
+}
+
+// Len returns the number of live records, online and offline.
+func (s *Store[ID, T]) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.onlineCount + s.offlineCount
+}
+
+// Keys returns the id of every live record, online and offline, in
+// insertion order. No value is loaded, so it is cheap enough to iterate a
+// large store and fetch values on demand with GetByID.
+func (s *Store[ID, T]) Keys() []ID {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ids := make(map[*record[T]]ID, len(s.index))
+	for id, rec := range s.index {
+		ids[rec] = id
+	}
+	keys := make([]ID, 0, len(s.index))
+	for _, rec := range s.records {
+		if id, ok := ids[rec]; ok {
+			keys = append(keys, id)
+		}
+	}
+	return keys
+}
+
+// ResidencyStats returns how many live records are resident in memory and
+// how many are offloaded to disk, to help tune MaxInMemoryRecords and
+// ResidencyFunc.
+func (s *Store[ID, T]) ResidencyStats() (online, offline int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.onlineCount, s.offlineCount
+}
+
+// Stats is a point-in-time view of the state of a store.
+type Stats struct {
+	// Online and Offline are the live records resident in memory and
+	// offloaded to disk, as reported by ResidencyStats. Archived is the
+	// part of Offline in the archive.
+	Online   int
+	Offline  int
+	Archived int
+	// ReadErrors counts the offline values that couldn't be read since
+	// the store was opened, by queries and snapshots alike. Get returns no
+	// results on such errors, so a rising count is how its callers notice
+	// a failing disk.
+	ReadErrors uint64
+	// SnapshotErr is the error of the last snapshot, nil when it
+	// succeeded. Snapshots are mostly taken in the background, where it is
+	// the only place their errors show besides Logger.
+	SnapshotErr error
+}
+
+// Stats returns the current Stats of the store.
+func (s *Store[ID, T]) Stats() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return Stats{
+		Online:      s.onlineCount,
+		Offline:     s.offlineCount,
+		Archived:    s.archivedCount,
+		ReadErrors:  s.readErrors,
+		SnapshotErr: s.snapshotErr,
+	}
+}
+
+// ApplyResidency offloads the records that ResidencyFunc and
+// MaxInMemoryRecords say should be offline. Writes do it on their own; it
+// is meant for stores opened with ResidencyOnReplay set to false, to offload
+// at a time of the caller's choosing.
+func (s *Store[ID, T]) ApplyResidency() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.handleResidency()
+}
+
+// version returns the version of the live record stored under id, 0 if
+// there is none.
+func (s *Store[ID, T]) version(id ID) uint64 {
+	if rec, ok := s.index[id]; ok {
+		return rec.version
+	}
+	return 0
+}
+
+func (s *Store[ID, T]) addOrUpdate(id ID, value *T) {
+	if rec, ok := s.index[id]; ok && !s.appendOnly {
+		if rec.archived {
+			// the archive is only reclaimed on Open
+			s.offlineCount--
+			s.archivedCount--
+			s.onlineCount++
+			rec.archived = false
+		} else if rec.offloaded {
+			s.offlineCount--
+			s.onlineCount++
+			s.superseded++
+			s.checkCompaction()
+		}
 		rec.value = value
+		rec.offloaded = false
 		rec.deleted = false
+		rec.version++
 	} else {
-		s.records = append(s.records, &record[T]{value: value})
+		// in an append-only store the index points to the latest record
+		// of the id, and the earlier ones stay in s.records
+		version := uint64(1)
+		if ok {
+			version = rec.version + 1
+		}
+		s.records = append(s.records, &record[T]{value: value, version: version})
 		s.index[id] = s.records[len(s.records)-1]
 		s.onlineCount++
 	}
+	s.indexPut(id, *value)
+}
+
+// commitPut applies the op of a live write, one that is not being replayed,
+// and notifies the watchers.
+func (s *Store[ID, T]) commitPut(op *walOp[ID, T]) {
+	s.applyPut(op)
+	s.notify(EventPut, op.ID, op.Value)
+}
+
+// applyPut applies the op of a live write in memory.
+func (s *Store[ID, T]) applyPut(op *walOp[ID, T]) {
+	s.addOrUpdate(op.ID, &op.Value)
+	rec := s.index[op.ID]
+	if s.keepRecentWrites {
+		rec.recent = true
+	}
+	if op.Created != 0 {
+		rec.createdAt, rec.updatedAt = op.Created, op.Updated
+	}
+	rec.blob = op.blob
+	s.checkSnapshotAge()
+}
+
+// stamp sets the times of a put op, see timesOf.
+func (s *Store[ID, T]) stamp(op *walOp[ID, T], now int64) {
+	op.Created, op.Updated = s.timesOf(op.ID, now)
+}
+
+// timesOf returns the times of a write of id at now, or zeros unless
+// Options.TrackTimestamps is set. An update keeps the creation time of the
+// record it replaces.
+func (s *Store[ID, T]) timesOf(id ID, now int64) (created, updated int64) {
+	if !s.trackTimestamps {
+		return 0, 0
+	}
+	if rec, ok := s.index[id]; ok && rec.createdAt != 0 {
+		return rec.createdAt, now
+	}
+	return now, now
+}
+
+// tombstone marks rec as deleted and removes id from the index.
+func (s *Store[ID, T]) tombstone(id ID, rec *record[T]) {
+	if !rec.offloaded {
+		s.onlineCount--
+	} else {
+		s.offlineCount--
+	}
+	if rec.archived {
+		s.archivedCount--
+	}
+	rec.deleted = true
+	rec.deletedAt = time.Now().UnixNano()
+	delete(s.index, id)
+	s.dirty = true
+	s.indexDrop(id)
+
+	// in-memory stores have no snapshots to drop their tombstones
+	if s.inMemory && len(s.records) > 2*len(s.index)+64 {
+		s.compact()
+	}
+	s.checkCompaction()
+	s.checkSnapshotAge()
+}
+
+// checkCompaction asks the snapshot loop for a compaction once the share of
+// wasted entries, tombstones and superseded offline payloads, goes over
+// CompactionTombstoneRatio.
+func (s *Store[ID, T]) checkCompaction() {
+	// the earlier records of an id are not waste in an append-only store,
+	// which never deletes nor supersedes anything
+	if s.compactionRatio <= 0 || s.appendOnly {
+		return
+	}
+	wasted := len(s.records) - len(s.index) - s.retained + s.superseded
+	if wasted <= 0 || float64(wasted)/float64(wasted+len(s.index)) <= s.compactionRatio {
+		return
+	}
+	select {
+	case s.compactCh <- struct{}{}:
+		if s.scheduler != nil {
+			s.scheduler.request()
+		}
+	default:
+	}
+}
+
+// checkSnapshotAge asks the snapshot loop for a snapshot once the last one
+// is older than MaxSnapshotAge.
+func (s *Store[ID, T]) checkSnapshotAge() {
+	// in-memory and read-only stores have no snapshots, and replay comes
+	// before the WAL is open
+	if s.maxSnapshotAge <= 0 || s.wal == nil {
+		return
+	}
+	if s.now().Sub(s.lastSnapshot) <= s.maxSnapshotAge {
+		return
+	}
+	select {
+	case s.snapshotCh <- struct{}{}:
+		if s.scheduler != nil {
+			s.scheduler.request()
+		}
+	default:
+	}
+}
+
+// SnapshotAge returns how long ago the last snapshot was taken. A store
+// opened without a snapshot counts from Open, and in-memory and read-only
+// stores, which have none, return 0.
+func (s *Store[ID, T]) SnapshotAge() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.wal == nil {
+		return 0
+	}
+	return s.now().Sub(s.lastSnapshot)
 }
 
 func (s *Store[ID, T]) runCheckers(old *T, new T) (*T, error) {
@@ -305,7 +2116,7 @@ func (s *Store[ID, T]) runCheckers(old *T, new T) (*T, error) {
 	for _, checker := range s.checkers {
 		next, err := checker(old, *current)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("%w: %w", ErrCheckerRejected, err)
 		}
 		if next != nil {
 			current = next
@@ -317,6 +2128,99 @@ func (s *Store[ID, T]) runCheckers(old *T, new T) (*T, error) {
 	return current, nil
 }
 
+// clone detaches an in-memory value from the store before it is handed to
+// the caller. Values loaded from disk are already detached.
+func (s *Store[ID, T]) clone(v T) T {
+	if s.cloneFn == nil {
+		return v
+	}
+	return s.cloneFn(v)
+}
+
+// current returns a copy of the live value stored under id, or nil when
+// there is none.
+func (s *Store[ID, T]) current(id ID) (*T, error) {
+	rec, ok := s.index[id]
+	if !ok || rec.deleted {
+		return nil, nil
+	}
+	v, err := s.valueOf(rec)
+	if err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// unchanged reports whether writing value over current is a no-op according
+// to the configured Equal function. Nothing is a no-op in an append-only
+// store.
+func (s *Store[ID, T]) unchanged(current *T, value T) bool {
+	return s.equal != nil && current != nil && !s.appendOnly && s.equal(*current, value)
+}
+
+// normalize brings a value to be written to the form it is read back in,
+// so in-memory and offline copies of a record compare equal.
+func (s *Store[ID, T]) normalize(value *T) {
+	if s.hasTimes {
+		normalizeTimes(reflect.ValueOf(value).Elem())
+	}
+}
+
+// checkValue rejects values that encoding/json can't persist, or that are
+// larger than MaxRecordBytes once encoded.
+func (s *Store[ID, T]) checkValue(value T) error {
+	if s.checkFloats {
+		if err := checkFinite(reflect.ValueOf(value), reflect.TypeFor[T]().String(), 0); err != nil {
+			return err
+		}
+	}
+	if s.maxRecordBytes > 0 {
+		b, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		if len(b) > s.maxRecordBytes {
+			return fmt.Errorf("%w: %d bytes, limit is %d", ErrRecordTooLarge, len(b), s.maxRecordBytes)
+		}
+	}
+	return nil
+}
+
+// checkCollision enforces the CollisionReject policy by comparing the
+// serialized forms of the stored and the new value.
+func (s *Store[ID, T]) checkCollision(current *T, value T) error {
+	if s.onIDCollision != CollisionReject || current == nil {
+		return nil
+	}
+	a, err := json.Marshal(*current)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(a, b) {
+		return ErrIDCollision
+	}
+	return nil
+}
+
+func (s *Store[ID, T]) runAfterWrites(old *T, new T) {
+	for _, fn := range s.afterWrites {
+		fn(old, new)
+	}
+}
+
+func (s *Store[ID, T]) runDeleteCheckers(value T) error {
+	for _, checker := range s.deleteCheckers {
+		if err := checker(value); err != nil {
+			return fmt.Errorf("%w: %w", ErrCheckerRejected, err)
+		}
+	}
+	return nil
+}
+
 /*func (s *Store[ID, T]) getOfflineMatching(predicate func(T) bool) ([]T, error) {
 	//
 	//file, err := os.Open(s.getDataPath())
@@ -3,8 +3,14 @@ package flea
 import (
 	"errors"
 	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 type User struct {
@@ -78,7 +84,8 @@ func TestPutUpdateAndGet(t *testing.T) {
 }
 
 func TestOpenFailsWhenIDFuncIsNil(t *testing.T) {
-	store, err := Open[uint64, int](Options[uint64, int]{})
+	// int ids have no default IDFunc
+	store, err := Open[int, int](Options[int, int]{Dir: t.TempDir()})
 
 	if err == nil {
 		t.Fatalf("expected error when IDFunc is nil")
@@ -195,7 +202,7 @@ func TestStore_TwoTypesInParallel(t *testing.T) {
 }
 
 func TestNewStore_RequiresIDFunc(t *testing.T) {
-	_, err := Open[uint64, User](Options[uint64, User]{})
+	_, err := Open[int64, User](Options[int64, User]{Dir: t.TempDir()})
 	if err == nil {
 		t.Fatalf("expected error when IDFunc is nil")
 	}
@@ -223,12 +230,294 @@ func TestPut_User_BlockChecker(t *testing.T) {
 		t.Fatalf("expected error, got nil")
 	}
 
+	// nil matches everything, and the rejected put stored nothing
 	users := s.Get(nil)
 	if len(users) != 0 {
 		t.Fatalf("expected no records, got %d", len(users))
 	}
 }
 
+type timedRecord struct {
+	Id      uint64
+	At      time.Time
+	Zero    time.Time
+	Windows [2]time.Time
+	Nested  struct{ Seen time.Time }
+}
+
+func TestTimeFieldsRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	opts := Options[uint64, timedRecord]{
+		Dir:           dir,
+		IDFunc:        func(r timedRecord) (uint64, error) { return r.Id, nil },
+		ResidencyFunc: func(r timedRecord) bool { return r.Id%2 == 0 },
+	}
+
+	s, err := Open[uint64, timedRecord](opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	paris := time.FixedZone("CET", 3600)
+	written := make(map[uint64]timedRecord)
+	for i := uint64(1); i <= 6; i++ {
+		r := timedRecord{Id: i, At: now.Add(time.Duration(i) * time.Nanosecond)}
+		r.Windows = [2]time.Time{now.In(paris), now.UTC()}
+		r.Nested.Seen = now.Local()
+		if _, err := s.Put(r); err != nil {
+			t.Fatal(err)
+		}
+		written[i] = r
+	}
+	if err := s.snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	s.Put(timedRecord{Id: 7, At: now})
+	written[7] = timedRecord{Id: 7, At: now}
+
+	before := make(map[uint64]timedRecord)
+	for _, r := range s.GetAll() {
+		before[r.Id] = r
+	}
+	s.Close()
+
+	s, err = Open[uint64, timedRecord](opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for id, w := range written {
+		r, ok, err := s.GetByID(id)
+		if err != nil || !ok {
+			t.Fatalf("expected record %d, got %v", id, err)
+		}
+		if r != before[id] {
+			t.Fatalf("record %d changed across reopen:\n%+v\n%+v", id, before[id], r)
+		}
+		if !r.At.Equal(w.At) || !r.Windows[0].Equal(w.Windows[0]) || !r.Nested.Seen.Equal(w.Nested.Seen) {
+			t.Fatalf("record %d doesn't hold the written instants", id)
+		}
+		if !r.Zero.IsZero() {
+			t.Fatalf("expected the zero time to stay zero, got %v", r.Zero)
+		}
+	}
+}
+
+func TestAppendOnly_MaxInMemoryCountsRecords(t *testing.T) {
+	two := 2
+	s, err := Open[uint64, User](Options[uint64, User]{
+		Dir:                t.TempDir(),
+		IDFunc:             userID,
+		AppendOnly:         true,
+		MaxInMemoryRecords: &two,
+		ResidencyFunc:      func(User) bool { return false },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// one id, many records
+	for i := 1; i <= 10; i++ {
+		if _, err := s.Put(User{Id: 1, Age: i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if online, offline := s.ResidencyStats(); online > 2 || online+offline != 10 {
+		t.Fatalf("expected at most 2 of 10 records online, got %d online and %d offline", online, offline)
+	}
+}
+
+func TestAppendOnly_KeepsEveryRecord(t *testing.T) {
+	dir := t.TempDir()
+	minusOne := -1
+	opts := Options[uint64, User]{
+		Dir:                dir,
+		IDFunc:             userID,
+		AppendOnly:         true,
+		MaxInMemoryRecords: &minusOne,
+		ResidencyFunc:      func(u User) bool { return u.Age != 2 },
+	}
+
+	s, err := Open[uint64, User](opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 3; i++ {
+		if _, err := s.Put(User{Id: 1, Name: "event", Age: i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.Put(User{Id: 2, Name: "other"})
+
+	check := func(s *Store[uint64, User]) {
+		t.Helper()
+		events := s.Get(func(u User) bool { return u.Id == 1 })
+		if len(events) != 3 {
+			t.Fatalf("expected 3 records for id 1, got %d", len(events))
+		}
+		for i, e := range events {
+			if e.Age != i+1 {
+				t.Fatalf("expected write order, got age %d at %d", e.Age, i)
+			}
+		}
+		if u, _, _ := s.GetByID(1); u.Age != 3 {
+			t.Fatalf("expected GetByID to return the latest record, got age %d", u.Age)
+		}
+		if s.Len() != 4 {
+			t.Fatalf("expected 4 records, got %d", s.Len())
+		}
+	}
+	check(s)
+
+	if _, err := s.Delete(func(u User) bool { return true }); !errors.Is(err, ErrAppendOnly) {
+		t.Fatalf("expected ErrAppendOnly, got %v", err)
+	}
+
+	// compaction and the snapshot keep the history
+	if err := s.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	s, err = Open[uint64, User](opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	check(s)
+}
+
+func TestGetOneByID(t *testing.T) {
+	dir := t.TempDir()
+	s := openUserStore(t, dir)
+	defer s.Close()
+
+	s.Put(User{Id: 1, Name: "alice"})
+
+	u, err := s.GetOneByID(1)
+	if err != nil || u.Name != "alice" {
+		t.Fatalf("expected alice, got %+v, %v", u, err)
+	}
+	if _, err := s.GetOneByID(2); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestPredicatePanic_ReturnsError(t *testing.T) {
+	dir := t.TempDir()
+	s := openUserStore(t, dir)
+	defer s.Close()
+
+	s.Put(User{Id: 1, Name: "alice"})
+
+	var tags map[string][]string
+	bad := func(u User) bool {
+		tags[u.Name] = nil // nil map write
+		return true
+	}
+
+	if _, err := s.Delete(bad); !errors.Is(err, ErrPredicatePanic) {
+		t.Fatalf("expected ErrPredicatePanic from Delete, got %v", err)
+	}
+	if _, err := s.GetSorted(bad, func(a, b User) bool { return a.Id < b.Id }); !errors.Is(err, ErrPredicatePanic) {
+		t.Fatalf("expected ErrPredicatePanic from GetSorted, got %v", err)
+	}
+	if got := s.Get(bad); got != nil {
+		t.Fatalf("expected no results, got %+v", got)
+	}
+
+	// the lock was released and nothing was deleted
+	if _, err := s.Put(User{Id: 2, Name: "bob"}); err != nil {
+		t.Fatal(err)
+	}
+	if s.Len() != 2 {
+		t.Fatalf("expected 2 records, got %d", s.Len())
+	}
+}
+
+func TestGetByID_Loader(t *testing.T) {
+	dir := t.TempDir()
+
+	loads := 0
+	s, err := Open[uint64, User](Options[uint64, User]{
+		Dir:    dir,
+		IDFunc: userID,
+		Loader: func(id uint64) (User, bool, error) {
+			loads++
+			if id == 42 {
+				return User{Id: 42, Name: "external"}, true, nil
+			}
+			return User{}, false, nil
+		},
+		CacheLoaded: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	u, ok, err := s.GetByID(42)
+	if err != nil || !ok || u.Name != "external" {
+		t.Fatalf("expected the loaded user, got %+v, %v, %v", u, ok, err)
+	}
+	if _, ok, _ := s.GetByID(7); ok {
+		t.Fatalf("expected a miss for an id the loader doesn't know")
+	}
+
+	// the loaded value was cached
+	if _, ok, _ := s.GetByID(42); !ok || loads != 2 {
+		t.Fatalf("expected 42 to be served from the store, loader ran %d times", loads)
+	}
+	if s.Len() != 1 {
+		t.Fatalf("expected 1 cached record, got %d", s.Len())
+	}
+}
+
+func TestGet_NilMatchesAll(t *testing.T) {
+	dir := t.TempDir()
+
+	minusOne := -1
+	s, err := Open[uint64, User](Options[uint64, User]{
+		Dir:                dir,
+		IDFunc:             userID,
+		MaxInMemoryRecords: &minusOne,
+		ResidencyFunc:      func(u User) bool { return u.Id%2 == 0 },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for i := 1; i <= 10; i++ {
+		s.Put(User{Id: uint64(i)})
+	}
+	s.Delete(func(u User) bool { return u.Id == 5 })
+
+	users := s.Get(nil)
+	if len(users) != 9 {
+		t.Fatalf("expected 9 live users across tiers, got %d", len(users))
+	}
+	for _, u := range users {
+		if u.Id == 5 {
+			t.Fatalf("expected the deleted user to be skipped")
+		}
+	}
+
+	sorted, err := GetSortedBy(s, nil, func(u User) uint64 { return u.Id })
+	if err != nil || len(sorted) != 9 {
+		t.Fatalf("expected GetSortedBy to return 9 users, got %d, %v", len(sorted), err)
+	}
+	if users, err := s.GetWithTimeout(nil, time.Minute); err != nil || len(users) != 9 {
+		t.Fatalf("expected GetWithTimeout to return 9 users, got %d, %v", len(users), err)
+	}
+}
+
 func TestPut_UpdatePreservesInsertionOrder(t *testing.T) {
 	dir := t.TempDir()
 	s := openUserStore(t, dir)
@@ -516,6 +805,35 @@ func TestDelete_TwiceIsNoOp(t *testing.T) {
 	}
 }
 
+func TestDeleteWhere_DoesNotRecomputeIDs(t *testing.T) {
+	broken := false
+	s, err := Open[uint64, User](Options[uint64, User]{
+		Dir: t.TempDir(),
+		IDFunc: func(u User) (uint64, error) {
+			if broken {
+				return 0, errors.New("broken")
+			}
+			return u.Id, nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	s.Put(User{Id: 1, Name: "Alice"})
+	s.Put(User{Id: 2, Name: "Bob"})
+
+	broken = true
+	n, err := s.DeleteWhere(func(u User) bool { return u.Id == 2 }, 0)
+	if err != nil || n != 1 {
+		t.Fatalf("expected 1 delete, got %d, %v", n, err)
+	}
+	if _, ok, _ := s.GetByID(2); ok {
+		t.Fatal("expected user 2 to be deleted")
+	}
+}
+
 func TestGet_ReturnedValueIsCopy(t *testing.T) {
 	dir := t.TempDir()
 	s := openUserStore(t, dir)
@@ -557,6 +875,43 @@ func TestPut_Concurrent(t *testing.T) {
 	}
 }
 
+func TestPut_GroupCommit(t *testing.T) {
+	dir := t.TempDir()
+	opts := Options[uint64, User]{
+		Dir:               dir,
+		IDFunc:            userID,
+		GroupCommitWindow: 5 * time.Millisecond,
+	}
+
+	s, err := Open[uint64, User](opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const n = 50
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if _, err := s.Put(User{Id: uint64(i), Name: "U"}); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	s.Close()
+
+	s, err = Open[uint64, User](opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if s.Len() != n {
+		t.Fatalf("expected %d users after reopen, got %d", n, s.Len())
+	}
+}
+
 func TestGet_PreservesOrderAcrossMemoryAndDisk(t *testing.T) {
 	dir := t.TempDir()
 
@@ -610,3 +965,1399 @@ func TestGet_PreservesOrderAcrossMemoryAndDisk(t *testing.T) {
 		}
 	}
 }
+
+func TestGet_PreservesOrderWithInterleavedTiers(t *testing.T) {
+	dir := t.TempDir()
+	max := 5
+
+	store, err := Open[uint64, testUser](Options[uint64, testUser]{
+		Dir: dir,
+		IDFunc: func(u testUser) (uint64, error) {
+			return u.Id, nil
+		},
+		MaxInMemoryRecords: &max,
+		ResidencyFunc: func(u testUser) bool {
+			return u.Id%3 == 0
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	for i := 1; i <= 30; i++ {
+		if _, err := store.Put(testUser{Id: uint64(i), Val: i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	online, offline := 0, 0
+	for _, rec := range store.records {
+		if !rec.offloaded {
+			online++
+		} else {
+			offline++
+		}
+	}
+	if online == 0 || offline == 0 {
+		t.Fatalf("expected records in both tiers, got %d online and %d offline", online, offline)
+	}
+
+	results := store.Get(all[testUser])
+	if len(results) != 30 {
+		t.Fatalf("expected 30 results, got %d", len(results))
+	}
+
+	for i, u := range results {
+		if u.Id != uint64(i+1) {
+			t.Fatalf("order broken at position %d: expected %d, got %d", i, i+1, u.Id)
+		}
+	}
+}
+
+func TestOpen_DirLockedElsewhereFails(t *testing.T) {
+	dir := t.TempDir()
+	s := openUserStore(t, dir)
+	defer s.Close()
+
+	s.Put(User{Id: 1, Name: "Alice"})
+
+	// a lock of its own, as another process would take
+	lock, err := os.Open(s.getLockPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lock.Close()
+	s.Close()
+	if err := lockFile(lock); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = Open[uint64, User](Options[uint64, User]{
+		IDFunc: userID,
+		Dir:    dir,
+	})
+	if !errors.Is(err, ErrLocked) {
+		t.Fatalf("expected ErrLocked, got %v", err)
+	}
+
+	ro, err := Open[uint64, User](Options[uint64, User]{
+		IDFunc:   userID,
+		Dir:      dir,
+		ReadOnly: true,
+	})
+	if err != nil {
+		t.Fatalf("read-only open failed: %v", err)
+	}
+	defer ro.Close()
+
+	if users := ro.Get(all[User]); len(users) != 1 {
+		t.Fatalf("expected 1 user through read-only store, got %d", len(users))
+	}
+
+	if _, err := ro.Put(User{Id: 2, Name: "Bob"}); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("expected ErrReadOnly, got %v", err)
+	}
+}
+
+func TestOpen_SameDirTwiceSharesStore(t *testing.T) {
+	dir := t.TempDir()
+	s1 := openUserStore(t, dir)
+	s2 := openUserStore(t, dir)
+	if s1 == s2 || s1.storeState != s2.storeState {
+		t.Fatal("expected both opens to return a handle on the same store")
+	}
+
+	s1.Put(User{Id: 1, Name: "Alice"})
+	if _, ok, _ := s2.GetByID(1); !ok {
+		t.Fatal("expected a write through one handle to be seen by the other")
+	}
+
+	// the store stays open until its last handle is closed, however many
+	// times the others are
+	if err := s1.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s1.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s2.Put(User{Id: 2, Name: "Bob"}); err != nil {
+		t.Fatalf("expected the store to stay open, got %v", err)
+	}
+	if err := s2.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s3 := openUserStore(t, dir)
+	defer s3.Close()
+	if s3.storeState == s1.storeState {
+		t.Fatal("expected a closed store to be opened anew")
+	}
+	if s3.Len() != 2 {
+		t.Fatalf("expected 2 users after reopening, got %d", s3.Len())
+	}
+}
+
+func TestOpen_SameDirOtherOptionsFails(t *testing.T) {
+	dir := t.TempDir()
+	s := openUserStore(t, dir)
+	defer s.Close()
+
+	_, err := Open[uint64, User](Options[uint64, User]{
+		IDFunc:          userID,
+		Dir:             dir,
+		TrackTimestamps: true,
+	})
+	if !errors.Is(err, ErrLocked) {
+		t.Fatalf("expected ErrLocked, got %v", err)
+	}
+
+	// the failed Open holds no reference to the store
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	s2 := openUserStore(t, dir)
+	defer s2.Close()
+	if s2.storeState == s.storeState {
+		t.Fatal("expected a closed store to be opened anew")
+	}
+}
+
+func TestOpen_LockReleasedOnClose(t *testing.T) {
+	dir := t.TempDir()
+	s := openUserStore(t, dir)
+	if err := s.Close(); err != nil {
+		t.Fatalf("close failed: %v", err)
+	}
+
+	s = openUserStore(t, dir)
+	defer s.Close()
+}
+
+func TestDelete_DeleteCheckerVeto(t *testing.T) {
+	dir := t.TempDir()
+
+	s, err := Open[uint64, User](Options[uint64, User]{
+		IDFunc: userID,
+		Dir:    dir,
+		DeleteCheckers: []DeleteChecker[User]{
+			func(u User) error {
+				if u.Active {
+					return fmt.Errorf("can't delete an active user")
+				}
+				return nil
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	defer s.Close()
+
+	s.Put(User{Id: 1, Name: "Alice", Active: true})
+	s.Put(User{Id: 2, Name: "Bob"})
+
+	deleted, err := s.Delete(all[User])
+	if err == nil {
+		t.Fatalf("expected delete to be vetoed")
+	}
+	if len(deleted) != 0 {
+		t.Fatalf("expected no deleted users, got %+v", deleted)
+	}
+
+	if users := s.Get(all[User]); len(users) != 2 {
+		t.Fatalf("store modified despite veto, got %d users", len(users))
+	}
+
+	deleted, err = s.Delete(func(u User) bool { return !u.Active })
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(deleted) != 1 || deleted[0].Id != 2 {
+		t.Fatalf("unexpected deleted users: %+v", deleted)
+	}
+}
+
+func TestAfterWrite_FiresOnLivePutsOnly(t *testing.T) {
+	dir := t.TempDir()
+
+	var calls []string
+	opts := Options[uint64, User]{
+		IDFunc: userID,
+		Dir:    dir,
+		AfterWrite: []AfterWrite[User]{
+			func(old *User, new User) {
+				if old == nil {
+					calls = append(calls, "insert "+new.Name)
+				} else {
+					calls = append(calls, "update "+old.Name+" -> "+new.Name)
+				}
+			},
+		},
+	}
+
+	s, err := Open[uint64, User](opts)
+	if err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+
+	s.Put(User{Id: 1, Name: "Alice"})
+	s.Put(User{Id: 1, Name: "Alice v2"})
+	s.PutAll([]User{{Id: 2, Name: "Bob"}})
+
+	expected := []string{"insert Alice", "update Alice -> Alice v2", "insert Bob"}
+	if strings.Join(calls, ",") != strings.Join(expected, ",") {
+		t.Fatalf("unexpected hook calls: %v", calls)
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatalf("close failed: %v", err)
+	}
+
+	calls = nil
+
+	// ---- restart ----
+	s, err = Open[uint64, User](opts)
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	defer s.Close()
+
+	if len(s.Get(all[User])) != 2 {
+		t.Fatalf("expected 2 users after restart")
+	}
+	if len(calls) != 0 {
+		t.Fatalf("hook fired during replay: %v", calls)
+	}
+}
+
+func TestPut_RejectIDCollision(t *testing.T) {
+	dir := t.TempDir()
+
+	s, err := Open[uint64, User](Options[uint64, User]{
+		Dir: dir,
+		// every user lands on the same id
+		IDFunc:        func(User) (uint64, error) { return 42, nil },
+		OnIDCollision: CollisionReject,
+	})
+	if err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	defer s.Close()
+
+	if _, err := s.Put(User{Id: 1, Name: "Alice"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, err := s.Put(User{Id: 1, Name: "Alice"}); err != nil {
+		t.Fatalf("identical re-put should be allowed: %v", err)
+	}
+
+	if _, err := s.Put(User{Id: 2, Name: "Bob"}); !errors.Is(err, ErrIDCollision) {
+		t.Fatalf("expected ErrIDCollision, got %v", err)
+	}
+
+	if _, err := s.PutAll([]User{{Id: 3, Name: "Carol"}}); !errors.Is(err, ErrIDCollision) {
+		t.Fatalf("expected ErrIDCollision from PutAll, got %v", err)
+	}
+
+	users := s.Get(all[User])
+	if len(users) != 1 || users[0].Name != "Alice" {
+		t.Fatalf("stored value was overwritten: %+v", users)
+	}
+}
+
+func TestPutAll_IDFuncErrorReportsIndex(t *testing.T) {
+	dir := t.TempDir()
+
+	s, err := Open[uint64, User](Options[uint64, User]{
+		Dir: dir,
+		IDFunc: func(u User) (uint64, error) {
+			if u.Name == "" {
+				return 0, errors.New("missing name")
+			}
+			return u.Id, nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	defer s.Close()
+
+	ids, err := s.PutAll([]User{
+		{Id: 1, Name: "Alice"},
+		{Id: 2},
+		{Id: 3, Name: "Carol"},
+	})
+	if !errors.Is(err, ErrIDFunc) {
+		t.Fatalf("expected ErrIDFunc, got %v", err)
+	}
+	if ids != nil {
+		t.Fatalf("expected no ids, got %v", ids)
+	}
+
+	var batchErr *BatchError
+	if !errors.As(err, &batchErr) || batchErr.Index != 1 {
+		t.Fatalf("expected failing index 1, got %v", err)
+	}
+
+	if users := s.Get(all[User]); len(users) != 0 {
+		t.Fatalf("expected nothing written, got %d users", len(users))
+	}
+}
+
+func TestGet_CloneFuncDetachesPointers(t *testing.T) {
+	dir := t.TempDir()
+
+	s, err := Open[uint64, Order](Options[uint64, Order]{
+		Dir:    dir,
+		IDFunc: func(o Order) (uint64, error) { return o.Id, nil },
+		CloneFunc: func(o Order) Order {
+			if o.User != nil {
+				u := *o.User
+				o.User = &u
+			}
+			return o
+		},
+	})
+	if err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	defer s.Close()
+
+	s.Put(Order{Id: 1, Amount: 10, User: &User{Id: 1, Name: "Alice"}})
+
+	orders := s.Get(all[Order])
+	orders[0].User.Name = "Hacked"
+
+	o, _, err := s.GetByID(1)
+	if err != nil {
+		t.Fatalf("get failed: %v", err)
+	}
+	if o.User.Name != "Alice" {
+		t.Fatalf("store value was mutated through Get")
+	}
+
+	o.User.Name = "Hacked"
+	if orders := s.Get(all[Order]); orders[0].User.Name != "Alice" {
+		t.Fatalf("store value was mutated through GetByID")
+	}
+}
+
+func TestGetFunc_PredicateErrorAbortsQuery(t *testing.T) {
+	dir := t.TempDir()
+
+	s, err := Open[uint64, User](Options[uint64, User]{
+		Dir:    dir,
+		IDFunc: userID,
+		ResidencyFunc: func(u User) bool {
+			return u.Id < 5
+		},
+	})
+	if err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	defer s.Close()
+
+	for i := 0; i < 10; i++ {
+		s.Put(User{Id: uint64(i), Email: fmt.Sprintf("user-%d@example.com", i)})
+	}
+	// offline record with a malformed email
+	s.Put(User{Id: 7, Email: "broken"})
+
+	errMalformed := errors.New("malformed email")
+	calls := 0
+	res, err := s.GetFunc(func(u User) (bool, error) {
+		calls++
+		if !strings.Contains(u.Email, "@") {
+			return false, errMalformed
+		}
+		return true, nil
+	})
+	if !errors.Is(err, errMalformed) {
+		t.Fatalf("expected predicate error, got %v", err)
+	}
+	if res != nil {
+		t.Fatalf("expected no results, got %+v", res)
+	}
+	if calls != 8 {
+		t.Fatalf("expected scan to stop at the failing record, got %d calls", calls)
+	}
+
+	res, err = s.GetFunc(func(u User) (bool, error) { return u.Id%2 == 0, nil })
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(res) != 5 {
+		t.Fatalf("expected 5 results, got %d", len(res))
+	}
+}
+
+func TestGetAll(t *testing.T) {
+	dir := t.TempDir()
+	s := openUserStore(t, dir)
+	defer s.Close()
+
+	s.PutAll([]User{{Id: 1, Name: "A"}, {Id: 2, Name: "B"}, {Id: 3, Name: "C"}})
+	s.Delete(func(u User) bool { return u.Id == 2 })
+
+	users := s.GetAll()
+	if len(users) != 2 || cap(users) != 2 {
+		t.Fatalf("expected exactly 2 users, got len %d cap %d", len(users), cap(users))
+	}
+	if users[0].Id != 1 || users[1].Id != 3 {
+		t.Fatalf("unexpected users: %+v", users)
+	}
+}
+
+func TestGetByIDOrDefault(t *testing.T) {
+	dir := t.TempDir()
+	s := openUserStore(t, dir)
+	defer s.Close()
+
+	s.Put(User{Id: 1, Name: "Alice"})
+	s.Put(User{Id: 2, Name: "Bob"})
+	s.Delete(func(u User) bool { return u.Id == 2 })
+
+	def := User{Name: "nobody"}
+	if u := s.GetByIDOrDefault(1, def); u.Name != "Alice" {
+		t.Fatalf("expected Alice, got %q", u.Name)
+	}
+	if u := s.GetByIDOrDefault(2, def); u.Name != "nobody" {
+		t.Fatalf("expected default for deleted id, got %q", u.Name)
+	}
+	if u := s.GetByIDOrDefault(3, def); u.Name != "nobody" {
+		t.Fatalf("expected default for missing id, got %q", u.Name)
+	}
+}
+
+type withHidden struct {
+	Id     uint64
+	Name   string
+	secret string
+}
+
+func TestStrictEncoding_RejectsUnexportedFields(t *testing.T) {
+	opts := Options[uint64, withHidden]{
+		Dir:    t.TempDir(),
+		IDFunc: func(v withHidden) (uint64, error) { return v.Id, nil },
+	}
+
+	s, err := Open[uint64, withHidden](opts)
+	if err != nil {
+		t.Fatalf("default encoding should accept the type: %v", err)
+	}
+	s.Put(withHidden{Id: 1, Name: "a", secret: "s"})
+	s.Close()
+
+	s, err = Open[uint64, withHidden](opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, _, _ := s.GetByID(1)
+	s.Close()
+	if v.Name != "a" || v.secret != "" {
+		t.Fatalf("expected the unexported field to be dropped, got %+v", v)
+	}
+
+	opts.StrictEncoding = true
+	if _, err := Open[uint64, withHidden](opts); !errors.Is(err, ErrLossyType) {
+		t.Fatalf("expected ErrLossyType, got %v", err)
+	}
+
+	u, err := Open[uint64, User](Options[uint64, User]{
+		Dir:            t.TempDir(),
+		IDFunc:         userID,
+		StrictEncoding: true,
+	})
+	if err != nil {
+		t.Fatalf("strict encoding should accept User: %v", err)
+	}
+	u.Close()
+}
+
+func TestPut_RejectsNonFiniteFloats(t *testing.T) {
+	dir := t.TempDir()
+	s := openUserStore(t, dir)
+	defer s.Close()
+
+	if _, err := s.Put(User{Id: 1, Score: math.Inf(1)}); !errors.Is(err, ErrInvalidValue) {
+		t.Fatalf("expected ErrInvalidValue, got %v", err)
+	}
+	if _, err := s.Put(User{Id: 2, Score: math.NaN()}); !errors.Is(err, ErrInvalidValue) {
+		t.Fatalf("expected ErrInvalidValue for NaN, got %v", err)
+	}
+
+	_, err := s.PutAll([]User{{Id: 3, Score: 1}, {Id: 4, Score: math.Inf(-1)}})
+	var be *BatchError
+	if !errors.As(err, &be) || be.Index != 1 || !errors.Is(err, ErrInvalidValue) {
+		t.Fatalf("expected BatchError at index 1 wrapping ErrInvalidValue, got %v", err)
+	}
+
+	if s.Len() != 0 {
+		t.Fatalf("expected no record to be written, got %d", s.Len())
+	}
+
+	if _, err := s.Put(User{Id: 5, Score: 2.5}); err != nil {
+		t.Fatalf("finite score rejected: %v", err)
+	}
+}
+
+func TestInMemory_CreatesNoFiles(t *testing.T) {
+	dir := t.TempDir()
+	opts := Options[uint64, User]{
+		Dir:      dir,
+		IDFunc:   userID,
+		InMemory: true,
+	}
+
+	s, err := Open[uint64, User](opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 1; i <= 200; i++ {
+		if _, err := s.Put(User{Id: uint64(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := s.Delete(func(u User) bool { return u.Id > 10 }); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(s.GetAll()); got != 10 {
+		t.Fatalf("expected 10 users, got %d", got)
+	}
+	if len(s.records) >= 200 {
+		t.Fatalf("tombstones were never dropped: %d records", len(s.records))
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("expected no files, found %d entries", len(entries))
+	}
+
+	s, err = Open[uint64, User](opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if s.Len() != 0 {
+		t.Fatalf("expected an empty store after reopen, got %d", s.Len())
+	}
+}
+
+func TestPutAndGet_ReturnsNormalizedValue(t *testing.T) {
+	dir := t.TempDir()
+
+	checker := func(old *User, new User) (*User, error) {
+		u := new
+		u.Name = strings.ToUpper(u.Name)
+		return &u, nil
+	}
+
+	s := openUserStore(t, dir, checker)
+	defer s.Close()
+
+	u, id, err := s.PutAndGet(User{Id: 1, Name: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != 1 {
+		t.Fatalf("expected id 1, got %d", id)
+	}
+	if u.Name != "ALICE" {
+		t.Fatalf("expected normalized name, got %s", u.Name)
+	}
+}
+
+func TestUpsert_IncrementsScore(t *testing.T) {
+	dir := t.TempDir()
+
+	s := openUserStore(t, dir)
+	defer s.Close()
+
+	inc := func(old, new User) User {
+		old.Score += new.Score
+		return old
+	}
+
+	for i := 0; i < 5; i++ {
+		if _, err := s.Upsert(User{Id: 1, Name: "alice", Score: 1}, inc); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	u, ok, err := s.GetByID(1)
+	if err != nil || !ok {
+		t.Fatalf("expected user 1, got %v", err)
+	}
+	if u.Score != 5 {
+		t.Fatalf("expected score 5, got %v", u.Score)
+	}
+
+	bad := func(old, new User) User {
+		old.Id = 2
+		return old
+	}
+	if _, err := s.Upsert(User{Id: 1}, bad); err == nil {
+		t.Fatalf("expected an error when merge changes the id")
+	}
+}
+
+func TestPutIfVersion_RejectsStaleVersion(t *testing.T) {
+	dir := t.TempDir()
+
+	s := openUserStore(t, dir)
+
+	v, err := s.PutIfVersion(User{Id: 1, Name: "alice"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != 1 {
+		t.Fatalf("expected version 1, got %d", v)
+	}
+	if _, err := s.PutIfVersion(User{Id: 1, Name: "again"}, 0); !errors.Is(err, ErrConflict) {
+		t.Fatalf("expected ErrConflict for an existing record, got %v", err)
+	}
+
+	// a plain Put bumps the version too
+	if _, err := s.Put(User{Id: 1, Name: "bob"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.PutIfVersion(User{Id: 1, Name: "stale"}, 1); !errors.Is(err, ErrConflict) {
+		t.Fatalf("expected ErrConflict for a stale version, got %v", err)
+	}
+	if u, _, _ := s.GetByID(1); u.Name != "bob" {
+		t.Fatalf("expected the stale write to be rejected, got %s", u.Name)
+	}
+	if v, err = s.PutIfVersion(User{Id: 1, Name: "carol"}, 2); err != nil || v != 3 {
+		t.Fatalf("expected version 3, got %d, %v", v, err)
+	}
+
+	// versions survive both the snapshot and the WAL
+	if err := s.snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	s.Put(User{Id: 1, Name: "dave"})
+	s.Put(User{Id: 2, Name: "erin"})
+	s.Close()
+
+	s = openUserStore(t, dir)
+	defer s.Close()
+	if v, _ := s.Version(1); v != 4 {
+		t.Fatalf("expected version 4 after reopen, got %d", v)
+	}
+	if v, _ := s.Version(2); v != 1 {
+		t.Fatalf("expected version 1 after reopen, got %d", v)
+	}
+	if err := s.snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	s = openUserStore(t, dir)
+	defer s.Close()
+	if v, _ := s.Version(1); v != 4 {
+		t.Fatalf("expected version 4 from the snapshot, got %d", v)
+	}
+}
+
+func TestPut_EqualSkipsNoOpUpdates(t *testing.T) {
+	dir := t.TempDir()
+
+	writes := 0
+	s, err := Open[uint64, User](Options[uint64, User]{
+		Dir:        dir,
+		IDFunc:     userID,
+		Equal:      func(a, b User) bool { return a == b },
+		AfterWrite: []AfterWrite[User]{func(*User, User) { writes++ }},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	s.Put(User{Id: 1, Name: "Alice"})
+
+	before, err := os.Stat(s.getWalPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.Put(User{Id: 1, Name: "Alice"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.PutAll([]User{{Id: 1, Name: "Alice"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	after, err := os.Stat(s.getWalPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.Size() != before.Size() {
+		t.Fatalf("WAL grew from %d to %d bytes on identical puts", before.Size(), after.Size())
+	}
+	if writes != 1 {
+		t.Fatalf("expected 1 AfterWrite call, got %d", writes)
+	}
+
+	s.Put(User{Id: 1, Name: "Alice v2"})
+	if u, _, _ := s.GetByID(1); u.Name != "Alice v2" {
+		t.Fatalf("real update was skipped, got %q", u.Name)
+	}
+}
+
+func TestMaxRecordBytes_RejectsLargeWrites(t *testing.T) {
+	s, err := Open[uint64, User](Options[uint64, User]{
+		Dir:            t.TempDir(),
+		IDFunc:         userID,
+		MaxRecordBytes: 256,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if _, err := s.Put(User{Id: 1, Name: "small"}); err != nil {
+		t.Fatalf("small record rejected: %v", err)
+	}
+	big := User{Id: 2, Name: strings.Repeat("x", 300)}
+	if _, err := s.Put(big); !errors.Is(err, ErrRecordTooLarge) {
+		t.Fatalf("expected ErrRecordTooLarge, got %v", err)
+	}
+	if _, err := s.PutAll([]User{{Id: 3}, big}); !errors.Is(err, ErrRecordTooLarge) {
+		t.Fatalf("expected ErrRecordTooLarge from PutAll, got %v", err)
+	}
+	if s.Len() != 1 {
+		t.Fatalf("expected 1 record, got %d", s.Len())
+	}
+}
+
+func TestMaxRecordBytes_RejectsLargeRecordsOnRead(t *testing.T) {
+	dir := t.TempDir()
+
+	s := openUserStore(t, dir)
+	s.Put(User{Id: 1, Name: "small"})
+	s.Put(User{Id: 2, Name: strings.Repeat("x", 300)})
+	if err := s.snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	_, err := Open[uint64, User](Options[uint64, User]{
+		Dir:            dir,
+		IDFunc:         userID,
+		MaxRecordBytes: 256,
+	})
+	if !errors.Is(err, ErrRecordTooLarge) {
+		t.Fatalf("expected ErrRecordTooLarge, got %v", err)
+	}
+}
+
+func TestMaxRecordBytes_RejectsLargeRecordsInWAL(t *testing.T) {
+	dir := t.TempDir()
+
+	s := openUserStore(t, dir)
+	s.Put(User{Id: 1, Name: "small"})
+	s.Put(User{Id: 2, Name: strings.Repeat("x", 1000)})
+	s.Close()
+
+	_, err := Open[uint64, User](Options[uint64, User]{
+		Dir:            dir,
+		IDFunc:         userID,
+		MaxRecordBytes: 256,
+	})
+	if !errors.Is(err, ErrRecordTooLarge) {
+		t.Fatalf("expected ErrRecordTooLarge, got %v", err)
+	}
+
+	// records within the limit replay from the WAL
+	s, err = Open[uint64, User](Options[uint64, User]{
+		Dir:            dir,
+		IDFunc:         userID,
+		MaxRecordBytes: 2048,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if s.Len() != 2 {
+		t.Fatalf("expected 2 users, got %d", s.Len())
+	}
+}
+
+func TestClose_Idempotent(t *testing.T) {
+	s, err := Open[uint64, User](Options[uint64, User]{
+		Dir:              t.TempDir(),
+		IDFunc:           userID,
+		SnapshotInterval: time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Put(User{Id: 1})
+	time.Sleep(5 * time.Millisecond)
+
+	if err := s.Close(); err != nil {
+		t.Fatalf("first Close failed: %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("second Close should be a no-op, got %v", err)
+	}
+}
+
+func TestGetAny_IncludesDeletedBeforeCompaction(t *testing.T) {
+	s := openUserStore(t, t.TempDir())
+	defer s.Close()
+
+	s.Put(User{Id: 1, Name: "Alice"})
+	s.Put(User{Id: 2, Name: "Bob"})
+	s.Delete(func(u User) bool { return u.Id == 1 })
+
+	if got := s.GetAny(all[User], false); len(got) != 1 || got[0].Id != 2 {
+		t.Fatalf("expected only Bob without deleted, got %+v", got)
+	}
+
+	got := s.GetAny(all[User], true)
+	if len(got) != 2 || got[0].Name != "Alice" || got[1].Name != "Bob" {
+		t.Fatalf("expected Alice and Bob with deleted, got %+v", got)
+	}
+
+	if err := s.snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.GetAny(all[User], true); len(got) != 1 {
+		t.Fatalf("expected the tombstone to be compacted away, got %+v", got)
+	}
+}
+
+func TestGetSorted_ByScoreDescending(t *testing.T) {
+	s := openUserStore(t, t.TempDir())
+	defer s.Close()
+
+	s.PutAll([]User{
+		{Id: 1, Score: 40, Active: true},
+		{Id: 2, Score: 90, Active: true},
+		{Id: 3, Score: 10, Active: false},
+		{Id: 4, Score: 90, Active: true},
+		{Id: 5, Score: 60, Active: true},
+	})
+
+	active := func(u User) bool { return u.Active }
+
+	users, err := s.GetSorted(active, func(a, b User) bool { return a.Score > b.Score })
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []uint64{2, 4, 5, 1}
+	if len(users) != len(want) {
+		t.Fatalf("expected %d users, got %d", len(want), len(users))
+	}
+	for i, u := range users {
+		if u.Id != want[i] {
+			t.Fatalf("position %d: expected %d, got %d", i, want[i], u.Id)
+		}
+	}
+
+	users, err = GetSortedBy(s, active, func(u User) float64 { return u.Score })
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []uint64{1, 5, 2, 4}
+	for i, u := range users {
+		if u.Id != want[i] {
+			t.Fatalf("GetSortedBy position %d: expected %d, got %d", i, want[i], u.Id)
+		}
+	}
+}
+
+func TestPath_IsModelDir(t *testing.T) {
+	dir := t.TempDir()
+	s := openUserStore(t, dir)
+	defer s.Close()
+
+	path := s.Path()
+	if path != filepath.Join(dir, "flea_user") {
+		t.Fatalf("unexpected path %q", path)
+	}
+
+	s.Put(User{Id: 1})
+	if err := s.snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(path, "snapshot.ndjson")); err != nil {
+		t.Fatalf("snapshot not under Path: %v", err)
+	}
+}
+
+func TestTombstoneRetention_RestoreAfterCompaction(t *testing.T) {
+	s, err := Open[uint64, User](Options[uint64, User]{
+		Dir:                t.TempDir(),
+		IDFunc:             userID,
+		TombstoneRetention: time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	s.Put(User{Id: 1, Name: "Alice"})
+	s.Put(User{Id: 2, Name: "Bob"})
+	s.Delete(func(u User) bool { return u.Id == 1 })
+
+	if err := s.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.snapshot(); err != nil {
+		t.Fatal(err)
+	}
+
+	ok, err := s.Restore(1)
+	if err != nil || !ok {
+		t.Fatalf("expected record 1 to be restored, got %v %v", ok, err)
+	}
+	users := s.GetAll()
+	if len(users) != 2 || users[0].Name != "Alice" {
+		t.Fatalf("expected Alice back in her slot, got %+v", users)
+	}
+	if ok, _ := s.Restore(1); ok {
+		t.Fatalf("restoring a live record should report false")
+	}
+
+	// without retention the tombstone is gone after compaction
+	s.tombstoneRetention = 0
+	s.Delete(func(u User) bool { return u.Id == 2 })
+	if err := s.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := s.Restore(2); ok {
+		t.Fatalf("record 2 should not be restorable after compaction")
+	}
+}
+
+func TestOpen_DirIsAFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "not-a-dir")
+	if err := os.WriteFile(file, []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := Open[uint64, User](Options[uint64, User]{
+		Dir:    file,
+		IDFunc: userID,
+	})
+	if err == nil {
+		t.Fatalf("expected Open to fail when Dir is a file")
+	}
+	if !strings.Contains(err.Error(), "can't create store directory") {
+		t.Fatalf("expected a clear error, got %v", err)
+	}
+}
+
+func TestPut_ErrorKinds(t *testing.T) {
+	errBlocked := errors.New("blocked")
+	s := openUserStore(t, t.TempDir(), func(old *User, new User) (*User, error) {
+		if new.Name == "" {
+			return nil, errBlocked
+		}
+		return nil, nil
+	})
+	defer s.Close()
+
+	_, err := s.Put(User{Id: 1})
+	if !errors.Is(err, ErrCheckerRejected) || !errors.Is(err, errBlocked) {
+		t.Fatalf("expected ErrCheckerRejected wrapping the checker error, got %v", err)
+	}
+	if errors.Is(err, ErrIO) {
+		t.Fatalf("checker rejection reported as ErrIO")
+	}
+
+	// break the WAL underneath the store
+	s.wal.file.Close()
+
+	_, err = s.Put(User{Id: 2, Name: "Bob"})
+	if !errors.Is(err, ErrIO) || !errors.Is(err, os.ErrClosed) {
+		t.Fatalf("expected ErrIO wrapping the write error, got %v", err)
+	}
+	if errors.Is(err, ErrCheckerRejected) {
+		t.Fatalf("I/O failure reported as ErrCheckerRejected")
+	}
+}
+
+func TestOnLoad_MigratesPersistedValues(t *testing.T) {
+	dir := t.TempDir()
+
+	s := openUserStore(t, dir)
+	s.Put(User{Id: 1, Name: "from snapshot"})
+	if err := s.snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	s.Put(User{Id: 2, Name: "from wal"})
+	s.Close()
+
+	loads := 0
+	s, err := Open[uint64, User](Options[uint64, User]{
+		Dir:    dir,
+		IDFunc: userID,
+		OnLoad: func(u *User) error {
+			loads++
+			if u.Country == "" {
+				u.Country = "BR"
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for _, id := range []uint64{1, 2} {
+		if u, _, _ := s.GetByID(id); u.Country != "BR" {
+			t.Fatalf("record %d not migrated: %+v", id, u)
+		}
+	}
+
+	before := loads
+	s.Put(User{Id: 3, Name: "fresh"})
+	if u, _, _ := s.GetByID(3); u.Country != "" {
+		t.Fatalf("OnLoad ran on a freshly put value: %+v", u)
+	}
+	if loads != before {
+		t.Fatalf("OnLoad called %d times for a fresh put", loads-before)
+	}
+}
+
+func TestDeleteAll(t *testing.T) {
+	dir := t.TempDir()
+	max := 3
+	opts := Options[uint64, User]{
+		Dir:                dir,
+		IDFunc:             userID,
+		MaxInMemoryRecords: &max,
+		ResidencyFunc:      func(User) bool { return false },
+	}
+
+	s, err := Open[uint64, User](opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 10; i++ {
+		s.Put(User{Id: uint64(i)})
+	}
+	if err := s.snapshot(); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := s.DeleteAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 10 {
+		t.Fatalf("expected 10 deleted, got %d", n)
+	}
+	if s.Len() != 0 || len(s.GetAll()) != 0 {
+		t.Fatalf("expected an empty store, got %d", s.Len())
+	}
+	if info, _ := os.Stat(s.getDataPath()); info.Size() != 0 {
+		t.Fatalf("expected the data file to be truncated, got %d bytes", info.Size())
+	}
+	// the snapshot emptied the WAL
+	wal, _ := os.ReadFile(s.getWalPath())
+	if lines := strings.Count(string(wal), "\n"); lines != 1 {
+		t.Fatalf("expected a single WAL op, got %d", lines)
+	}
+
+	s.Put(User{Id: 42})
+	s.Close()
+
+	// the snapshot still holds the 10 records; the WAL clear must win
+	s, err = Open[uint64, User](opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	users := s.GetAll()
+	if len(users) != 1 || users[0].Id != 42 {
+		t.Fatalf("expected only user 42 after reopen, got %+v", users)
+	}
+}
+
+func TestDeleteAllDuringForEach(t *testing.T) {
+	max := 0
+	s := openUserStoreWithOpts(t, Options[uint64, User]{
+		Dir:                t.TempDir(),
+		IDFunc:             userID,
+		MaxInMemoryRecords: &max,
+		ResidencyFunc:      func(User) bool { return false },
+	})
+	defer s.Close()
+	for i := 1; i <= 20; i++ {
+		s.Put(User{Id: uint64(i)})
+	}
+
+	visited := 0
+	err := s.ForEach(func(u User) error {
+		visited++
+		if visited == 1 {
+			if _, err := s.DeleteAll(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("ForEach failed: %v", err)
+	}
+	if visited != 20 {
+		t.Fatalf("expected ForEach to visit the 20 records it started with, got %d", visited)
+	}
+	if s.Len() != 0 {
+		t.Fatalf("expected an empty store, got %d", s.Len())
+	}
+}
+
+func TestGetParallelism_KeepsInsertionOrder(t *testing.T) {
+	open := func(workers int) *Store[uint64, User] {
+		return openUserStoreWithOpts(t, Options[uint64, User]{
+			Dir:            t.TempDir(),
+			IDFunc:         userID,
+			GetParallelism: workers,
+		})
+	}
+	seq, par := open(0), open(4)
+	defer seq.Close()
+	defer par.Close()
+
+	for i := 3000; i > 0; i-- {
+		u := User{Id: uint64(i), Age: i % 97}
+		seq.Put(u)
+		par.Put(u)
+	}
+
+	old := func(u User) bool { return u.Age > 60 }
+	want, got := seq.Get(old), par.Get(old)
+	if len(want) == 0 || !slices.Equal(got, want) {
+		t.Fatalf("expected %d matches in insertion order, got %d", len(want), len(got))
+	}
+
+	_, err := par.GetSorted(func(u User) bool {
+		if u.Id == 1500 {
+			panic("bad record")
+		}
+		return true
+	}, func(a, b User) bool { return a.Id < b.Id })
+	if !errors.Is(err, ErrPredicatePanic) {
+		t.Fatalf("expected ErrPredicatePanic, got %v", err)
+	}
+}
+
+func TestPutAllEx_ReportsInsertsAndUpdates(t *testing.T) {
+	s := openUserStoreWithOpts(t, Options[uint64, User]{
+		Dir:    t.TempDir(),
+		IDFunc: userID,
+		Checkers: []Checker[User]{
+			func(old *User, u User) (*User, error) {
+				u.Name = strings.ToUpper(u.Name)
+				return &u, nil
+			},
+		},
+	})
+	defer s.Close()
+
+	s.Put(User{Id: 1, Name: "alice"})
+	s.Put(User{Id: 2, Name: "bob"})
+
+	results, err := s.PutAllEx([]User{
+		{Id: 2, Name: "bobby"},
+		{Id: 3, Name: "carol"},
+		{Id: 3, Name: "caroline"},
+		{Id: 1, Name: "alice"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []PutResult[uint64, User]{
+		{ID: 2, Inserted: false, Value: User{Id: 2, Name: "BOBBY"}},
+		{ID: 3, Inserted: true, Value: User{Id: 3, Name: "CAROL"}},
+		{ID: 3, Inserted: false, Value: User{Id: 3, Name: "CAROLINE"}},
+		{ID: 1, Inserted: false, Value: User{Id: 1, Name: "ALICE"}},
+	}
+	if !slices.Equal(results, want) {
+		t.Fatalf("expected %+v, got %+v", want, results)
+	}
+}
+
+func TestGetByPrefix(t *testing.T) {
+	type doc struct {
+		Key  string
+		Body string
+	}
+	s, err := Open[string, doc](Options[string, doc]{
+		Dir:    t.TempDir(),
+		IDFunc: func(d doc) (string, error) { return d.Key, nil },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for _, k := range []string{"tenant:2:a", "tenant:12:a", "tenant:1:b", "tenant:1:a", "other:1:a"} {
+		s.Put(doc{Key: k, Body: k})
+	}
+	s.Delete(func(d doc) bool { return d.Key == "tenant:1:b" })
+	s.Put(doc{Key: "tenant:1:c"})
+
+	got, err := GetByPrefix(s, "tenant:1:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for _, d := range got {
+		keys = append(keys, d.Key)
+	}
+	if want := []string{"tenant:1:a", "tenant:1:c"}; !slices.Equal(keys, want) {
+		t.Fatalf("expected %v, got %v", want, keys)
+	}
+
+	if got, _ := GetByPrefix(s, ""); len(got) != 5 {
+		t.Fatalf("expected the empty prefix to match all 5 records, got %d", len(got))
+	}
+}
+
+func TestMeta_UpdateKeepsCreatedAt(t *testing.T) {
+	dir := t.TempDir()
+	open := func() *Store[uint64, User] {
+		s, err := Open[uint64, User](Options[uint64, User]{
+			Dir:             dir,
+			IDFunc:          userID,
+			TrackTimestamps: true,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	s := open()
+
+	s.Put(User{Id: 1, Name: "alice"})
+	created, ok := s.Meta(1)
+	if !ok || created.CreatedAt.IsZero() || !created.CreatedAt.Equal(created.UpdatedAt) {
+		t.Fatalf("expected equal times on insert, got %+v", created)
+	}
+
+	time.Sleep(time.Millisecond)
+	s.Put(User{Id: 1, Name: "alice v2"})
+	updated, _ := s.Meta(1)
+	if !updated.CreatedAt.Equal(created.CreatedAt) {
+		t.Fatalf("expected createdAt to stay %v, got %v", created.CreatedAt, updated.CreatedAt)
+	}
+	if !updated.UpdatedAt.After(created.UpdatedAt) {
+		t.Fatalf("expected updatedAt to move past %v, got %v", created.UpdatedAt, updated.UpdatedAt)
+	}
+	if _, ok := s.Meta(2); ok {
+		t.Fatal("expected no meta for a missing id")
+	}
+
+	// the times survive both the WAL and the snapshot
+	s.Close()
+	s = open()
+	if m, _ := s.Meta(1); m != updated {
+		t.Fatalf("expected %+v after replay, got %+v", updated, m)
+	}
+	if err := s.snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	s = open()
+	defer s.Close()
+	if m, _ := s.Meta(1); m != updated {
+		t.Fatalf("expected %+v from the snapshot, got %+v", updated, m)
+	}
+}
+
+func TestValidate_RunsCheckersWithoutWriting(t *testing.T) {
+	errMinor := errors.New("too young")
+	rejectMinors := func(old *User, u User) (*User, error) {
+		if u.Age < 18 {
+			return nil, errMinor
+		}
+		return nil, nil
+	}
+	lowerEmail := func(old *User, u User) (*User, error) {
+		u.Email = strings.ToLower(u.Email)
+		return &u, nil
+	}
+	writes := 0
+	s, err := Open[uint64, User](Options[uint64, User]{
+		Dir:        t.TempDir(),
+		IDFunc:     userID,
+		Checkers:   []Checker[User]{rejectMinors, lowerEmail},
+		AfterWrite: []AfterWrite[User]{func(old *User, new User) { writes++ }},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if _, err := s.Validate(User{Id: 1, Age: 12}); !errors.Is(err, ErrCheckerRejected) || !errors.Is(err, errMinor) {
+		t.Fatalf("expected the rejection, got %v", err)
+	}
+	u, err := s.Validate(User{Id: 1, Age: 30, Email: "Alice@Example.COM"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Email != "alice@example.com" {
+		t.Fatalf("expected the normalized email, got %q", u.Email)
+	}
+	if s.Len() != 0 || writes != 0 {
+		t.Fatalf("expected nothing written, got %d records and %d writes", s.Len(), writes)
+	}
+}
+
+func TestSelectProjectsMatches(t *testing.T) {
+	max := 1
+	s, err := Open[uint64, User](Options[uint64, User]{
+		Dir:                t.TempDir(),
+		IDFunc:             userID,
+		MaxInMemoryRecords: &max,
+		ResidencyFunc:      func(User) bool { return false },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	s.PutAll([]User{
+		{Id: 1, Name: "Alice", Email: "alice@example.com", Age: 30},
+		{Id: 2, Name: "Bob", Email: "bob@example.com", Age: 12},
+		{Id: 3, Name: "Carol", Email: "carol@example.com", Age: 40},
+	})
+	if _, offline := s.ResidencyStats(); offline == 0 {
+		t.Fatal("expected offline records")
+	}
+
+	type summary struct {
+		Id   uint64
+		Name string
+	}
+	got, err := Select(s, func(u User) bool { return u.Age >= 18 }, func(u User) summary {
+		return summary{Id: u.Id, Name: u.Name}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []summary{{1, "Alice"}, {3, "Carol"}}; !slices.Equal(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+}
@@ -0,0 +1,120 @@
+package flea
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// View is a read-only copy of a store as it was when SnapshotView returned
+// it. Writes made to the store since, compactions included, don't show in
+// the view.
+type View[ID comparable, T any] struct {
+	s       *Store[ID, T]
+	entries []snapshotEntry[T]
+	// guards files, whose buffers are shared by the reads of the view
+	mu     sync.Mutex
+	files  *offlineReader
+	closed bool
+}
+
+// SnapshotView returns a view of the live records of the store, so that a
+// long query sees a stable dataset while writes go on. Like Get, the view
+// leaves out archived records.
+//
+// Taking a view copies the state of every record, not their values, and
+// opens the data file again. The store only appends to its data file, and
+// compactions and DeleteAll rename a new one over it, so the file the view
+// opened keeps the offline values it points to. The view must be closed to
+// release it, and can't be read once the store is closed.
+func (s *Store[ID, T]) SnapshotView() (*View[ID, T], error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	v := &View[ID, T]{s: s, files: &offlineReader{}}
+	if s.offlineCount > s.archivedCount {
+		f, err := s.fs.Open(s.getDataPath())
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrIO, err)
+		}
+		v.files.data = f
+	}
+
+	v.entries = make([]snapshotEntry[T], 0, len(s.index))
+	for _, r := range s.records {
+		if r.deleted || r.archived {
+			continue
+		}
+		v.entries = append(v.entries, entryOf(r))
+	}
+	return v, nil
+}
+
+// Len returns the number of records in the view.
+func (v *View[ID, T]) Len() int {
+	return len(v.entries)
+}
+
+// Get returns the values of the view matching p, in insertion order. A nil
+// p matches every value.
+func (v *View[ID, T]) Get(p Predicate[T]) ([]T, error) {
+	if p == nil {
+		p = matchAll[T]
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if v.closed {
+		return nil, fmt.Errorf("%w: %w", ErrIO, os.ErrClosed)
+	}
+
+	var results []T
+	for _, e := range v.entries {
+		value, err := v.valueOf(e)
+		if err != nil {
+			return nil, err
+		}
+		ok, err := callPredicateFunc(func(value T) (bool, error) {
+			return p(value), nil
+		}, value)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			results = append(results, value)
+		}
+	}
+	return results, nil
+}
+
+// valueOf returns the value of e, reading it from the data file of the view
+// when it was offline. It runs under v.mu.
+func (v *View[ID, T]) valueOf(e snapshotEntry[T]) (T, error) {
+	if !e.offloaded {
+		return v.s.clone(*e.value), nil
+	}
+	var value T
+	data, err := v.files.read(false, 0, e.offset, e.size)
+	if err != nil {
+		return value, fmt.Errorf("%w: %w", ErrIO, err)
+	}
+	_, err = v.s.decodeRef(data, &value)
+	return value, err
+}
+
+// Close releases the data file held by the view. Calling Close again is a
+// no-op.
+func (v *View[ID, T]) Close() error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if v.closed {
+		return nil
+	}
+	v.closed = true
+	if v.files.data != nil {
+		return v.files.data.Close()
+	}
+	return nil
+}
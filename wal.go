@@ -2,8 +2,14 @@ package flea
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/json"
+	"errors"
+	"io"
 	"os"
+	"sync"
+	"syscall"
+	"time"
 )
 
 type walOpType string
@@ -11,43 +17,307 @@ type walOpType string
 const (
 	opPut    walOpType = "put"
 	opDelete walOpType = "delete"
+	// opClear deletes every record
+	opClear walOpType = "clear"
+	// opType records the types the WAL was written with, see typeSig
+	opType walOpType = "type"
 )
 
 type walOp[ID comparable, T any] struct {
+	Seq   uint64    `json:"seq,omitempty"`
 	Op    walOpType `json:"op"`
 	ID    ID        `json:"Id"`
 	Value T         `json:"Value,omitempty"`
+	// version of the record once the op is applied; 0 in ops written
+	// before versions existed
+	Version uint64 `json:"ver,omitempty"`
+	// unix nanoseconds, see Options.TrackTimestamps
+	Created int64 `json:"cat,omitempty"`
+	Updated int64 `json:"uat,omitempty"`
+	// only set in opType ops
+	Type *typeSig `json:"type,omitempty"`
+	// where the blob of Value went, see Store.walOps; never logged itself
+	blob blobRef
+}
+
+// walTypeLine is the opType op. It has no value, so it decodes into a walOp
+// of any T.
+type walTypeLine struct {
+	Op   walOpType `json:"op"`
+	Type *typeSig  `json:"type"`
 }
 
 type wal[ID comparable, T any] struct {
-	file *os.File
+	fs   FS
+	path string
+	file File
 	w    *bufio.Writer
+	// sequence number of the last appended op
+	seq uint64
+	// nil unless Options.GroupCommitWindow is set
+	group *groupCommit
+	// nil unless Options.WriteBufferRecords or WriteBufferBytes is set
+	buffer *writeBuffer
+	// see Options.SyncRetries
+	syncRetries int
+	syncBackoff time.Duration
+}
+
+// writeBuffer holds encoded ops in memory until enough of them are pending
+// to be written and synced at once, see Options.WriteBufferRecords.
+type writeBuffer struct {
+	// 0 means no limit
+	maxOps   int
+	maxBytes int
+	buf      bytes.Buffer
+	ops      int
+}
+
+func (b *writeBuffer) full() bool {
+	return b.maxOps > 0 && b.ops >= b.maxOps || b.maxBytes > 0 && b.buf.Len() >= b.maxBytes
+}
+
+// groupCommit shares one fsync between the writers that append to the WAL
+// within the same window, see Options.GroupCommitWindow.
+type groupCommit struct {
+	window  time.Duration
+	mu      sync.Mutex
+	pending *syncBatch
+	// counts the writers between write and waitSync, so close can wait
+	// for them
+	writers sync.WaitGroup
+}
+
+// syncBatch is one fsync shared by every writer that joined it.
+type syncBatch struct {
+	done chan struct{}
+	err  error
 }
 
-func openWAL[ID comparable, T any](path string) (*wal[ID, T], error) {
-	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0644)
+func openWAL[ID comparable, T any](fs FS, path string, seq uint64) (*wal[ID, T], error) {
+	f, err := fs.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0644)
 	if err != nil {
 		return nil, err
 	}
 	return &wal[ID, T]{
+		fs:   fs,
+		path: path,
 		file: f,
 		w:    bufio.NewWriter(f),
+		seq:  seq,
 	}, nil
 }
 
 func (w *wal[ID, T]) append(ops []walOp[ID, T]) error {
+	if w.buffer != nil {
+		return w.bufferOps(ops)
+	}
 	enc := json.NewEncoder(w.w)
 	for _, op := range ops {
+		w.seq++
+		op.Seq = w.seq
+		if err := enc.Encode(op); err != nil {
+			return err
+		}
+	}
+	if err := w.w.Flush(); err != nil {
+		return err
+	}
+	return w.sync()
+}
+
+// bufferOps appends ops to the write buffer, and writes and syncs the
+// buffer once it is full.
+func (w *wal[ID, T]) bufferOps(ops []walOp[ID, T]) error {
+	enc := json.NewEncoder(&w.buffer.buf)
+	for _, op := range ops {
+		w.seq++
+		op.Seq = w.seq
 		if err := enc.Encode(op); err != nil {
 			return err
 		}
-		if err := w.w.Flush(); err != nil {
+	}
+	w.buffer.ops += len(ops)
+	if w.buffer.full() {
+		return w.flush()
+	}
+	return nil
+}
+
+// drain moves the ops of the write buffer to the file, without syncing.
+func (w *wal[ID, T]) drain() error {
+	if w.buffer == nil || w.buffer.buf.Len() == 0 {
+		return nil
+	}
+	if _, err := w.w.Write(w.buffer.buf.Bytes()); err != nil {
+		return err
+	}
+	w.buffer.buf.Reset()
+	w.buffer.ops = 0
+	return nil
+}
+
+// writeType starts an empty WAL with an opType op. It has no sequence
+// number, so it doesn't count as a write.
+func (w *wal[ID, T]) writeType(sig *typeSig) error {
+	size, err := w.size()
+	if err != nil || size > 0 {
+		return err
+	}
+	if err := json.NewEncoder(w.w).Encode(walTypeLine{Op: opType, Type: sig}); err != nil {
+		return err
+	}
+	return w.flush()
+}
+
+// write appends ops like append, but leaves the fsync to a later waitSync,
+// which the caller must make once it no longer holds the store lock.
+func (w *wal[ID, T]) write(ops []walOp[ID, T]) error {
+	enc := json.NewEncoder(w.w)
+	for _, op := range ops {
+		w.seq++
+		op.Seq = w.seq
+		if err := enc.Encode(op); err != nil {
 			return err
 		}
 	}
-	return w.file.Sync()
+	if err := w.w.Flush(); err != nil {
+		return err
+	}
+	w.group.writers.Add(1)
+	return nil
+}
+
+// waitSync returns once the ops of the preceding write are on disk. The
+// first writer to arrive waits for the window, then syncs for every
+// writer that joined in the meantime.
+func (w *wal[ID, T]) waitSync() error {
+	g := w.group
+	defer g.writers.Done()
+
+	g.mu.Lock()
+	b := g.pending
+	leader := b == nil
+	if leader {
+		b = &syncBatch{done: make(chan struct{})}
+		g.pending = b
+	}
+	g.mu.Unlock()
+
+	if !leader {
+		<-b.done
+		return b.err
+	}
+
+	time.Sleep(g.window)
+	g.mu.Lock()
+	g.pending = nil
+	g.mu.Unlock()
+
+	b.err = w.sync()
+	close(b.done)
+	return b.err
+}
+
+// flush writes any buffered op to the file and fsyncs it.
+func (w *wal[ID, T]) flush() error {
+	if err := w.drain(); err != nil {
+		return err
+	}
+	if err := w.w.Flush(); err != nil {
+		return err
+	}
+	return w.sync()
+}
+
+// sync fsyncs the WAL, retrying a failure as Options.SyncRetries says.
+//
+// Only interrupted calls are retried: after any other failure, Linux may
+// have dropped the dirty pages of the file and cleared the error, so a
+// retry that succeeds would report writes durable that never reached the
+// disk.
+func (w *wal[ID, T]) sync() error {
+	backoff := w.syncBackoff
+	err := w.file.Sync()
+	for i := 0; transientSync(err) && i < w.syncRetries; i++ {
+		time.Sleep(backoff)
+		backoff *= 2
+		err = w.file.Sync()
+	}
+	return err
+}
+
+// transientSync reports whether an fsync failed with err before doing
+// anything, so that it can be retried.
+func transientSync(err error) bool {
+	return errors.Is(err, syscall.EINTR) || errors.Is(err, syscall.EAGAIN)
+}
+
+// size returns the number of bytes written to the WAL so far.
+func (w *wal[ID, T]) size() (int64, error) {
+	if err := w.drain(); err != nil {
+		return 0, err
+	}
+	if err := w.w.Flush(); err != nil {
+		return 0, err
+	}
+	info, err := w.file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// dropBefore discards the first mark bytes of the WAL, keeping every op
+// appended after them. The ops kept are written to a new file, synced and
+// renamed over the WAL, so a crash leaves either WAL whole.
+func (w *wal[ID, T]) dropBefore(mark int64) error {
+	if w.group != nil {
+		// waitSync syncs w.file without the store lock
+		w.group.writers.Wait()
+	}
+	end, err := w.size()
+	if err != nil {
+		return err
+	}
+
+	tail := make([]byte, end-mark)
+	if _, err := w.file.ReadAt(tail, mark); err != nil && err != io.EOF {
+		return err
+	}
+
+	// the new file stays open as the WAL once renamed
+	tmp := w.path + ".tmp"
+	f, err := w.fs.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_APPEND|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(tail)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = w.fs.Rename(tmp, w.path)
+	}
+	if err != nil {
+		f.Close()
+		w.fs.Remove(tmp)
+		return err
+	}
+
+	w.file.Close()
+	w.file = f
+	w.w.Reset(f)
+	return nil
 }
 
 func (w *wal[ID, T]) close() error {
-	return w.file.Close()
+	if w.group != nil {
+		w.group.writers.Wait()
+	}
+	var err error
+	if w.buffer != nil {
+		err = w.flush()
+	}
+	return errors.Join(err, w.file.Close())
 }
@@ -0,0 +1,161 @@
+package flea
+
+import "sync"
+
+// EventOp is the kind of change an Event reports.
+type EventOp int
+
+const (
+	// EventPut reports an insert or an update.
+	EventPut EventOp = iota
+	// EventDelete reports a delete.
+	EventDelete
+)
+
+// Event is a change committed to a store. Value is the stored value for
+// EventPut and the deleted one for EventDelete.
+type Event[ID comparable, T any] struct {
+	Op    EventOp
+	ID    ID
+	Value T
+}
+
+// watcher queues the events of one subscriber, so a slow reader never
+// blocks writers nor loses events.
+type watcher[ID comparable, T any] struct {
+	mu    sync.Mutex
+	queue []Event[ID, T]
+	wake  chan struct{}
+	out   chan Event[ID, T]
+	done  chan struct{}
+	once  sync.Once
+}
+
+func newWatcher[ID comparable, T any]() *watcher[ID, T] {
+	w := &watcher[ID, T]{
+		wake: make(chan struct{}, 1),
+		out:  make(chan Event[ID, T]),
+		done: make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+func (w *watcher[ID, T]) push(e Event[ID, T]) {
+	w.mu.Lock()
+	w.queue = append(w.queue, e)
+	w.mu.Unlock()
+
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (w *watcher[ID, T]) run() {
+	defer close(w.out)
+
+	for {
+		w.mu.Lock()
+		queue := w.queue
+		w.queue = nil
+		w.mu.Unlock()
+
+		for _, e := range queue {
+			select {
+			case w.out <- e:
+			case <-w.done:
+				return
+			}
+		}
+
+		select {
+		case <-w.wake:
+		case <-w.done:
+			return
+		}
+	}
+}
+
+func (w *watcher[ID, T]) stop() {
+	w.once.Do(func() { close(w.done) })
+}
+
+// Watch streams every change committed from now on, in commit order. The
+// channel is closed once cancel is called or the store is closed. Events
+// are queued for slow readers rather than dropped, so the channel must be
+// drained or cancelled.
+func (s *Store[ID, T]) Watch() (<-chan Event[ID, T], func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.subscribe()
+}
+
+// WatchFrom is like Watch, but also returns the live values at the moment
+// of the subscription, in insertion order. Both are taken under the store
+// lock, so every change is either part of initial or delivered as an event,
+// never both and never neither. With GroupCommitWindow, a put still
+// awaiting its fsync is left out of initial: its event follows once it is
+// durable, and a put rolled back by a failed fsync is never seen.
+func (s *Store[ID, T]) WatchFrom() ([]T, <-chan Event[ID, T], func(), error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	initial := make([]T, 0, s.onlineCount+s.offlineCount)
+	for _, rec := range s.records {
+		if rec.deleted {
+			continue
+		}
+		if gs := s.pending[rec]; len(gs) > 0 {
+			// the value before the first pending put, if it had one
+			if g := gs[0]; g.old != nil && !s.appendOnly {
+				initial = append(initial, s.clone(*g.old))
+			}
+			continue
+		}
+		v, err := s.valueOf(rec)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if !rec.offloaded {
+			v = s.clone(v)
+		}
+		initial = append(initial, v)
+	}
+
+	events, cancel := s.subscribe()
+	return initial, events, cancel, nil
+}
+
+func (s *Store[ID, T]) subscribe() (<-chan Event[ID, T], func()) {
+	w := newWatcher[ID, T]()
+	if s.watchers == nil {
+		s.watchers = make(map[*watcher[ID, T]]struct{})
+	}
+	s.watchers[w] = struct{}{}
+
+	cancel := func() {
+		s.mu.Lock()
+		delete(s.watchers, w)
+		s.mu.Unlock()
+		w.stop()
+	}
+	return w.out, cancel
+}
+
+// notify hands a committed change to every watcher. It runs under s.mu,
+// right after the change is applied.
+func (s *Store[ID, T]) notify(op EventOp, id ID, value T) {
+	for w := range s.watchers {
+		w.push(Event[ID, T]{Op: op, ID: id, Value: s.clone(value)})
+	}
+}
+
+// stopWatchers closes the channel of every watcher. It runs under s.mu.
+func (s *Store[ID, T]) stopWatchers() {
+	for w := range s.watchers {
+		w.stop()
+	}
+	s.watchers = nil
+}
@@ -0,0 +1,89 @@
+package flea
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWatch_ReportsPutsAndDeletes(t *testing.T) {
+	s := openUserStore(t, t.TempDir())
+	defer s.Close()
+
+	events, cancel := s.Watch()
+	defer cancel()
+
+	s.Put(User{Id: 1, Name: "Alice"})
+	s.Delete(func(u User) bool { return u.Id == 1 })
+
+	want := []Event[uint64, User]{
+		{Op: EventPut, ID: 1, Value: User{Id: 1, Name: "Alice"}},
+		{Op: EventDelete, ID: 1, Value: User{Id: 1, Name: "Alice"}},
+	}
+	for i, w := range want {
+		select {
+		case e := <-events:
+			if e != w {
+				t.Fatalf("event %d: expected %+v, got %+v", i, w, e)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("event %d not delivered", i)
+		}
+	}
+
+	cancel()
+	if _, ok := <-events; ok {
+		t.Fatalf("expected the channel to be closed after cancel")
+	}
+}
+
+func TestWatchFrom_NoGapNoDuplicate(t *testing.T) {
+	s := openUserStore(t, t.TempDir())
+	defer s.Close()
+
+	const total = 2000
+	started := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 1; i <= total; i++ {
+			if i == total/4 {
+				close(started)
+			}
+			s.Put(User{Id: uint64(i)})
+		}
+	}()
+
+	<-started
+	initial, events, cancel, err := s.WatchFrom()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cancel()
+
+	seen := make(map[uint64]int, total)
+	for _, u := range initial {
+		seen[u.Id]++
+	}
+	<-done
+
+	timeout := time.After(5 * time.Second)
+	for len(seen) < total {
+		select {
+		case e := <-events:
+			seen[e.ID]++
+		case <-timeout:
+			t.Fatalf("only %d of %d ids seen", len(seen), total)
+		}
+	}
+
+	for id, n := range seen {
+		if n != 1 {
+			t.Fatalf("id %d seen %d times", id, n)
+		}
+	}
+	select {
+	case e := <-events:
+		t.Fatalf("unexpected extra event %+v", e)
+	case <-time.After(50 * time.Millisecond):
+	}
+}